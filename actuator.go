@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// chargerActuator sits between the consumers and haService for current
+// commands. It drops writes of the value already applied, enforces a minimum
+// interval between writes per entity and queues only the latest value in
+// between. Safety reductions are always written at once.
+type chargerActuator struct {
+	ha          *haService
+	minInterval time.Duration
+
+	mu       sync.Mutex
+	entities map[string]*actuatorEntity
+	saved    int
+}
+
+type actuatorEntity struct {
+	value      int // last value written
+	written    bool
+	lastWrite  time.Time
+	pending    int
+	hasPending bool
+	timer      *time.Timer
+}
+
+func newChargerActuator(ha *haService, minInterval time.Duration) *chargerActuator {
+	a := &chargerActuator{
+		ha:          ha,
+		minInterval: minInterval,
+		entities:    make(map[string]*actuatorEntity),
+	}
+	ha.onCommandResult(a.commandResult)
+	return a
+}
+
+// setAmps requests a current setting. safety marks reductions that must not
+// wait for the minimum interval.
+func (a *chargerActuator) setAmps(entity string, amps int, safety bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	e, ok := a.entities[entity]
+	if !ok {
+		e = &actuatorEntity{}
+		a.entities[entity] = e
+	}
+
+	if e.written && amps == e.value {
+		if e.hasPending {
+			// Back to the applied value before the queued one went out
+			e.hasPending = false
+			e.timer.Stop()
+			a.savedInternal(1)
+		}
+		a.savedInternal(1)
+		return
+	}
+
+	wait := a.minInterval - time.Since(e.lastWrite)
+	if safety || !e.written || wait <= 0 {
+		if e.hasPending {
+			e.hasPending = false
+			e.timer.Stop()
+			a.savedInternal(1)
+		}
+		a.writeInternal(entity, e, amps)
+		return
+	}
+
+	if e.hasPending {
+		// The queued value is replaced and never sent
+		a.savedInternal(1)
+		e.pending = amps
+		return
+	}
+	e.pending = amps
+	e.hasPending = true
+	e.timer = time.AfterFunc(wait, func() { a.flush(entity) })
+}
+
+func (a *chargerActuator) flush(entity string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e := a.entities[entity]
+	if e == nil || !e.hasPending {
+		return
+	}
+	e.hasPending = false
+	a.writeInternal(entity, e, e.pending)
+}
+
+func (a *chargerActuator) writeInternal(entity string, e *actuatorEntity, amps int) {
+	e.value = amps
+	e.written = true
+	e.lastWrite = time.Now()
+	a.ha.updateAmpsDawn(amps, entity)
+}
+
+func (a *chargerActuator) savedInternal(n int) {
+	a.saved += n
+	metrics.addCounter("electricity_charger_commands_saved_total", float64(n))
+}
+
+// commandResult forgets the applied value of an entity whose command could
+// not be confirmed, so the next request is written again.
+func (a *chargerActuator) commandResult(entity string, err error) {
+	if err == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if e, ok := a.entities[entity]; ok {
+		e.written = false
+	}
+}
+
+// commandsSaved returns how many writes were dropped or collapsed.
+func (a *chargerActuator) commandsSaved() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.saved
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordedWrites struct {
+	mu     sync.Mutex
+	values []string
+}
+
+func (r *recordedWrites) call(domain string, service string, data map[string]string, entity string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.values = append(r.values, data["value"])
+	return nil
+}
+
+func (r *recordedWrites) get() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.values...)
+}
+
+func newTestActuator(minInterval time.Duration) (*chargerActuator, *recordedWrites) {
+	writes := &recordedWrites{}
+	ha := &haService{context: context.Background(), commands: newCommandVerifier(writes.call, nil)}
+	return newChargerActuator(ha, minInterval), writes
+}
+
+func TestChargerActuator_DropsDuplicates(t *testing.T) {
+	a, writes := newTestActuator(0)
+
+	a.setAmps("number.dawn_amps", 10, false)
+	a.setAmps("number.dawn_amps", 10, false)
+	a.setAmps("number.dawn_amps", 10, true)
+
+	assert.Eventually(t, func() bool { return len(writes.get()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, a.commandsSaved())
+}
+
+func TestChargerActuator_QueuesLatestValue(t *testing.T) {
+	a, writes := newTestActuator(100 * time.Millisecond)
+
+	a.setAmps("number.dawn_amps", 10, false)
+	a.setAmps("number.dawn_amps", 11, false)
+	a.setAmps("number.dawn_amps", 12, false)
+	a.setAmps("number.dawn_amps", 13, false)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"10"}, writes.get())
+
+	assert.Eventually(t, func() bool { return len(writes.get()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"10", "13"}, writes.get())
+	assert.Equal(t, 2, a.commandsSaved())
+}
+
+func TestChargerActuator_SafetyReductionBypassesInterval(t *testing.T) {
+	a, writes := newTestActuator(time.Hour)
+
+	a.setAmps("number.dawn_amps", 12, false)
+	assert.Eventually(t, func() bool { return len(writes.get()) == 1 }, time.Second, 5*time.Millisecond)
+	a.setAmps("number.dawn_amps", 14, false)
+	a.setAmps("number.dawn_amps", 8, true)
+
+	assert.Eventually(t, func() bool { return len(writes.get()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"12", "8"}, writes.get())
+}
+
+func TestChargerActuator_RewritesAfterFailedCommand(t *testing.T) {
+	a, writes := newTestActuator(0)
+
+	a.setAmps("number.dawn_amps", 10, false)
+	assert.Eventually(t, func() bool { return len(writes.get()) == 1 }, time.Second, 5*time.Millisecond)
+	a.commandResult("number.dawn_amps", assert.AnError)
+	a.setAmps("number.dawn_amps", 10, false)
+
+	assert.Eventually(t, func() bool { return len(writes.get()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, a.commandsSaved())
+}
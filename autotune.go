@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// tuneChargerLag is the time constant in seconds the car follows a new
+	// current setting with.
+	tuneChargerLag = 10.0
+	// tuneUnusedWeight and tuneCommandCost weigh unused headroom (A·s) and
+	// charger commands against overshoot (A·s) in the tuning cost.
+	tuneUnusedWeight = 0.1
+	tuneCommandCost  = 30.0
+)
+
+// tuneResult is the outcome of one simulated run.
+type tuneResult struct {
+	tuning    pidTuning
+	overshoot float64 // A·s above the setpoint (fuse) or of grid import (PV-only)
+	unused    float64 // A·s of headroom left while below the maximum current
+	commands  int     // charger current changes
+}
+
+func (r tuneResult) cost() float64 {
+	return r.overshoot + tuneUnusedWeight*r.unused + tuneCommandCost*float64(r.commands)
+}
+
+func (r tuneResult) String() string {
+	return fmt.Sprintf("%s: overshoot %.0fA·s, unused %.0fA·s, %d commands, cost %.0f", r.tuning, r.overshoot, r.unused, r.commands, r.cost())
+}
+
+// simulatePID runs the consumer's PID layer every period against a simple
+// house and charger model at 1s resolution. load is the household current on the
+// highest phase (fuse) or the export per phase before the charger (PV-only),
+// one value per second. The charger runs from 6A to 16A and follows its
+// setting with a first order lag.
+func simulatePID(tuning pidTuning, pvOnly bool, setpoint float64, period time.Duration, load []float64) tuneResult {
+	result := tuneResult{tuning: tuning}
+	pid := &PIDController{Setpoint: setpoint}
+	pid.apply(tuning)
+	steps := int(math.Max(1, period.Seconds()))
+	current, setting, actual := 6.0, 6, 6.0
+
+	for second, value := range load {
+		actual += (float64(setting) - actual) / tuneChargerLag
+		measured := value + actual
+		if pvOnly {
+			measured = value - actual
+		}
+
+		if pvOnly {
+			result.overshoot += math.Max(0, -measured)
+		} else {
+			result.overshoot += math.Max(0, measured-setpoint)
+		}
+		if setting < 16 {
+			if pvOnly {
+				result.unused += math.Max(0, measured-setpoint)
+			} else {
+				result.unused += math.Max(0, setpoint-measured)
+			}
+		}
+
+		if second%steps != 0 {
+			continue
+		}
+		adjustment := pid.UpdateWithDt(measured, float64(steps))
+		if pvOnly {
+			adjustment = -adjustment
+		}
+		current = math.Max(6, math.Min(16, current+adjustment))
+		if int(current) != setting {
+			setting = int(current)
+			result.commands++
+		}
+	}
+	return result
+}
+
+// stepTestLoad is the default disturbance of an hour: load steps, a stretch
+// of short spikes and a slow drift for the fuse mode, and passing clouds and
+// a slow decline for PV-only mode.
+func stepTestLoad(pvOnly bool) []float64 {
+	load := make([]float64, 3600)
+	for s := range load {
+		minute := s / 60
+		switch {
+		case pvOnly && minute < 10:
+			load[s] = 14
+		case pvOnly && minute < 13:
+			load[s] = 5 // cloud
+		case pvOnly && minute < 30:
+			load[s] = 16
+		case pvOnly && minute < 32:
+			load[s] = 7
+		case pvOnly:
+			load[s] = 16 - 10*float64(s-32*60)/float64(28*60)
+		case minute < 5:
+			load[s] = 4
+		case minute < 15:
+			load[s] = 12
+		case minute < 25:
+			load[s] = 2
+		case minute < 40:
+			load[s] = 8
+			if s%120 < 20 {
+				load[s] += 6 // kettle, compressor starts
+			}
+		default:
+			load[s] = 6 + 4*float64(s-40*60)/float64(20*60)
+		}
+	}
+	return load
+}
+
+// readTuneLog reads a recorded "time,current" CSV. The time is seconds or
+// RFC3339, the log is resampled to 1s by holding each value.
+func readTuneLog(r io.Reader) ([]float64, error) {
+	type sample struct {
+		at    float64
+		value float64
+	}
+	var samples []sample
+	var origin time.Time
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, ",")
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected time,current", line)
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(fields[1]), 64)
+		if err != nil {
+			if len(samples) == 0 {
+				continue // header
+			}
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		at, err := strconv.ParseFloat(strings.TrimSpace(fields[0]), 64)
+		if err != nil {
+			t, terr := time.Parse(time.RFC3339, strings.TrimSpace(fields[0]))
+			if terr != nil {
+				return nil, fmt.Errorf("line %d: invalid time %q", line, fields[0])
+			}
+			if origin.IsZero() {
+				origin = t
+			}
+			at = t.Sub(origin).Seconds()
+		}
+		samples = append(samples, sample{at: at, value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(samples) < 2 {
+		return nil, errors.New("the log needs at least two samples")
+	}
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].at < samples[j].at })
+
+	var load []float64
+	first := samples[0].at
+	for i, s := range samples {
+		end := samples[len(samples)-1].at - first + 1
+		if i+1 < len(samples) {
+			end = samples[i+1].at - first
+		}
+		for float64(len(load)) < end {
+			load = append(load, s.value)
+		}
+	}
+	return load, nil
+}
+
+// autotune simulates a grid of gains and deadbands around base and returns
+// the runs ordered by cost, together with the run of base itself.
+func autotune(pvOnly bool, setpoint float64, period time.Duration, load []float64, base pidTuning) ([]tuneResult, tuneResult) {
+	var results []tuneResult
+	for _, kp := range []float64{0.1, 0.2, 0.3, 0.4, 0.6, 0.8, 1.0} {
+		for _, ki := range []float64{0, 0.005, 0.01, 0.02, 0.05} {
+			for _, kd := range []float64{0, 0.05, 0.1, 0.2} {
+				for _, deadband := range []float64{0, 0.5, 1} {
+					tuning := base
+					tuning.Kp, tuning.Ki, tuning.Kd, tuning.Deadband = kp, ki, kd, deadband
+					results = append(results, simulatePID(tuning, pvOnly, setpoint, period, load))
+				}
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool { return results[i].cost() < results[j].cost() })
+	return results, simulatePID(base, pvOnly, setpoint, period, load)
+}
+
+// runAutotune is the "autotune" command. It prints the best tunings for a
+// mode on the step test or a recorded log.
+func runAutotune(args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("autotune", flag.ContinueOnError)
+	mode := fs.String("mode", "fuse", "control mode: fuse or pv")
+	logPath := fs.String("log", "", "recorded time,current CSV instead of the step test")
+	setpoint := fs.Float64("setpoint", 0, "setpoint in A (default 20 for fuse, 0.5 for pv)")
+	baseSpec := fs.String("base", "", "tuning to compare with and take the integral, rate and derivative filter settings from")
+	period := fs.Duration("period", defaultControlPeriod, "control period, as CONTROL_PERIOD")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	pvOnly := false
+	switch *mode {
+	case "fuse":
+		if *setpoint == 0 {
+			*setpoint = MAX_PHASE_CURRENT
+		}
+	case "pv":
+		pvOnly = true
+		if *setpoint == 0 {
+			*setpoint = 0.5
+		}
+	default:
+		return fmt.Errorf("unknown mode %q", *mode)
+	}
+	base, err := parsePIDTuning(*baseSpec, defaultPIDTuning)
+	if err != nil {
+		return err
+	}
+
+	load := stepTestLoad(pvOnly)
+	if *logPath != "" {
+		f, err := os.Open(*logPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if load, err = readTuneLog(f); err != nil {
+			return fmt.Errorf("%s: %v", *logPath, err)
+		}
+	}
+
+	if *period < time.Second {
+		return fmt.Errorf("period %v is shorter than the simulation step", *period)
+	}
+
+	results, baseline := autotune(pvOnly, *setpoint, *period, load, base)
+	fmt.Fprintf(out, "Simulated %d tunings over %v.\n", len(results), time.Duration(len(load))*time.Second)
+	fmt.Fprintf(out, "Current  %s\n", baseline)
+	for i := 0; i < 5 && i < len(results); i++ {
+		fmt.Fprintf(out, "#%d       %s\n", i+1, results[i])
+	}
+	variable := "PID_FUSE"
+	if pvOnly {
+		variable = "PID_PV"
+	}
+	fmt.Fprintf(out, "Suggested: %s=%s\n", variable, results[0].tuning)
+	return nil
+}
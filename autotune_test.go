@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAutotune_BeatsDefault(t *testing.T) {
+	for _, pvOnly := range []bool{false, true} {
+		setpoint := 20.0
+		if pvOnly {
+			setpoint = 0.5
+		}
+		results, baseline := autotune(pvOnly, setpoint, defaultControlPeriod, stepTestLoad(pvOnly), defaultPIDTuning)
+		assert.LessOrEqual(t, results[0].cost(), baseline.cost())
+		assert.LessOrEqual(t, results[0].commands, baseline.commands)
+		assert.LessOrEqual(t, results[0].cost(), results[len(results)-1].cost())
+	}
+}
+
+func TestSimulatePID_FollowsLoad(t *testing.T) {
+	// 10A of household load leaves room for the full 16A below 30A
+	load := make([]float64, 1200)
+	for i := range load {
+		load[i] = 10
+	}
+	result := simulatePID(defaultPIDTuning, false, 30, defaultControlPeriod, load)
+	assert.Equal(t, 0.0, result.overshoot)
+	assert.Equal(t, 3, result.commands, "6A to 16A in a few large steps")
+
+	// Without any export, PV-only mode stays at the minimum
+	result = simulatePID(defaultPIDTuning, true, 0.5, defaultControlPeriod, make([]float64, 1200))
+	assert.Equal(t, 0, result.commands)
+	assert.Greater(t, result.overshoot, 0.0, "the minimum current is imported")
+}
+
+func TestReadTuneLog(t *testing.T) {
+	load, err := readTuneLog(strings.NewReader("time,current\n0,5\n2,7.5\n# comment\n3,4\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{5, 5, 7.5, 4}, load)
+
+	load, err = readTuneLog(strings.NewReader("2025-06-01T10:00:00Z,8\n2025-06-01T10:00:03Z,9\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, []float64{8, 8, 8, 9}, load)
+
+	_, err = readTuneLog(strings.NewReader("0,5\n"))
+	assert.Error(t, err)
+	_, err = readTuneLog(strings.NewReader("0,5\nsoon,6\n"))
+	assert.Error(t, err)
+}
+
+func TestRunAutotune(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, runAutotune([]string{"-mode", "pv"}, &out))
+	assert.Contains(t, out.String(), "Suggested: PID_PV=kp=")
+
+	assert.Error(t, runAutotune([]string{"-mode", "solar"}, &out))
+	assert.Error(t, runAutotune([]string{"-base", "kp=x"}, &out))
+	assert.Error(t, runAutotune([]string{"-period", "500ms"}, &out))
+}
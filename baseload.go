@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// baseLoadSlot is the resolution of the base load profile.
+	baseLoadSlot = 15 * time.Minute
+	// baseLoadAlpha weights a new week against the history, so the profile
+	// follows the seasons.
+	baseLoadAlpha = 0.2
+	// baseLoadHighWeight makes the high estimate follow readings above it
+	// nine times faster than those below, the 90% expectile.
+	baseLoadHighWeight = 0.9
+	// baseLoadMinSamples is how many weeks a slot needs before it is used.
+	baseLoadMinSamples = 3
+)
+
+// baseLoadKey is one slot of the week on one phase, in local time.
+type baseLoadKey struct {
+	Weekday time.Weekday `json:"weekday"`
+	Slot    int          `json:"slot"` // quarter hour of the day
+	Phase   int          `json:"phase"`
+}
+
+// baseLoadStats is the learned household current of a slot in A.
+type baseLoadStats struct {
+	baseLoadKey
+	Mean    float64 `json:"mean"`
+	High    float64 `json:"high"` // 90% expectile, a robust high estimate
+	Samples int     `json:"samples"`
+}
+
+func (s *baseLoadStats) add(current float64) {
+	if s.Samples == 0 {
+		s.Mean, s.High = current, current
+	} else {
+		// Average the first weeks, then decay exponentially
+		alpha := math.Max(baseLoadAlpha, 1/float64(s.Samples+1))
+		s.Mean += alpha * (current - s.Mean)
+		weight := 1 - baseLoadHighWeight
+		if current > s.High {
+			weight = baseLoadHighWeight
+		}
+		s.High += 2 * alpha * weight * (current - s.High)
+	}
+	s.Samples++
+}
+
+func baseLoadKeyAt(t time.Time, phase int) baseLoadKey {
+	local := t.In(time.Local)
+	return baseLoadKey{Weekday: local.Weekday(), Slot: (local.Hour()*60 + local.Minute()) / int(baseLoadSlot/time.Minute), Phase: phase}
+}
+
+// baseLoadForecaster learns the household current per phase, without the
+// EV, by weekday and quarter hour from the same readings as the consumer.
+type baseLoadForecaster struct {
+	topology  PhaseTopology
+	evCurrent func() map[int]float64 // EV current per installation phase in A
+
+	ha        *haService
+	sensor    string        // HA sensor the forecast is published to
+	path      string        // JSON file the profile is kept in, empty to not persist
+	lookahead time.Duration // how far ahead a peak holds back a start
+
+	mu          sync.Mutex
+	imports     map[int]float64
+	directional map[int]bool
+	lastUpdate  time.Time
+	slotStart   time.Time
+	sums        map[int]float64 // A·s of household current in the current slot
+	seconds     float64         // integrated time in the current slot
+	stats       map[baseLoadKey]*baseLoadStats
+}
+
+func newBaseLoadForecaster(topology PhaseTopology, evCurrent func() map[int]float64) *baseLoadForecaster {
+	return &baseLoadForecaster{
+		topology:    topology,
+		evCurrent:   evCurrent,
+		imports:     make(map[int]float64),
+		directional: make(map[int]bool),
+		sums:        make(map[int]float64),
+		stats:       make(map[baseLoadKey]*baseLoadStats),
+	}
+}
+
+// update integrates the household current up to now and then applies the
+// reading.
+func (b *baseLoadForecaster) update(pe *powerEvent) {
+	b.updateAt(pe, time.Now())
+}
+
+func (b *baseLoadForecaster) updateAt(pe *powerEvent, now time.Time) {
+	// Read the EV before locking, the consumer calls into the forecaster
+	var ev map[int]float64
+	if b.evCurrent != nil {
+		ev = b.evCurrent()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.lastUpdate.IsZero() && now.Sub(b.lastUpdate) <= maxLedgerGap {
+		b.integrateInternal(b.lastUpdate, now, ev)
+	}
+	b.lastUpdate = now
+
+	// Only the import is learned, the export is not kept
+	flow := phaseFlow{imported: b.imports[pe.phaseIndex], directional: b.directional[pe.phaseIndex]}
+	if flow.apply(pe) {
+		b.imports[pe.phaseIndex], b.directional[pe.phaseIndex] = flow.imported, flow.directional
+	}
+}
+
+// integrateInternal adds the household current over [from, to), finishing
+// each slot it passes.
+func (b *baseLoadForecaster) integrateInternal(from time.Time, to time.Time, ev map[int]float64) {
+	for from.Before(to) {
+		slot := from.Truncate(baseLoadSlot)
+		if !slot.Equal(b.slotStart) {
+			b.finishSlotInternal()
+			b.slotStart = slot
+		}
+		end := slot.Add(baseLoadSlot)
+		if to.Before(end) {
+			end = to
+		}
+		seconds := end.Sub(from).Seconds()
+		for _, phase := range b.topology.phases() {
+			b.sums[phase] += math.Max(0, b.imports[phase]-ev[phase]) * seconds
+		}
+		b.seconds += seconds
+		from = end
+	}
+}
+
+// finishSlotInternal adds the average of the current slot to the profile.
+// Slots with readings for less than half of the time are dropped.
+func (b *baseLoadForecaster) finishSlotInternal() {
+	if !b.slotStart.IsZero() && b.seconds >= baseLoadSlot.Seconds()/2 {
+		for _, phase := range b.topology.phases() {
+			key := baseLoadKeyAt(b.slotStart, phase)
+			s, ok := b.stats[key]
+			if !ok {
+				s = &baseLoadStats{baseLoadKey: key}
+				b.stats[key] = s
+			}
+			s.add(b.sums[phase] / b.seconds)
+		}
+	}
+	b.sums = make(map[int]float64)
+	b.seconds = 0
+}
+
+// forecast returns the learned mean and high household current of a phase at
+// t, and false while the slot has too few samples.
+func (b *baseLoadForecaster) forecast(t time.Time, phase int) (float64, float64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s, ok := b.stats[baseLoadKeyAt(t, phase)]
+	if !ok || s.Samples < baseLoadMinSamples {
+		return 0, 0, false
+	}
+	return s.Mean, s.High, true
+}
+
+// peak returns the highest expected household current over the phases in
+// [from, to), the slot it falls in and the phase. The high estimate is used,
+// so a peak that happens most weeks is found.
+func (b *baseLoadForecaster) peak(from time.Time, to time.Time, phases []int) (float64, time.Time, int) {
+	if b == nil {
+		return 0, time.Time{}, 0
+	}
+	highest, at, on := 0.0, time.Time{}, 0
+	for t := from.Truncate(baseLoadSlot); t.Before(to); t = t.Add(baseLoadSlot) {
+		for _, phase := range phases {
+			if _, high, ok := b.forecast(t, phase); ok && high > highest {
+				highest, at, on = high, t, phase
+			}
+		}
+	}
+	return highest, at, on
+}
+
+// publish publishes the expected household current of the current slot and
+// the coming day.
+func (b *baseLoadForecaster) publish(now time.Time) {
+	if b.sensor == "" {
+		return
+	}
+	slot := now.Truncate(baseLoadSlot)
+	state := "unknown"
+	if total, ok := b.total(slot); ok {
+		state = fmt.Sprintf("%.1f", total)
+	}
+	var series []map[string]interface{}
+	for t := slot; t.Before(slot.Add(24 * time.Hour)); t = t.Add(baseLoadSlot) {
+		entry := map[string]interface{}{"start": t.Format(time.RFC3339)}
+		for _, phase := range b.topology.phases() {
+			if mean, high, ok := b.forecast(t, phase); ok {
+				entry[fmt.Sprintf("phase%d", phase)] = math.Round(mean*10) / 10
+				entry[fmt.Sprintf("phase%d_high", phase)] = math.Round(high*10) / 10
+			}
+		}
+		if len(entry) > 1 {
+			series = append(series, entry)
+		}
+	}
+	attributes := map[string]interface{}{
+		"friendly_name":       "Household base load forecast",
+		"unit_of_measurement": "A",
+		"forecast":            series,
+	}
+	if current, at, phase := b.peak(slot, slot.Add(24*time.Hour), b.topology.phases()); phase != 0 {
+		attributes["peak"] = math.Round(current*10) / 10
+		attributes["peak_start"] = at.Format(time.RFC3339)
+		attributes["peak_phase"] = phase
+	}
+	if err := b.ha.publishState(b.sensor, state, attributes); err != nil {
+		log.Printf("BASELOAD: could not publish %s: %v", b.sensor, err)
+	}
+}
+
+// total sums the mean household current over the phases of a slot.
+func (b *baseLoadForecaster) total(t time.Time) (float64, bool) {
+	total := 0.0
+	for _, phase := range b.topology.phases() {
+		mean, _, ok := b.forecast(t, phase)
+		if !ok {
+			return 0, false
+		}
+		total += mean
+	}
+	return total, true
+}
+
+func (b *baseLoadForecaster) save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.mu.Lock()
+	stats := make([]baseLoadStats, 0, len(b.stats))
+	for _, s := range b.stats {
+		stats = append(stats, *s)
+	}
+	b.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		a, c := stats[i], stats[j]
+		if a.Weekday != c.Weekday {
+			return a.Weekday < c.Weekday
+		}
+		if a.Slot != c.Slot {
+			return a.Slot < c.Slot
+		}
+		return a.Phase < c.Phase
+	})
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+func (b *baseLoadForecaster) load() error {
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return err
+	}
+	var stats []baseLoadStats
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range stats {
+		s := s
+		b.stats[s.baseLoadKey] = &s
+	}
+	return nil
+}
+
+// run publishes and saves the profile every slot.
+func (b *baseLoadForecaster) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		b.publish(now)
+		if err := b.save(); err != nil {
+			log.Printf("BASELOAD: could not save %s: %v", b.path, err)
+		}
+		if !sleepContext(ctx, time.Until(now.Truncate(baseLoadSlot).Add(baseLoadSlot))) {
+			return
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// feedBaseLoad reads the phase 1 current every minute over [from, to).
+func feedBaseLoad(b *baseLoadForecaster, from time.Time, to time.Time, current float64) {
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		b.updateAt(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: current}, t)
+	}
+}
+
+func TestBaseLoadStats(t *testing.T) {
+	s := &baseLoadStats{}
+	s.add(10)
+	s.add(20)
+	assert.Equal(t, 15.0, s.Mean, "the first weeks are averaged")
+	assert.Greater(t, s.High, s.Mean)
+
+	for i := 0; i < 50; i++ {
+		s.add(5)
+	}
+	assert.InDelta(t, 5.0, s.Mean, 0.01, "old weeks decay")
+	assert.Less(t, s.High, 8.0, "the high estimate follows lower readings slowly")
+}
+
+func TestBaseLoadForecaster_LearnsWeeklyProfile(t *testing.T) {
+	ev := map[int]float64{}
+	b := newBaseLoadForecaster(TopologyThreePhase, func() map[int]float64 { return ev })
+	monday := time.Date(2025, 9, 1, 17, 0, 0, 0, time.Local)
+
+	for week := 0; week < 3; week++ {
+		start := monday.AddDate(0, 0, 7*week)
+		feedBaseLoad(b, start, start.Add(15*time.Minute), 4)
+		feedBaseLoad(b, start.Add(15*time.Minute), start.Add(16*time.Minute), 22)
+		// The EV draws 10A of the 22A in the second slot
+		ev[1] = 10
+		feedBaseLoad(b, start.Add(16*time.Minute), start.Add(32*time.Minute), 22)
+		ev[1] = 0
+	}
+
+	mean, _, ok := b.forecast(monday.AddDate(0, 0, 21), 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 4.0, mean, 1e-9)
+	mean, _, ok = b.forecast(monday.AddDate(0, 0, 21).Add(20*time.Minute), 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 12.0, mean, 1e-9, "without the EV")
+
+	_, _, ok = b.forecast(monday.AddDate(0, 0, 22), 1)
+	assert.False(t, ok, "nothing learned for tuesdays")
+
+	current, at, phase := b.peak(monday.AddDate(0, 0, 21), monday.AddDate(0, 0, 21).Add(time.Hour), []int{1, 2, 3})
+	assert.InDelta(t, 12.0, current, 1e-9)
+	assert.True(t, at.Equal(monday.AddDate(0, 0, 21).Add(15*time.Minute)))
+	assert.Equal(t, 1, phase)
+
+	// Persisted across restarts
+	b.path = filepath.Join(t.TempDir(), "baseload.json")
+	assert.NoError(t, b.save())
+	restored := newBaseLoadForecaster(TopologyThreePhase, nil)
+	restored.path = b.path
+	assert.NoError(t, restored.load())
+	mean, _, ok = restored.forecast(monday.Add(20*time.Minute), 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 12.0, mean, 1e-9)
+
+	restored.path = filepath.Join(t.TempDir(), "missing.json")
+	assert.True(t, os.IsNotExist(restored.load()))
+}
+
+func TestBaseLoadForecaster_IdleExportSensorKeepsImport(t *testing.T) {
+	b := newBaseLoadForecaster(TopologySinglePhase, nil)
+	monday := time.Date(2025, 9, 1, 17, 0, 0, 0, time.Local)
+
+	for week := 0; week < 3; week++ {
+		start := monday.AddDate(0, 0, 7*week)
+		// Separate HA import and export sensors, the idle export one reporting last
+		for at := start; at.Before(start.Add(15 * time.Minute)); at = at.Add(time.Minute) {
+			b.updateAt(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 10}, at)
+			b.updateAt(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 0}, at)
+		}
+		// Exporting for the next slot
+		for at := start.Add(15 * time.Minute); at.Before(start.Add(32 * time.Minute)); at = at.Add(time.Minute) {
+			b.updateAt(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 4}, at)
+			b.updateAt(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 0}, at)
+		}
+	}
+
+	mean, _, ok := b.forecast(monday.AddDate(0, 0, 21), 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 10.0, mean, 1e-9)
+	mean, _, ok = b.forecast(monday.AddDate(0, 0, 21).Add(15*time.Minute), 1)
+	assert.True(t, ok)
+	assert.InDelta(t, 0.0, mean, 1e-9)
+}
+
+func TestDawnConsumer_HoldsStartBeforeHouseholdPeak(t *testing.T) {
+	b := newBaseLoadForecaster(TopologyThreePhase, nil)
+	b.lookahead = 30 * time.Minute
+	now := time.Now()
+	key := baseLoadKeyAt(now.Add(15*time.Minute), 2)
+	b.stats[key] = &baseLoadStats{baseLoadKey: key, Mean: 12, High: 16, Samples: 5}
+
+	service := &dawnConsumerService{
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		exports:            make(map[string]float64),
+		currents:           map[string]float64{"phase1": 4, "phase2": 4, "phase3": 4},
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+		baseLoad:           b,
+	}
+
+	service.calculateAndSetAmps()
+	assert.False(t, service.isCharging, "16A expected on phase 2 leaves no room for 6A")
+
+	b.stats[key].High = 13
+	service.calculateAndSetAmps()
+	assert.True(t, service.isCharging)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ChargeState is the charging state of the Dawn consumer.
+type ChargeState int
+
+const (
+	ChargeIdle               ChargeState = iota // not charging, nothing to wait for
+	ChargeWaitingForSurplus                     // PV-only mode, waiting for enough export
+	ChargeStarting                              // switched on, car not drawing yet
+	ChargeCharging                              // charging under PID control
+	ChargeThrottled                             // reduced by a safety layer, PID locked out
+	ChargeEmergencyStopped                      // stopped on overcurrent
+	ChargePvShortageCooldown                    // stopped on sustained grid import in PV-only mode
+	ChargeCarFull                               // the car ended the session
+	ChargeError                                 // the charger reports an error
+)
+
+func (s ChargeState) String() string {
+	switch s {
+	case ChargeIdle:
+		return "idle"
+	case ChargeWaitingForSurplus:
+		return "waiting_for_surplus"
+	case ChargeStarting:
+		return "starting"
+	case ChargeCharging:
+		return "charging"
+	case ChargeThrottled:
+		return "throttled"
+	case ChargeEmergencyStopped:
+		return "emergency_stopped"
+	case ChargePvShortageCooldown:
+		return "pv_shortage_cooldown"
+	case ChargeCarFull:
+		return "car_full"
+	case ChargeError:
+		return "error"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+func (s ChargeState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// pvShortageCooldown is how long charging stays off after a PV shortage stop
+// before it waits for surplus again.
+const pvShortageCooldown = 10 * time.Minute
+
+// chargeGuard is a condition that must hold for a transition to be taken.
+// since is when the current state was entered.
+type chargeGuard struct {
+	name  string
+	check func(tc *dawnConsumerService, since time.Time) bool
+}
+
+var (
+	guardEnabled  = &chargeGuard{"charging enabled", func(tc *dawnConsumerService, _ time.Time) bool { return tc.isCharging }}
+	guardDisabled = &chargeGuard{"charging disabled", func(tc *dawnConsumerService, _ time.Time) bool { return !tc.isCharging }}
+
+	guardCooledDown = &chargeGuard{"charging disabled and the cooldown over", func(tc *dawnConsumerService, since time.Time) bool {
+		return !tc.isCharging && time.Since(since) >= pvShortageCooldown
+	}}
+	guardEnabledAfterCooldown = &chargeGuard{"charging enabled and the cooldown over", func(tc *dawnConsumerService, since time.Time) bool {
+		return tc.isCharging && time.Since(since) >= pvShortageCooldown
+	}}
+)
+
+// chargeTransitions declares every allowed transition and its guard (nil for
+// none). States entered by switching the charger on require it to be enabled,
+// states entered by switching it off require it to be disabled. Charging does
+// not restart from a PV shortage before the cooldown is over.
+var chargeTransitions = map[ChargeState]map[ChargeState]*chargeGuard{
+	ChargeIdle: {
+		ChargeWaitingForSurplus: guardDisabled,
+		ChargeStarting:          guardEnabled,
+		ChargeCharging:          guardEnabled,
+		ChargeCarFull:           nil,
+		ChargeError:             nil,
+	},
+	ChargeWaitingForSurplus: {
+		ChargeIdle:     guardDisabled,
+		ChargeStarting: guardEnabled,
+		ChargeCharging: guardEnabled,
+		ChargeCarFull:  nil,
+		ChargeError:    nil,
+	},
+	ChargeStarting: {
+		ChargeIdle:               guardDisabled,
+		ChargeCharging:           guardEnabled,
+		ChargeThrottled:          guardEnabled,
+		ChargeEmergencyStopped:   guardDisabled,
+		ChargePvShortageCooldown: guardDisabled,
+		ChargeCarFull:            nil,
+		ChargeError:              nil,
+	},
+	ChargeCharging: {
+		ChargeIdle:               guardDisabled,
+		ChargeThrottled:          guardEnabled,
+		ChargeEmergencyStopped:   guardDisabled,
+		ChargePvShortageCooldown: guardDisabled,
+		ChargeCarFull:            nil,
+		ChargeError:              nil,
+	},
+	ChargeThrottled: {
+		ChargeIdle:               guardDisabled,
+		ChargeCharging:           guardEnabled,
+		ChargeEmergencyStopped:   guardDisabled,
+		ChargePvShortageCooldown: guardDisabled,
+		ChargeCarFull:            nil,
+		ChargeError:              nil,
+	},
+	ChargeEmergencyStopped: {
+		ChargeIdle:              guardDisabled,
+		ChargeWaitingForSurplus: guardDisabled,
+		ChargeStarting:          guardEnabled,
+		ChargeCharging:          guardEnabled,
+		ChargeError:             nil,
+	},
+	ChargePvShortageCooldown: {
+		ChargeIdle:              guardDisabled,
+		ChargeWaitingForSurplus: guardCooledDown,
+		ChargeStarting:          guardEnabledAfterCooldown,
+		ChargeCharging:          guardEnabledAfterCooldown,
+		ChargeError:             nil,
+	},
+	ChargeCarFull: {
+		ChargeIdle:     guardDisabled,
+		ChargeStarting: guardEnabled,
+		ChargeCharging: guardEnabled,
+		ChargeError:    nil,
+	},
+	ChargeError: {
+		ChargeIdle:     guardDisabled,
+		ChargeStarting: guardEnabled,
+		ChargeCharging: guardEnabled,
+		ChargeCarFull:  nil,
+	},
+}
+
+const chargeHistorySize = 50
+
+type chargeTransition struct {
+	From   ChargeState `json:"from"`
+	To     ChargeState `json:"to"`
+	Reason string      `json:"reason"`
+	At     time.Time   `json:"at"`
+}
+
+// chargeStateMachine holds the current state and a ring buffer of recent
+// transitions. The zero value starts in ChargeIdle.
+type chargeStateMachine struct {
+	mu      sync.Mutex
+	state   ChargeState
+	reason  string
+	since   time.Time
+	history []chargeTransition
+	next    int
+}
+
+// fire moves to a new state if the transition is declared and its guard
+// holds. Firing the current state only updates the reason.
+func (m *chargeStateMachine) fire(tc *dawnConsumerService, to ChargeState, reason string) (chargeTransition, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if to == m.state {
+		m.reason = reason
+		return chargeTransition{}, errNoTransition
+	}
+	guard, ok := chargeTransitions[m.state][to]
+	if !ok {
+		return chargeTransition{}, fmt.Errorf("transition %s -> %s is not allowed", m.state, to)
+	}
+	if guard != nil && !guard.check(tc, m.since) {
+		return chargeTransition{}, fmt.Errorf("transition %s -> %s requires %s", m.state, to, guard.name)
+	}
+
+	t := chargeTransition{From: m.state, To: to, Reason: reason, At: time.Now()}
+	m.state, m.reason, m.since = to, reason, t.At
+	if len(m.history) < chargeHistorySize {
+		m.history = append(m.history, t)
+	} else {
+		m.history[m.next] = t
+	}
+	m.next = (m.next + 1) % chargeHistorySize
+	return t, nil
+}
+
+var errNoTransition = errors.New("already in state")
+
+func (m *chargeStateMachine) current() (ChargeState, string, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state, m.reason, m.since
+}
+
+// recent returns up to n transitions, newest first.
+func (m *chargeStateMachine) recent(n int) []chargeTransition {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n > len(m.history) {
+		n = len(m.history)
+	}
+	out := make([]chargeTransition, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, m.history[(m.next-i+chargeHistorySize)%chargeHistorySize])
+	}
+	return out
+}
+
+// setChargeStateInternal fires a transition and publishes the new state. A
+// rejected transition is logged and leaves the state unchanged.
+func (tc *dawnConsumerService) setChargeStateInternal(to ChargeState, reason string) {
+	t, err := tc.charge.fire(tc, to, reason)
+	if err == errNoTransition {
+		return
+	}
+	if err != nil {
+		log.Printf("DAWN: charge state: %v (%s)", err, reason)
+		return
+	}
+	log.Printf("DAWN: charge state %s -> %s: %s", t.From, t.To, t.Reason)
+	metrics.setGauge("electricity_charge_state", float64(t.To))
+
+	if tc.chargeStateSensor == "" {
+		return
+	}
+	history := make([]string, 0, 5)
+	for _, h := range tc.charge.recent(5) {
+		history = append(history, fmt.Sprintf("%s %s -> %s: %s", h.At.Format("15:04:05"), h.From, h.To, h.Reason))
+	}
+	attributes := map[string]interface{}{
+		"friendly_name": "EV charge state",
+		"reason":        t.Reason,
+		"previous":      t.From.String(),
+		"since":         t.At.Format(time.RFC3339),
+		"history":       history,
+	}
+	go func() {
+		if err := tc.haService.publishState(tc.chargeStateSensor, t.To.String(), attributes); err != nil {
+			log.Printf("DAWN: could not publish charge state: %v", err)
+		}
+	}()
+}
+
+// chargeStateHandler serves the current state and transition history as JSON.
+func (tc *dawnConsumerService) chargeStateHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state, reason, since := tc.charge.current()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"state":   state,
+			"reason":  reason,
+			"since":   since,
+			"history": tc.charge.recent(chargeHistorySize),
+		})
+	})
+}
+
+// dailySummaryLines describes the charging of the last 24 hours for the daily
+// summary notification.
+func (tc *dawnConsumerService) dailySummaryLines() []string {
+	state, reason, _ := tc.charge.current()
+	counts := make(map[ChargeState]int)
+	for _, t := range tc.charge.recent(chargeHistorySize) {
+		if time.Since(t.At) > 24*time.Hour {
+			break
+		}
+		counts[t.To]++
+	}
+	return []string{
+		fmt.Sprintf("Charge state: %s (%s)", state, reason),
+		fmt.Sprintf("Starts: %d, throttled: %d, emergency stops: %d, PV shortage stops: %d",
+			counts[ChargeStarting], counts[ChargeThrottled], counts[ChargeEmergencyStopped], counts[ChargePvShortageCooldown]),
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChargeStateMachine_DeclaredTransitionsAndGuards(t *testing.T) {
+	tc := &dawnConsumerService{}
+	m := &tc.charge
+
+	_, err := m.fire(tc, ChargeThrottled, "not declared from idle")
+	assert.Error(t, err)
+
+	_, err = m.fire(tc, ChargeStarting, "guard fails while disabled")
+	assert.Error(t, err)
+
+	tc.isCharging = true
+	tr, err := m.fire(tc, ChargeStarting, "headroom")
+	assert.NoError(t, err)
+	assert.Equal(t, ChargeIdle, tr.From)
+
+	_, err = m.fire(tc, ChargeStarting, "again")
+	assert.Equal(t, errNoTransition, err)
+
+	state, reason, _ := m.current()
+	assert.Equal(t, ChargeStarting, state)
+	assert.Equal(t, "again", reason)
+}
+
+func TestChargeStateMachine_HistoryRingBuffer(t *testing.T) {
+	tc := &dawnConsumerService{isCharging: true}
+	m := &tc.charge
+	m.fire(tc, ChargeCharging, "start")
+	for i := 0; i < chargeHistorySize; i++ {
+		m.fire(tc, ChargeThrottled, "reduce")
+		m.fire(tc, ChargeCharging, "recover")
+	}
+
+	recent := m.recent(chargeHistorySize + 10)
+	assert.Len(t, recent, chargeHistorySize)
+	assert.Equal(t, ChargeCharging, recent[0].To)
+	assert.Equal(t, ChargeThrottled, recent[1].To)
+}
+
+func TestDawnConsumer_ChargeStateFollowsControlLoop(t *testing.T) {
+	tc := &dawnConsumerService{
+		haService:          &haService{},
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        6,
+		setpoint:           20,
+		currents:           map[string]float64{"phase1": 5, "phase2": 5, "phase3": 5},
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		pid:                &PIDController{Kp: 0.4, Ki: 0.01, Kd: 0.05, Setpoint: 20},
+	}
+
+	tc.calculateAndSetAmps()
+	state, reason, _ := tc.charge.current()
+	assert.Equal(t, ChargeStarting, state)
+	assert.Contains(t, reason, "headroom")
+
+	tc.connectorStatus = "charging"
+	tc.setChargeStateInternal(ChargeCharging, "car drawing current")
+	tc.currentAmps, tc.actualAmps = 12, 12
+	tc.currents["phase1"] = 23
+	tc.calculateAndSetAmps()
+	state, reason, _ = tc.charge.current()
+	assert.Equal(t, ChargeThrottled, state)
+	assert.Contains(t, reason, "hard safety")
+
+	recorder := httptest.NewRecorder()
+	tc.chargeStateHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/charge/state", nil))
+	var body struct {
+		State   string `json:"state"`
+		History []struct {
+			From string `json:"from"`
+			To   string `json:"to"`
+		} `json:"history"`
+	}
+	assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &body))
+	assert.Equal(t, "throttled", body.State)
+	assert.Len(t, body.History, 3)
+	assert.Equal(t, "charging", body.History[0].From)
+}
+
+func TestChargeStateMachine_PvShortageCooldownGuard(t *testing.T) {
+	tc := &dawnConsumerService{isCharging: true}
+	m := &tc.charge
+	m.fire(tc, ChargeCharging, "start")
+	tc.isCharging = false
+	_, err := m.fire(tc, ChargePvShortageCooldown, "grid import")
+	assert.NoError(t, err)
+
+	_, err = m.fire(tc, ChargeWaitingForSurplus, "too early")
+	assert.Error(t, err)
+	tc.isCharging = true
+	_, err = m.fire(tc, ChargeStarting, "too early")
+	assert.Error(t, err)
+
+	m.since = time.Now().Add(-pvShortageCooldown)
+	_, err = m.fire(tc, ChargeStarting, "cooldown over")
+	assert.NoError(t, err)
+}
+
+func TestDawnConsumer_PvShortageCooldownHoldsRestart(t *testing.T) {
+	tc := &dawnConsumerService{
+		isCharging:         true,
+		pvOnlyMode:         true,
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        6,
+		setpoint:           20,
+		exports:            map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0},
+		currents:           map[string]float64{"phase1": 2, "phase2": 2, "phase3": 0},
+		hasDirectionalData: map[string]bool{"phase1": true, "phase2": true, "phase3": true},
+		haService:          &haService{},
+		connectorStatus:    "charging",
+		pid:                &PIDController{},
+	}
+	tc.setChargeStateInternal(ChargeCharging, "car drawing current")
+
+	tc.pvShortageStartTime = time.Now().Add(-6 * time.Minute)
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.isCharging)
+	state, _, _ := tc.charge.current()
+	assert.Equal(t, ChargePvShortageCooldown, state)
+
+	// The sun returns at once, the surplus timer does not run during the cooldown
+	tc.currents = map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0}
+	tc.exports = map[string]float64{"phase1": 10, "phase2": 10, "phase3": 10}
+	tc.calculateAndSetAmps()
+	state, _, _ = tc.charge.current()
+	assert.Equal(t, ChargePvShortageCooldown, state)
+	assert.True(t, tc.pvSurplusStartTime.IsZero())
+
+	tc.charge.since = time.Now().Add(-pvShortageCooldown)
+	tc.calculateAndSetAmps()
+	state, reason, _ := tc.charge.current()
+	assert.Equal(t, ChargeWaitingForSurplus, state)
+	assert.Contains(t, reason, "cooldown")
+	assert.False(t, tc.pvSurplusStartTime.IsZero(), "the surplus timer starts once the cooldown is over")
+
+	tc.pvSurplusStartTime = time.Now().Add(-6 * time.Minute)
+	tc.calculateAndSetAmps()
+	assert.True(t, tc.isCharging)
+	state, _, _ = tc.charge.current()
+	assert.Equal(t, ChargeStarting, state)
+}
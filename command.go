@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	commandAttempts = 4
+	commandSettle   = 3 * time.Second
+	commandBackoff  = 2 * time.Second
+)
+
+// commandVerifier delivers commands to an entity and confirms them by
+// reading the entity state back, retrying with exponential backoff when the
+// call fails or the state does not match. A newer command to the same entity
+// supersedes the one in flight.
+type commandVerifier struct {
+	call     func(domain string, service string, data map[string]string, entity string) error
+	read     func(entity string) (string, bool) // false when the state is unknown
+	settle   time.Duration                      // wait before reading back
+	backoff  time.Duration                      // first retry delay, doubled per attempt
+	attempts int
+
+	mu         sync.Mutex
+	generation map[string]uint64
+	listeners  []func(entity string, err error)
+}
+
+func newCommandVerifier(call func(string, string, map[string]string, string) error, read func(string) (string, bool)) *commandVerifier {
+	return &commandVerifier{
+		call:       call,
+		read:       read,
+		settle:     commandSettle,
+		backoff:    commandBackoff,
+		attempts:   commandAttempts,
+		generation: make(map[string]uint64),
+	}
+}
+
+// onResult registers a listener for the final outcome of every command: nil
+// once confirmed, the last error when all attempts failed.
+func (v *commandVerifier) onResult(listener func(entity string, err error)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.listeners = append(v.listeners, listener)
+}
+
+// send delivers the command in the background. expected is the state the
+// entity should report afterwards; empty skips the read back.
+func (v *commandVerifier) send(ctx context.Context, domain string, service string, data map[string]string, entity string, expected string) {
+	v.mu.Lock()
+	v.generation[entity]++
+	generation := v.generation[entity]
+	v.mu.Unlock()
+
+	go func() {
+		err := v.deliver(ctx, generation, domain, service, data, entity, expected)
+		if err == errCommandSuperseded {
+			return
+		}
+
+		v.mu.Lock()
+		listeners := append([]func(string, error){}, v.listeners...)
+		v.mu.Unlock()
+		for _, listener := range listeners {
+			listener(entity, err)
+		}
+	}()
+}
+
+var errCommandSuperseded = errors.New("command superseded")
+
+func (v *commandVerifier) deliver(ctx context.Context, generation uint64, domain string, service string, data map[string]string, entity string, expected string) error {
+	var err error
+	delay := v.backoff
+	for attempt := 1; attempt <= v.attempts; attempt++ {
+		if attempt > 1 {
+			log.Printf("HA service: %s %s on %s failed (%v), retry %d/%d in %v", domain, service, entity, err, attempt-1, v.attempts-1, delay)
+			if !sleepContext(ctx, delay) {
+				return ctx.Err()
+			}
+			delay *= 2
+		}
+		if v.superseded(entity, generation) {
+			return errCommandSuperseded
+		}
+
+		if err = v.call(domain, service, data, entity); err != nil {
+			continue
+		}
+		if expected == "" || v.read == nil {
+			return nil
+		}
+		if !sleepContext(ctx, v.settle) {
+			return ctx.Err()
+		}
+		if v.superseded(entity, generation) {
+			return errCommandSuperseded
+		}
+		state, ok := v.read(entity)
+		if !ok {
+			err = errors.New("state could not be read back")
+			continue
+		}
+		if statesEqual(state, expected) {
+			return nil
+		}
+		err = fmt.Errorf("state is %q, expected %q", state, expected)
+	}
+	return err
+}
+
+func (v *commandVerifier) superseded(entity string, generation uint64) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.generation[entity] != generation
+}
+
+// statesEqual compares numerically when both states are numbers, so "10.0"
+// matches "10".
+func statesEqual(actual string, expected string) bool {
+	a, errA := strconv.ParseFloat(strings.TrimSpace(actual), 64)
+	e, errE := strconv.ParseFloat(strings.TrimSpace(expected), 64)
+	if errA == nil && errE == nil {
+		return math.Abs(a-e) < 0.01
+	}
+	return strings.EqualFold(strings.TrimSpace(actual), strings.TrimSpace(expected))
+}
+
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
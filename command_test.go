@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCharger struct {
+	mu      sync.Mutex
+	calls   int
+	applied string
+	failFor int // number of calls that fail
+	ignore  bool
+	reads   int
+	unknown int // number of reads that cannot tell the state
+}
+
+func (c *fakeCharger) call(domain string, service string, data map[string]string, entity string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	if c.calls <= c.failFor {
+		return errors.New("HA: could not call service from HA")
+	}
+	if !c.ignore {
+		c.applied = data["value"]
+	}
+	return nil
+}
+
+func (c *fakeCharger) read(entity string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reads++
+	if c.reads <= c.unknown {
+		return "", false
+	}
+	return c.applied, true
+}
+
+func newTestVerifier(charger *fakeCharger) (*commandVerifier, chan error) {
+	v := newCommandVerifier(charger.call, charger.read)
+	v.settle = time.Millisecond
+	v.backoff = time.Millisecond
+	results := make(chan error, 10)
+	v.onResult(func(entity string, err error) { results <- err })
+	return v, results
+}
+
+func waitResult(t *testing.T, results chan error) error {
+	select {
+	case err := <-results:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("no command result")
+		return nil
+	}
+}
+
+func TestCommandVerifier_RetriesUntilConfirmed(t *testing.T) {
+	charger := &fakeCharger{applied: "6.0", failFor: 2}
+	v, results := newTestVerifier(charger)
+
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "10"}, "number.dawn_amps", "10")
+
+	assert.NoError(t, waitResult(t, results))
+	assert.Equal(t, 3, charger.calls)
+}
+
+func TestCommandVerifier_UnreadableStateIsRetried(t *testing.T) {
+	charger := &fakeCharger{applied: "6", unknown: 1}
+	v, results := newTestVerifier(charger)
+
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "10"}, "number.dawn_amps", "10")
+
+	assert.NoError(t, waitResult(t, results))
+	assert.Equal(t, 2, charger.calls, "an unknown state is not a confirmation")
+
+	charger = &fakeCharger{applied: "6", unknown: commandAttempts}
+	v, results = newTestVerifier(charger)
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "10"}, "number.dawn_amps", "10")
+	err := waitResult(t, results)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "could not be read back")
+}
+
+func TestCommandVerifier_ReportsMismatch(t *testing.T) {
+	charger := &fakeCharger{applied: "6", ignore: true}
+	v, results := newTestVerifier(charger)
+
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "10"}, "number.dawn_amps", "10")
+
+	err := waitResult(t, results)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `state is "6"`)
+	assert.Equal(t, commandAttempts, charger.calls)
+}
+
+func TestCommandVerifier_NewerCommandSupersedes(t *testing.T) {
+	charger := &fakeCharger{applied: "6", failFor: 1}
+	v, results := newTestVerifier(charger)
+	v.backoff = 50 * time.Millisecond
+
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "10"}, "number.dawn_amps", "10")
+	time.Sleep(10 * time.Millisecond)
+	v.send(context.Background(), "number", "set_value", map[string]string{"value": "8"}, "number.dawn_amps", "8")
+
+	assert.NoError(t, waitResult(t, results))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, results)
+	assert.Equal(t, "8", charger.applied)
+}
+
+func TestStatesEqual(t *testing.T) {
+	assert.True(t, statesEqual("10.0", "10"))
+	assert.True(t, statesEqual("On", "on"))
+	assert.False(t, statesEqual("unavailable", "10"))
+}
+
+func TestDawnConsumer_UnresponsiveChargerStopsOnOvercurrent(t *testing.T) {
+	tc := &dawnConsumerService{
+		haService:          &haService{},
+		dawnId:             "number.dawn_amps",
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        12,
+		actualAmps:         12,
+		setpoint:           20,
+		isCharging:         true,
+		connectorStatus:    "charging",
+		currents:           map[string]float64{"phase1": 23, "phase2": 10, "phase3": 10},
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		pid:                &PIDController{Kp: 0.4, Ki: 0.01, Kd: 0.05, Setpoint: 20},
+	}
+
+	tc.commandResult("number.dawn_amps", errors.New("state is \"unavailable\", expected \"12\""))
+	assert.True(t, tc.chargerNotResponding)
+
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.isCharging, "overcurrent with an unresponsive charger should stop through the switch")
+
+	tc.commandResult("number.dawn_amps", nil)
+	assert.False(t, tc.chargerNotResponding)
+}
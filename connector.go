@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ConnectorState is a charger connector status normalised across integrations.
+type ConnectorState int
+
+const (
+	ConnectorUnknown      ConnectorState = iota
+	ConnectorDisconnected                // no car
+	ConnectorConnected                   // car plugged in, waiting to start
+	ConnectorCharging                    // car drawing current
+	ConnectorSuspended                   // session paused by the car or the charger
+	ConnectorFinishing                   // session ended, car still plugged in
+	ConnectorError
+	ConnectorOffline // the status entity is unavailable in HA
+)
+
+func (s ConnectorState) String() string {
+	switch s {
+	case ConnectorDisconnected:
+		return "disconnected"
+	case ConnectorConnected:
+		return "connected"
+	case ConnectorCharging:
+		return "charging"
+	case ConnectorSuspended:
+		return "suspended"
+	case ConnectorFinishing:
+		return "finishing"
+	case ConnectorError:
+		return "error"
+	case ConnectorOffline:
+		return "offline"
+	default:
+		return "unknown"
+	}
+}
+
+func parseConnectorState(s string) (ConnectorState, error) {
+	for state := ConnectorDisconnected; state <= ConnectorOffline; state++ {
+		if strings.EqualFold(strings.TrimSpace(s), state.String()) {
+			return state, nil
+		}
+	}
+	return ConnectorUnknown, fmt.Errorf("unknown connector state %q", s)
+}
+
+// connectorStatusMap maps lower case vendor status strings to canonical
+// states.
+type connectorStatusMap map[string]ConnectorState
+
+// connectorPresets holds the status strings of common HA charger
+// integrations. Every preset maps the states HA reports while an integration
+// is down or restarting to ConnectorOffline.
+var connectorPresets = map[string]connectorStatusMap{
+	"dawn": {
+		"disconnected":   ConnectorDisconnected,
+		"1":              ConnectorDisconnected,
+		"connected":      ConnectorConnected,
+		"2":              ConnectorConnected,
+		"awaiting start": ConnectorConnected,
+		"charging":       ConnectorCharging,
+		"3":              ConnectorCharging,
+		"busy":           ConnectorCharging,
+		"finishing":      ConnectorFinishing,
+		"error":          ConnectorError,
+		"unavailable":    ConnectorOffline,
+		"unknown":        ConnectorOffline,
+	},
+	// OCPP 1.6 connector status (ocpp integration)
+	"ocpp": {
+		"available":     ConnectorDisconnected,
+		"preparing":     ConnectorConnected,
+		"reserved":      ConnectorConnected,
+		"charging":      ConnectorCharging,
+		"suspendedev":   ConnectorSuspended,
+		"suspendedevse": ConnectorSuspended,
+		"finishing":     ConnectorFinishing,
+		"faulted":       ConnectorError,
+		"unavailable":   ConnectorOffline, // also the OCPP status, map it with CHARGER_STATUS_MAP to stop
+		"unknown":       ConnectorOffline,
+	},
+	"easee": {
+		"disconnected":           ConnectorDisconnected,
+		"awaiting_start":         ConnectorConnected,
+		"ready_to_charge":        ConnectorConnected,
+		"awaiting_authorization": ConnectorConnected,
+		"charging":               ConnectorCharging,
+		"completed":              ConnectorFinishing,
+		"de_authorizing":         ConnectorFinishing,
+		"error":                  ConnectorError,
+		"unavailable":            ConnectorOffline,
+		"unknown":                ConnectorOffline,
+	},
+	// go-e Charger API v2 "car" state, numeric or as named by the integration
+	"goe": {
+		"0":           ConnectorError,
+		"1":           ConnectorDisconnected,
+		"idle":        ConnectorDisconnected,
+		"2":           ConnectorCharging,
+		"charging":    ConnectorCharging,
+		"3":           ConnectorConnected,
+		"waitcar":     ConnectorConnected,
+		"4":           ConnectorFinishing,
+		"complete":    ConnectorFinishing,
+		"5":           ConnectorError,
+		"error":       ConnectorError,
+		"unavailable": ConnectorOffline,
+		"unknown":     ConnectorOffline,
+	},
+}
+
+// newConnectorStatusMap builds the mapping from a preset and overrides of the
+// form "vendor=canonical,vendor=canonical".
+func newConnectorStatusMap(preset string, overrides string) (connectorStatusMap, error) {
+	base, ok := connectorPresets[strings.ToLower(strings.TrimSpace(preset))]
+	if !ok {
+		names := make([]string, 0, len(connectorPresets))
+		for name := range connectorPresets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown preset %q, expected one of %s", preset, strings.Join(names, ", "))
+	}
+
+	m := make(connectorStatusMap, len(base))
+	for status, state := range base {
+		m[status] = state
+	}
+	for _, entry := range strings.Split(overrides, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		status, canonical, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid mapping %q, expected status=state", entry)
+		}
+		state, err := parseConnectorState(canonical)
+		if err != nil {
+			return nil, err
+		}
+		m[strings.ToLower(strings.TrimSpace(status))] = state
+	}
+	return m, nil
+}
+
+// normalize returns the canonical state of a vendor status. A nil map uses
+// the Dawn preset.
+func (m connectorStatusMap) normalize(status string) ConnectorState {
+	if m == nil {
+		m = connectorPresets["dawn"]
+	}
+	return m[strings.ToLower(strings.TrimSpace(status))]
+}
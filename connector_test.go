@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectorStatusMap_Presets(t *testing.T) {
+	ocpp, err := newConnectorStatusMap("ocpp", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ConnectorSuspended, ocpp.normalize("SuspendedEV"))
+	assert.Equal(t, ConnectorDisconnected, ocpp.normalize("Available"))
+
+	easee, err := newConnectorStatusMap("easee", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ConnectorConnected, easee.normalize("awaiting_start"))
+
+	goe, err := newConnectorStatusMap("goe", "")
+	assert.NoError(t, err)
+	assert.Equal(t, ConnectorCharging, goe.normalize("2"))
+	assert.Equal(t, ConnectorConnected, goe.normalize("3"))
+
+	var dawn connectorStatusMap
+	assert.Equal(t, ConnectorCharging, dawn.normalize("busy"))
+	assert.Equal(t, ConnectorUnknown, dawn.normalize("SuspendedEV"))
+
+	_, err = newConnectorStatusMap("tesla", "")
+	assert.Error(t, err)
+}
+
+func TestConnectorStatusMap_Overrides(t *testing.T) {
+	m, err := newConnectorStatusMap("dawn", "Paused=suspended, 9=error")
+	assert.NoError(t, err)
+	assert.Equal(t, ConnectorSuspended, m.normalize("paused"))
+	assert.Equal(t, ConnectorError, m.normalize("9"))
+	assert.Equal(t, ConnectorCharging, m.normalize("charging"))
+
+	_, err = newConnectorStatusMap("dawn", "paused=sleeping")
+	assert.Error(t, err)
+	_, err = newConnectorStatusMap("dawn", "paused")
+	assert.Error(t, err)
+}
+
+func TestDawnConsumer_ConnectorStatusNormalised(t *testing.T) {
+	statusMap, _ := newConnectorStatusMap("ocpp", "")
+	tc := &dawnConsumerService{haService: &haService{}, statusMap: statusMap}
+
+	tc.connectorStatusInternal("charging")
+	assert.True(t, tc.isCharging)
+	assert.True(t, tc.isActuallyChargingInternal())
+
+	// Paused by the car: still a session under control
+	tc.connectorStatusInternal("suspendedev")
+	assert.True(t, tc.isCharging)
+	assert.True(t, tc.isActuallyChargingInternal())
+
+	// Unknown statuses are reported and keep the last known state
+	tc.connectorStatusInternal("firmwareupdate")
+	assert.True(t, tc.isCharging)
+	assert.True(t, tc.isActuallyChargingInternal())
+	assert.True(t, tc.unknownStatuses["firmwareupdate"])
+
+	tc.connectorStatusInternal("available")
+	assert.False(t, tc.isCharging)
+	state, _, _ := tc.charge.current()
+	assert.Equal(t, ChargeIdle, state)
+}
+
+func TestDawnConsumer_ConnectorOfflineKeepsState(t *testing.T) {
+	for preset := range connectorPresets {
+		statusMap, _ := newConnectorStatusMap(preset, "")
+		assert.Equal(t, ConnectorOffline, statusMap.normalize("unavailable"), preset)
+		assert.Equal(t, ConnectorOffline, statusMap.normalize("unknown"), preset)
+
+		tc := &dawnConsumerService{haService: &haService{}, statusMap: statusMap, isCharging: true}
+		tc.connectorStatusInternal("charging")
+		tc.connectorStatusInternal("unavailable")
+		tc.connectorStatusInternal("unknown")
+		assert.True(t, tc.isCharging, preset)
+		assert.True(t, tc.isActuallyChargingInternal(), preset)
+		assert.Empty(t, tc.unknownStatuses, preset)
+	}
+
+	ocpp, _ := newConnectorStatusMap("ocpp", "unavailable=error")
+	assert.Equal(t, ConnectorError, ocpp.normalize("Unavailable"))
+}
@@ -12,6 +12,17 @@ import (
 	"github.com/tuomaz/gohaws"
 )
 
+const (
+	// phaseDetectDelay is how long after start the per-phase currents are
+	// compared to find the phases the car draws from.
+	phaseDetectDelay = 60 * time.Second
+	// phaseDetectMinDelta is the smallest current rise counted as car load.
+	phaseDetectMinDelta = 3.0
+	// defaultControlPeriod is how often the control loop runs when no period
+	// is configured.
+	defaultControlPeriod = 30 * time.Second
+)
+
 type dawnConsumerService struct {
 	ctx                  context.Context
 	haService            *haService
@@ -40,19 +51,103 @@ type dawnConsumerService struct {
 	isCharging           bool
 	pvOnlyMode           bool
 	connectorStatus      string
-	lastExecution        time.Time
+	lastExecution        time.Time // last start or protection reduction, the PID waits a period after it
 	lastHardSafetyEvent  time.Time
+	now                  func() time.Time // clock of the fuse protection, time.Now when nil
+	accounting           ExportAccounting
+	importWeight         float64
+	topology             PhaseTopology
+	phases               []int // installation phases
+	chargerPhases        []int // installation phases the charger is wired to, in terminal order
+	activePhases         []int // installation phases the car has been seen drawing from
+	assumeFirstPhase     bool  // until detected, the car is assumed to draw from chargerPhases[0] only
+	actualTotalAmps      float64
+	phaseBaseline        map[string]float64
+	phaseDetectStart     time.Time
+	fuse                 *fuseModel // nil uses the instantaneous threshold
+	imbalance            imbalanceConfig
+	production           float64 // latest PV production in W, if reported
+	phaseSwitchTried     bool
+	lastImbalanceEvent   time.Time
+	lastImbalanceReport  time.Time
+	chargerNotResponding bool             // the last command to the charger could not be confirmed
+	actuator             *chargerActuator // nil writes every command directly
+	charge               chargeStateMachine
+	chargeStateSensor    string              // HA sensor the charge state is published to
+	statusMap            connectorStatusMap  // nil uses the Dawn preset
+	connectorState       ConnectorState      // last known canonical status
+	unknownStatuses      map[string]bool     // unknown statuses already reported
+	stoppedOnRequest     bool                // no automatic start until resumed or unplugged
+	priceOverride        *priceOverride      // nil disables low price charging
+	curtailment          *curtailment        // nil when the inverter has no feed-in limit
+	forecast             *solarForecaster    // nil keeps the fixed PV-only timers
+	baseLoad             *baseLoadForecaster // nil starts without looking ahead
+	lastPeakHold         time.Time
+	pidConfig            *pidConfig    // nil keeps the controller's gains in every mode
+	controlPeriod        time.Duration // 0 uses defaultControlPeriod
+}
+
+// imbalanceConfig limits the spread between phases and the estimated neutral
+// current. Zero limits are disabled.
+type imbalanceConfig struct {
+	limit         float64
+	neutralLimit  float64
+	phaseSwitchId string // optional switch, on = charge on all phases
+	sensorId      string // HA sensor the imbalance is published to
+}
+
+// dawnConfig is the configuration of the Dawn consumer.
+type dawnConfig struct {
+	statusSensor      string // HA sensor of the connector status
+	dawnId            string // HA number of the current setting
+	dawnSwitch        string // HA switch of the charger
+	notifyDevice      string
+	dawnCurrentId     string  // HA sensor of the measured charging current
+	setpoint          float64 // max phase current in A
+	pvOnlySwitchId    string
+	userLimitId       string
+	chargeStateSensor string // HA sensor the charge state is published to
+	accounting        ExportAccounting
+	importWeight      float64
+	topology          PhaseTopology
+	chargerPhases     []int
+	assumeFirstPhase  bool // a phase rotation is configured, see controlPhaseList
+	fuse              *fuseModel
+	imbalance         imbalanceConfig
+	actuator          *chargerActuator
+	statusMap         connectorStatusMap
+	override          *priceOverride
+	curtailment       *curtailment
+	forecast          *solarForecaster
+	baseLoad          *baseLoadForecaster
+	tuning            *pidConfig
+	controlPeriod     time.Duration
 }
 
-func newDawnConsumerService(ctx context.Context, eventChannel chan *event, ha *haService, statusSensor string, dawnId string, dawnSwitch string, notifyDevice string, dawnCurrentId string, setpoint float64, pvOnlySwitchId string, userLimitId string) *dawnConsumerService {
+func newDawnConsumerService(ctx context.Context, eventChannel chan *event, ha *haService, config dawnConfig) *dawnConsumerService {
 	haChannel := make(chan *gohaws.Message)
-	ha.subscribeMulti([]string{statusSensor, dawnCurrentId, pvOnlySwitchId, userLimitId}, haChannel)
+	entities := []string{config.statusSensor, config.dawnCurrentId, config.pvOnlySwitchId, config.userLimitId}
+	if curtail := config.curtailment; curtail != nil {
+		for _, entity := range []string{curtail.productionSensor, curtail.sensor} {
+			if entity != "" {
+				entities = append(entities, entity)
+			}
+		}
+	}
+	if tuning := config.tuning; tuning != nil {
+		for _, entity := range []string{tuning.fuseEntity, tuning.pvEntity} {
+			if entity != "" {
+				entities = append(entities, entity)
+			}
+		}
+	}
+	ha.subscribeMulti(entities, haChannel)
 
-	pid := &PIDController{
-		Kp:       0.4,
-		Ki:       0.01,
-		Kd:       0.05,
-		Setpoint: setpoint,
+	pid := &PIDController{Setpoint: config.setpoint}
+	if config.tuning != nil {
+		pid.apply(config.tuning.fuse)
+	} else {
+		pid.apply(defaultPIDTuning)
 	}
 
 	dawnConsumerService := &dawnConsumerService{
@@ -64,25 +159,62 @@ func newDawnConsumerService(ctx context.Context, eventChannel chan *event, ha *h
 		currentAmps:        6,
 		actualAmps:         0,
 		haChannel:          haChannel,
-		dawnId:             dawnId,
-		dawnSwitch:         dawnSwitch,
-		notifyDevice:       notifyDevice,
-		dawnCurrentId:      dawnCurrentId,
-		pvOnlySwitchId:     pvOnlySwitchId,
-		userLimitId:        userLimitId,
+		dawnId:             config.dawnId,
+		dawnSwitch:         config.dawnSwitch,
+		notifyDevice:       config.notifyDevice,
+		dawnCurrentId:      config.dawnCurrentId,
+		pvOnlySwitchId:     config.pvOnlySwitchId,
+		userLimitId:        config.userLimitId,
 		currents:           make(map[string]float64),
 		exports:            make(map[string]float64),
 		hasDirectionalData: make(map[string]bool),
 		pid:                pid,
-		setpoint:           setpoint,
+		setpoint:           config.setpoint,
 		lastExecution:      time.Now(),
+		accounting:         config.accounting,
+		importWeight:       config.importWeight,
+		topology:           config.topology,
+		phases:             config.topology.phases(),
+		chargerPhases:      config.chargerPhases,
+		assumeFirstPhase:   config.assumeFirstPhase,
+		fuse:               config.fuse,
+		imbalance:          config.imbalance,
+		actuator:           config.actuator,
+		chargeStateSensor:  config.chargeStateSensor,
+		statusMap:          config.statusMap,
+		priceOverride:      config.override,
+		curtailment:        config.curtailment,
+		forecast:           config.forecast,
+		baseLoad:           config.baseLoad,
+		pidConfig:          config.tuning,
+		controlPeriod:      config.controlPeriod,
 	}
 
+	ha.onCommandResult(dawnConsumerService.commandResult)
+	ha.onNotificationAction(ActionResumeCharging, dawnConsumerService.resumeCharging)
+	ha.onNotificationAction(ActionStopCharging, dawnConsumerService.stopChargingOnRequest)
+
 	go dawnConsumerService.run()
+	go dawnConsumerService.controlLoop()
 
 	return dawnConsumerService
 }
 
+// dawnCurrentInternal takes the charger's current sensor. It is a sum over
+// the phases the car draws from, except with split-phase: a 240V charger
+// across both legs carries the same current in each, and the sensor reports
+// that per-leg current.
+func (tc *dawnConsumerService) dawnCurrentInternal(amps float64) {
+	phases := float64(len(tc.controlPhaseList()))
+	if tc.topology == TopologySplitPhase {
+		tc.actualAmps = amps
+		tc.actualTotalAmps = amps * phases
+		return
+	}
+	tc.actualTotalAmps = amps
+	tc.actualAmps = amps / phases
+}
+
 func (ps *dawnConsumerService) run() {
 Loop:
 	for {
@@ -92,10 +224,8 @@ Loop:
 		case message, ok := <-ps.haChannel:
 			if ok {
 				if message.Event.Data.EntityID == ps.dawnCurrentId {
-					totalAmps := parseFloat(message.Event.Data.NewState.State)
 					ps.mu.Lock()
-					// Divide by 3 because the sensor is a sum of all 3 phases
-					ps.actualAmps = totalAmps / 3.0
+					ps.dawnCurrentInternal(parseFloat(message.Event.Data.NewState.State))
 					ps.mu.Unlock()
 				} else if message.Event.Data.EntityID == ps.userLimitId {
 					limit := parseFloat(message.Event.Data.NewState.State)
@@ -105,7 +235,6 @@ Loop:
 						log.Printf("DAWN: User limit updated: %.2fA", limit)
 					}
 					ps.mu.Unlock()
-					ps.calculateAndSetAmps()
 				} else if message.Event.Data.EntityID == ps.pvOnlySwitchId {
 					state := strings.ToLower(fmt.Sprintf("%v", message.Event.Data.NewState.State))
 					ps.mu.Lock()
@@ -113,31 +242,28 @@ Loop:
 					ps.pvOnlyMode = state == "on"
 					if oldMode != ps.pvOnlyMode {
 						log.Printf("DAWN: PV-only mode changed: %v -> %v. Resetting PID.", oldMode, ps.pvOnlyMode)
-						ps.pid.Integral = 0
-						ps.pid.LastError = 0
-						ps.pid.LastTime = time.Time{}
+						ps.pid.Reset()
+						ps.lastExecution = time.Now()
+						if current, _, _ := ps.charge.current(); !ps.pvOnlyMode && (current == ChargeWaitingForSurplus || current == ChargePvShortageCooldown) {
+							ps.setChargeStateInternal(ChargeIdle, "PV-only mode off")
+						}
 					}
 					ps.mu.Unlock()
+					// Start or stop at once, the PID waits for the next period
 					ps.calculateAndSetAmps()
+				} else if ps.pidConfig != nil && (message.Event.Data.EntityID == ps.pidConfig.fuseEntity || message.Event.Data.EntityID == ps.pidConfig.pvEntity) {
+					ps.mu.Lock()
+					ps.pidTuningStateInternal(message.Event.Data.EntityID, fmt.Sprintf("%v", message.Event.Data.NewState.State))
+					ps.mu.Unlock()
+				} else if ps.curtailment != nil && (message.Event.Data.EntityID == ps.curtailment.productionSensor || message.Event.Data.EntityID == ps.curtailment.sensor) {
+					ps.mu.Lock()
+					ps.curtailmentStateInternal(message.Event.Data.EntityID, message.Event.Data.NewState)
+					ps.mu.Unlock()
 				} else {
-					state := strings.ToLower(fmt.Sprintf("%v", message.Event.Data.NewState.State))
+					status := strings.ToLower(fmt.Sprintf("%v", message.Event.Data.NewState.State))
 					ps.mu.Lock()
-					ps.connectorStatus = state
-					// Sync isCharging state with reality
-					switch state {
-					case "charging", "3", "busy":
-						if !ps.isCharging {
-							log.Printf("DAWN: Detected external charging start. Enabling safety monitoring.")
-							ps.isCharging = true
-						}
-					case "disconnected", "1", "finishing", "error":
-						if ps.isCharging {
-							log.Printf("DAWN: Detected charging stop (Status: %s).", state)
-							ps.isCharging = false
-						}
-					}
+					ps.connectorStatusInternal(status)
 					ps.mu.Unlock()
-					log.Printf("DAWN: connector status: %s", state)
 				}
 			} else {
 				break Loop
@@ -146,86 +272,354 @@ Loop:
 	}
 }
 
+// pidTuningStateInternal applies a tuning entered in HA to the next PID
+// update. An invalid tuning is reported and the previous one kept.
+func (tc *dawnConsumerService) pidTuningStateInternal(entity string, state string) {
+	if state == "" || state == "unknown" || state == "unavailable" {
+		return
+	}
+	mode, tuning := "fuse", &tc.pidConfig.fuse
+	if entity == tc.pidConfig.pvEntity {
+		mode, tuning = "PV-only", &tc.pidConfig.pv
+	}
+	updated, err := parsePIDTuning(state, *tuning)
+	if err != nil {
+		msg := fmt.Sprintf("Ignoring %s PID tuning from %s: %v", mode, entity, err)
+		log.Printf("DAWN: %s", msg)
+		tc.haService.notify(NotifyConfiguration, SeverityWarning, msg)
+		return
+	}
+	if updated != *tuning {
+		log.Printf("DAWN: %s PID tuning %s -> %s", mode, *tuning, updated)
+		*tuning = updated
+	}
+}
+
+// connectorStatusInternal syncs the charging state with a new connector
+// status. Unknown statuses are reported and leave the state unchanged, as
+// does the status entity going offline.
+func (tc *dawnConsumerService) connectorStatusInternal(status string) {
+	tc.connectorStatus = status
+	state := tc.statusMap.normalize(status)
+	log.Printf("DAWN: connector status: %s (%s)", status, state)
+
+	switch state {
+	case ConnectorCharging:
+		if !tc.isCharging {
+			// The car already draws current, so a snapshot now would include
+			// it and no phase would rise. Detection is left out.
+			log.Printf("DAWN: Detected external charging start. Enabling safety monitoring, phase detection skipped.")
+			tc.isCharging = true
+			tc.phaseBaseline = nil
+		}
+		if current, _, _ := tc.charge.current(); current != ChargeThrottled {
+			tc.setChargeStateInternal(ChargeCharging, "car drawing current")
+		}
+	case ConnectorDisconnected, ConnectorFinishing, ConnectorError:
+		if tc.isCharging {
+			log.Printf("DAWN: Detected charging stop (Status: %s).", status)
+			tc.isCharging = false
+		}
+	case ConnectorOffline:
+		// HA restarting or the integration reloading, not a status of the charger
+		return
+	case ConnectorUnknown:
+		metrics.addCounter("electricity_connector_unknown_status_total", 1)
+		if !tc.unknownStatuses[status] {
+			if tc.unknownStatuses == nil {
+				tc.unknownStatuses = make(map[string]bool)
+			}
+			tc.unknownStatuses[status] = true
+			msg := fmt.Sprintf("Unknown charger status %q, keeping the current charging state. Map it with CHARGER_STATUS_MAP.", status)
+			log.Printf("DAWN: %s", msg)
+			tc.haService.notify(NotifyConfiguration, SeverityWarning, msg)
+		}
+		return
+	}
+	tc.connectorState = state
+
+	switch state {
+	case ConnectorDisconnected:
+		// A different car may be plugged in next
+		tc.activePhases = nil
+		tc.stoppedOnRequest = false
+		tc.setChargeStateInternal(ChargeIdle, "car disconnected")
+	case ConnectorFinishing:
+		tc.setChargeStateInternal(ChargeCarFull, "car ended the session")
+	case ConnectorError:
+		tc.setChargeStateInternal(ChargeError, "charger reports an error")
+	}
+}
+
 func (tc *dawnConsumerService) updateCurrents(pe *powerEvent) {
+	if pe.sensorType == SensorTypeProduction {
+		tc.mu.Lock()
+		tc.production = pe.value
+		tc.mu.Unlock()
+		return
+	}
+
 	phaseKey := fmt.Sprintf("phase%d", pe.phaseIndex)
 
 	tc.mu.Lock()
-	if pe.sensorType == SensorTypeExport {
-		tc.exports[phaseKey] = pe.value
-		// If we are exporting, import current is 0
-		tc.currents[phaseKey] = 0
-		tc.hasDirectionalData[phaseKey] = true
-	} else if pe.sensorType == SensorTypeImport {
-		tc.currents[phaseKey] = pe.value
-		// If we are importing, export current is 0
-		tc.exports[phaseKey] = 0
-		tc.hasDirectionalData[phaseKey] = true
-	} else if pe.sensorType == SensorTypeCurrent {
-		// Use absolute current sensor ONLY as a fallback if we haven't seen directional data.
-		if !tc.hasDirectionalData[phaseKey] {
-			tc.currents[phaseKey] = pe.value
+	// Import and export clear each other, absolute current is ONLY a fallback
+	// while no directional data has been seen.
+	flow := phaseFlow{imported: tc.currents[phaseKey], exported: tc.exports[phaseKey], directional: tc.hasDirectionalData[phaseKey]}
+	if flow.apply(pe) {
+		tc.currents[phaseKey], tc.exports[phaseKey], tc.hasDirectionalData[phaseKey] = flow.imported, flow.exported, flow.directional
+	}
+	if tc.fuse != nil && pe.sensorType != SensorTypeVoltage {
+		tc.fuse.update(pe.phaseIndex, tc.currents[phaseKey], tc.nowInternal())
+	}
+	tc.mu.Unlock()
+
+	tc.safetyCheck()
+}
+
+// lockoutOverInternal reports whether a control period has passed since the
+// last start or protection reduction. A start is made during a tick, so the
+// next tick comes slightly less than a period later; a tenth of the period is
+// allowed for that so the PID runs on that tick and not one later.
+func (tc *dawnConsumerService) lockoutOverInternal() bool {
+	period := tc.controlPeriodInternal()
+	return time.Since(tc.lastExecution) >= period-period/10
+}
+
+// nowInternal is the clock of the fuse protection, replaced by simulations.
+func (tc *dawnConsumerService) nowInternal() time.Time {
+	if tc.now == nil {
+		return time.Now()
+	}
+	return tc.now()
+}
+
+// controlPeriodInternal is the fixed period of the control loop.
+func (tc *dawnConsumerService) controlPeriodInternal() time.Duration {
+	if tc.controlPeriod <= 0 {
+		return defaultControlPeriod
+	}
+	return tc.controlPeriod
+}
+
+// controlLoop runs the control pass at a fixed rate on the latest readings,
+// so starts, stops and the PID behave the same whether the meter reports
+// every second or every ten. Readings only trigger the safety check.
+func (tc *dawnConsumerService) controlLoop() {
+	ticker := time.NewTicker(tc.controlPeriodInternal())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tc.ctx.Done():
+			return
+		case <-ticker.C:
+			tc.calculateAndSetAmps()
 		}
 	}
+}
+
+// safetyCheck is run on every reading. It only does what cannot wait for
+// the next control pass: the fuse protection, and the inverter limit, which
+// has to follow a drop in local consumption at once.
+func (tc *dawnConsumerService) safetyCheck() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	tc.inverterLimitInternal(time.Now())
+	if !tc.isCharging {
+		return
+	}
+	tc.hardSafetyInternal(tc.getMaxPhaseCurrentInternal(tc.safetyPhaseList()))
+}
+
+// commandResult tracks whether the charger confirms its commands. Hard safety
+// falls back to the switch while it does not.
+func (tc *dawnConsumerService) commandResult(entity string, err error) {
+	if entity != tc.dawnId && entity != tc.dawnSwitch {
+		return
+	}
+
+	tc.mu.Lock()
+	wasResponding := !tc.chargerNotResponding
+	tc.chargerNotResponding = err != nil
 	tc.mu.Unlock()
 
-	tc.calculateAndSetAmps()
+	if err != nil {
+		metrics.addCounter("electricity_charger_command_failures_total", 1)
+		if wasResponding {
+			msg := fmt.Sprintf("EV charger not responding: command to %s failed after retries (%v).", entity, err)
+			log.Printf("DAWN: %s", msg)
+			tc.haService.notify(NotifyChargerFault, SeverityWarning, msg)
+		}
+	} else if !wasResponding {
+		log.Printf("DAWN: EV charger responding again (%s).", entity)
+		tc.haService.notify(NotifyChargerFault, SeverityInfo, "EV charger responding again.")
+	}
+}
+
+// unresponsiveStopInternal stops charging through the switch when a
+// reduction is needed but the charger does not confirm current changes.
+func (tc *dawnConsumerService) unresponsiveStopInternal(maxPhaseCurrent float64) bool {
+	if !tc.chargerNotResponding {
+		return false
+	}
+	msg := fmt.Sprintf("OVERCURRENT (%.2fA) and EV charger not responding to current changes. Stopping charger.", maxPhaseCurrent)
+	log.Printf("DAWN: %s", msg)
+	tc.haService.notify(NotifyEmergencyStop, SeverityCritical, msg, notificationAction{Action: ActionResumeCharging, Title: "Resume charging"})
+	tc.stopChargingInternal()
+	tc.setChargeStateInternal(ChargeEmergencyStopped, "overcurrent with unresponsive charger")
+	return true
 }
 
 func (tc *dawnConsumerService) isActuallyCharging() bool {
 	tc.mu.RLock()
 	defer tc.mu.RUnlock()
+	return tc.isActuallyChargingInternal()
+}
 
+// isActuallyChargingInternal reports whether charging is enabled and the
+// connector has a car that is, or is about to start, drawing current.
+func (tc *dawnConsumerService) isActuallyChargingInternal() bool {
 	if !tc.isCharging {
 		return false
 	}
 
-	switch tc.connectorStatus {
-	case "charging", "3", "busy":
-		return true
-	case "connected", "2", "awaiting start":
+	state := tc.statusMap.normalize(tc.connectorStatus)
+	if state == ConnectorUnknown || state == ConnectorOffline {
+		state = tc.connectorState
+	}
+	switch state {
+	case ConnectorCharging, ConnectorConnected, ConnectorSuspended:
 		return true
 	default:
 		return false
 	}
 }
 
+// evCurrent is the measured charging current summed over the charger's
+// phases.
+func (tc *dawnConsumerService) evCurrent() float64 {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	return tc.actualTotalAmps
+}
+
+// evPhaseCurrents is the measured charging current per installation phase.
+func (tc *dawnConsumerService) evPhaseCurrents() map[int]float64 {
+	tc.mu.RLock()
+	defer tc.mu.RUnlock()
+	currents := make(map[int]float64)
+	for _, phase := range tc.controlPhaseList() {
+		currents[phase] = tc.actualAmps
+	}
+	return currents
+}
+
+// householdPeakAheadInternal reports whether the household is expected to
+// leave no room for the minimum current on a charger phase within the
+// lookahead, so a start would soon be throttled or stopped again.
+func (tc *dawnConsumerService) householdPeakAheadInternal(now time.Time) bool {
+	if tc.baseLoad == nil {
+		return false
+	}
+	current, at, phase := tc.baseLoad.peak(now, now.Add(tc.baseLoad.lookahead), tc.controlPhaseList())
+	if phase == 0 || current+tc.minimumAmps <= tc.setpoint {
+		return false
+	}
+	if time.Since(tc.lastPeakHold) > 5*time.Minute {
+		tc.lastPeakHold = time.Now()
+		log.Printf("DAWN: Household peak of %.1fA on phase %d expected at %s. Holding the start.", current, phase, at.Format("15:04"))
+	}
+	return true
+}
+
 func (tc *dawnConsumerService) calculateAndSetAmps() {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
 
-	maxPhaseCurrent := tc.getMaxCurrentInternal()
-	netExport := tc.getNetExportInternal()
+	imbalance, neutral := tc.reportImbalanceInternal()
+
+	// Only the phases the car draws from can be relieved by the charger
+	maxPhaseCurrent := tc.getMaxPhaseCurrentInternal(tc.controlPhaseList())
+	netExport := tc.getAvailableExportInternal()
+	chargerPhaseCount := float64(len(tc.controlPhaseList()))
+	now := time.Now()
+	// A low price overrides PV-only mode
+	override := tc.priceOverrideInternal(now)
+	pvOnly := tc.pvOnlyMode && !override
+	tc.inverterLimitInternal(now)
 
 	// 1. RESTART LOGIC
 	if !tc.isCharging {
+		if tc.stoppedOnRequest {
+			return
+		}
 		canStart := false
 
-		if tc.pvOnlyMode {
-			// PV-Only Start Condition: Total net export must be >= 18A (assuming 3-phase 6A start)
-			if netExport >= tc.minimumAmps*3.0 {
+		current, _, since := tc.charge.current()
+		if current == ChargePvShortageCooldown && pvOnly {
+			// No restart until the cooldown is over
+			if time.Since(since) < pvShortageCooldown {
+				return
+			}
+			tc.setChargeStateInternal(ChargeWaitingForSurplus, fmt.Sprintf("PV shortage cooldown of %v over", pvShortageCooldown))
+		} else if pvOnly && (current == ChargeIdle || current == ChargeEmergencyStopped) {
+			tc.setChargeStateInternal(ChargeWaitingForSurplus, "PV-only mode")
+		}
+
+		startDelay, worthwhile := tc.forecast.startDelay(now)
+		if pvOnly {
+			// PV-Only Start Condition: Total available export must cover the minimum
+			// current on every charger phase (18A for a 3-phase 6A start). Power
+			// a curtailing inverter holds back counts as surplus.
+			// The solar forecast shortens the timer, or holds the start back
+			// when the surplus is not expected to last.
+			curtailed := tc.curtailedHeadroomInternal()
+			if netExport+curtailed >= tc.minimumAmps*chargerPhaseCount {
 				if tc.pvSurplusStartTime.IsZero() {
 					tc.pvSurplusStartTime = time.Now()
-					log.Printf("DAWN: PV surplus detected (Net: %.2fA). Starting 5m stabilization timer.", netExport)
-				} else if time.Since(tc.pvSurplusStartTime) > 5*time.Minute {
-					canStart = true
-					log.Printf("DAWN: PV surplus sustained for 5m. Starting EV charging.")
+					log.Printf("DAWN: PV surplus detected (%s: %.2fA, curtailed: %.2fA). Starting %v stabilization timer.", tc.accounting, netExport, curtailed, startDelay)
+				} else if time.Since(tc.pvSurplusStartTime) > startDelay {
+					if worthwhile {
+						canStart = true
+						log.Printf("DAWN: PV surplus sustained for %v. Starting EV charging.", startDelay)
+					} else {
+						tc.pvSurplusStartTime = time.Now()
+						log.Printf("DAWN: PV surplus not forecast to last %v. Waiting.", tc.forecast.minRun)
+					}
 				}
 			} else {
 				tc.pvSurplusStartTime = time.Time{}
 			}
 		} else {
 			// Normal Start Condition: Sufficient headroom
-			if maxPhaseCurrent > 0 && maxPhaseCurrent <= tc.setpoint-8.0 {
+			if maxPhaseCurrent > 0 && maxPhaseCurrent <= tc.setpoint-8.0 && (!override || tc.peakAllowsStartInternal(now)) {
 				canStart = true
 				log.Printf("DAWN: Sufficient headroom (%.2fA). Starting EV charging.", tc.setpoint-maxPhaseCurrent)
 			}
 		}
 
+		if canStart && tc.householdPeakAheadInternal(now) {
+			canStart = false
+		}
+
 		if canStart {
+			reason := fmt.Sprintf("headroom %.1fA", tc.setpoint-maxPhaseCurrent)
+			if pvOnly {
+				reason = fmt.Sprintf("PV surplus %.1fA sustained for %v", netExport, startDelay)
+			} else if override {
+				reason = fmt.Sprintf("low price, headroom %.1fA", tc.setpoint-maxPhaseCurrent)
+			}
 			tc.isCharging = true
+			tc.setChargeStateInternal(ChargeStarting, reason)
+			if pvOnly {
+				tc.haService.notify(NotifyPvCharging, SeverityInfo, fmt.Sprintf("PV charging started (%s).", reason),
+					notificationAction{Action: ActionStopCharging, Title: "Stop charging"})
+			}
+			tc.beginPhaseDetectionInternal()
 			tc.haService.setDawnSwitch(true, tc.dawnSwitch)
 			tc.setAmpsInternal(tc.minimumAmps)
 			tc.pid.Integral = 0
+			tc.lastExecution = time.Now()
 			tc.overcurrentStartTime = time.Time{}
 			tc.pvSurplusStartTime = time.Time{}
 			tc.pvShortageStartTime = time.Time{}
@@ -233,57 +627,34 @@ func (tc *dawnConsumerService) calculateAndSetAmps() {
 		return
 	}
 
-	// 2. HARD SAFETY OVERRIDE (Fuses)
-	// IMPORTANT: Fuses are per-phase, so we still use maxPhaseCurrent here!
-	hardSafetyThreshold := tc.setpoint + 2.0
-	if maxPhaseCurrent > hardSafetyThreshold && time.Since(tc.lastHardSafetyEvent) > 5*time.Second {
-		// BASELINE: Use Actual Draw if it's lower than our current setting
-		baseline := math.Min(tc.currentAmps, tc.actualAmps)
-		if baseline < tc.minimumAmps {
-			baseline = tc.currentAmps // Fallback if actual is weirdly low (e.g. 0 during ramp)
-		}
-
-		if baseline <= tc.minimumAmps {
-			if tc.overcurrentStartTime.IsZero() {
-				tc.overcurrentStartTime = time.Now()
-				log.Printf("DAWN: Overcurrent detected at minimum charging. Starting 10s shutdown timer.")
-			} else if time.Since(tc.overcurrentStartTime) > 10*time.Second {
-				msg := fmt.Sprintf("CRITICAL OVERCURRENT (%.2fA). Emergency stop of EV charger.", maxPhaseCurrent)
-				log.Printf("DAWN: %s", msg)
-				tc.haService.sendNotification(msg, tc.notifyDevice)
+	tc.detectPhasesInternal()
 
-				tc.stopChargingInternal()
-				return
-			}
-		} else {
-			overage := maxPhaseCurrent - tc.setpoint
-			reduction := math.Ceil(overage)
-
-			newAmps := math.Max(tc.minimumAmps, baseline-reduction)
+	// 2. HARD SAFETY OVERRIDE (Fuses)
+	// Also checked on every reading, see safetyCheck
+	if tc.hardSafetyInternal(tc.getMaxPhaseCurrentInternal(tc.safetyPhaseList())) {
+		return
+	}
 
-			if int(newAmps) != int(tc.currentAmps) {
-				log.Printf("DAWN: HARD SAFETY REDUCTION! Max phase %.2fA. Car drawing %.2fA. Reducing setting %vA -> %vA", maxPhaseCurrent, tc.actualAmps, int(tc.currentAmps), int(newAmps))
-				tc.setAmpsInternal(newAmps)
-				tc.pid.Integral = 0
-				tc.lastHardSafetyEvent = time.Now()
-				tc.lastExecution = time.Now()
-			}
-		}
+	// 2b. PHASE IMBALANCE AND NEUTRAL CURRENT
+	if tc.imbalanceProtectionInternal(imbalance, neutral) {
 		return
 	}
-	tc.overcurrentStartTime = time.Time{}
 
 	// 3. PV SHORTAGE STOP LOGIC
-	if tc.pvOnlyMode && tc.isCharging {
-		// Stop if net importing (> 3.0A) while at minimum charging
-		// Using 3.0A as a buffer (1.0A per phase average)
-		if netExport < -3.0 && tc.currentAmps <= tc.minimumAmps {
+	if pvOnly && tc.isCharging {
+		// Stop if net importing while at minimum charging
+		// Using 1.0A per charger phase as a buffer (3.0A for 3-phase)
+		// The forecast rides out passing clouds and stops sooner at the end of the day
+		stopDelay := tc.forecast.stopDelay(now)
+		if netExport < -1.0*chargerPhaseCount && tc.currentAmps <= tc.minimumAmps {
 			if tc.pvShortageStartTime.IsZero() {
 				tc.pvShortageStartTime = time.Now()
-				log.Printf("DAWN: PV shortage (Net Import: %.2fA) at minimum charging. Starting 5m shutdown timer.", -netExport)
-			} else if time.Since(tc.pvShortageStartTime) > 5*time.Minute {
-				log.Printf("DAWN: PV shortage sustained for 5m. Stopping EV charging to avoid grid costs.")
+				log.Printf("DAWN: PV shortage (Net Import: %.2fA) at minimum charging. Starting %v shutdown timer.", -netExport, stopDelay)
+			} else if time.Since(tc.pvShortageStartTime) > stopDelay {
+				log.Printf("DAWN: PV shortage sustained for %v. Stopping EV charging to avoid grid costs.", stopDelay)
 				tc.stopChargingInternal()
+				tc.setChargeStateInternal(ChargePvShortageCooldown, fmt.Sprintf("grid import %.1fA at minimum current for %v", -netExport, stopDelay))
+				tc.haService.notify(NotifyPvCharging, SeverityInfo, "PV charging stopped, not enough surplus.")
 				return
 			}
 		} else if netExport > -1.0 || tc.currentAmps > tc.minimumAmps {
@@ -295,8 +666,10 @@ func (tc *dawnConsumerService) calculateAndSetAmps() {
 		}
 	}
 
-	// 4. THROTTLE & LOCKOUT
-	if time.Since(tc.lastExecution) < 30*time.Second {
+	// 4. LOCKOUT
+	// The PID runs once per control pass. After a start or a protection
+	// reduction it waits a period for the car to follow.
+	if !tc.lockoutOverInternal() {
 		return
 	}
 	if time.Since(tc.lastHardSafetyEvent) < 60*time.Second {
@@ -304,40 +677,51 @@ func (tc *dawnConsumerService) calculateAndSetAmps() {
 	}
 
 	// 5. CHECK IF ADJUSTMENT IS NEEDED
-	// Inline isActuallyCharging logic here to avoid deadlocks since we already hold the lock
-	actuallyCharging := false
-	if tc.isCharging {
-		switch tc.connectorStatus {
-		case "charging", "3", "busy", "connected", "2", "awaiting start":
-			actuallyCharging = true
-		}
-	}
-
-	if !actuallyCharging {
+	if !tc.isActuallyChargingInternal() {
 		return
 	}
+	if current, _, _ := tc.charge.current(); current == ChargeThrottled {
+		tc.setChargeStateInternal(ChargeCharging, "safety lockout ended")
+	}
 
 	// 6. OPTIMIZATION LAYER (PID)
 	var input float64
 	var currentSetpoint float64
 
-	if tc.pvOnlyMode {
+	if pvOnly {
 		currentSetpoint = 0.5
-		// Input is "average per-phase export"
-		input = netExport / 3.0
+		// Input is "average export per charger phase"
+		input = netExport / chargerPhaseCount
 	} else {
 		currentSetpoint = tc.setpoint
 		input = maxPhaseCurrent
 	}
 
+	if tc.pidConfig != nil {
+		if pvOnly {
+			tc.pid.apply(tc.pidConfig.pv)
+		} else {
+			tc.pid.apply(tc.pidConfig.fuse)
+		}
+	}
 	tc.pid.Setpoint = currentSetpoint
-	adjustment := tc.pid.Update(input)
+	adjustment := tc.pid.UpdateWithDt(input, tc.controlPeriodInternal().Seconds())
 
-	if tc.pvOnlyMode {
+	if pvOnly {
 		adjustment = -adjustment
 	}
 
 	targetAmps := tc.currentAmps + adjustment
+	curtailmentRamp := 0.0
+	if pvOnly {
+		curtailmentRamp = tc.curtailmentRampInternal()
+	}
+	if curtailmentRamp > 0 {
+		// The export sensors cannot show what the inverter holds back, so step
+		// up until it stops curtailing and let the PID take over from there
+		targetAmps = tc.currentAmps + curtailmentRamp
+		tc.pid.Integral = 0
+	}
 
 	if targetAmps < tc.minimumAmps {
 		targetAmps = tc.minimumAmps
@@ -349,18 +733,229 @@ func (tc *dawnConsumerService) calculateAndSetAmps() {
 	if tc.userLimit > 0 && targetAmps > tc.userLimit {
 		targetAmps = tc.userLimit
 	}
+	if override {
+		targetAmps = tc.peakCapInternal(targetAmps, now)
+	}
 
 	if int(targetAmps) != int(tc.currentAmps) {
 		modeStr := "NORMAL"
-		if tc.pvOnlyMode {
+		if curtailmentRamp > 0 {
+			modeStr = "PV-ONLY CURTAILED"
+		} else if pvOnly {
 			modeStr = "PV-ONLY"
+		} else if override {
+			modeStr = "LOW-PRICE"
 		}
 		log.Printf("DAWN: %s PID Adjustment %vA -> %vA (Max Phase: %.2fA, Net Export: %.2fA, Actual Draw: %.2fA)", modeStr, int(tc.currentAmps), int(targetAmps), maxPhaseCurrent, netExport, tc.actualAmps)
 		tc.setAmpsInternal(targetAmps)
 	} else {
 		tc.currentAmps = targetAmps
 	}
+}
+
+// hardSafetyInternal reduces the charger, or stops it at the minimum current,
+// when a charger phase is over the fuse limit. It returns true when the rest
+// of the control pass should be skipped.
+func (tc *dawnConsumerService) hardSafetyInternal(maxPhaseCurrent float64) bool {
+	// IMPORTANT: Fuses are per-phase, so we still use maxPhaseCurrent here!
+	if tc.fuse != nil && tc.fuseProtectionInternal(maxPhaseCurrent) {
+		return true
+	}
+	now := tc.nowInternal()
+	hardSafetyThreshold := tc.setpoint + 2.0
+	// With a trip curve, overloads the fuse carries for a while are left to
+	// the fuse model. The threshold stays as a backstop for those it would
+	// trip on within fuseBackstopTripTime.
+	tolerated := tc.fuse != nil && tc.fuse.tripTime(maxPhaseCurrent) >= fuseBackstopTripTime.Seconds()
+	if maxPhaseCurrent > hardSafetyThreshold && !tolerated && now.Sub(tc.lastHardSafetyEvent) > 5*time.Second {
+		if tc.unresponsiveStopInternal(maxPhaseCurrent) {
+			return true
+		}
+
+		// BASELINE: Use Actual Draw if it's lower than our current setting
+		baseline := math.Min(tc.currentAmps, tc.actualAmps)
+		if baseline < tc.minimumAmps {
+			baseline = tc.currentAmps // Fallback if actual is weirdly low (e.g. 0 during ramp)
+		}
+
+		if baseline <= tc.minimumAmps {
+			if tc.overcurrentStartTime.IsZero() {
+				tc.overcurrentStartTime = now
+				log.Printf("DAWN: Overcurrent detected at minimum charging. Starting 10s shutdown timer.")
+			} else if now.Sub(tc.overcurrentStartTime) > 10*time.Second {
+				msg := fmt.Sprintf("CRITICAL OVERCURRENT (%.2fA). Emergency stop of EV charger.", maxPhaseCurrent)
+				log.Printf("DAWN: %s", msg)
+				tc.haService.notify(NotifyEmergencyStop, SeverityCritical, msg, notificationAction{Action: ActionResumeCharging, Title: "Resume charging"})
+
+				tc.stopChargingInternal()
+				tc.setChargeStateInternal(ChargeEmergencyStopped, fmt.Sprintf("overcurrent %.1fA at minimum current for 10s", maxPhaseCurrent))
+				return true
+			}
+		} else {
+			overage := maxPhaseCurrent - tc.setpoint
+			reduction := math.Ceil(overage)
+
+			newAmps := math.Max(tc.minimumAmps, baseline-reduction)
+
+			if int(newAmps) != int(tc.currentAmps) {
+				log.Printf("DAWN: HARD SAFETY REDUCTION! Max phase %.2fA. Car drawing %.2fA. Reducing setting %vA -> %vA", maxPhaseCurrent, tc.actualAmps, int(tc.currentAmps), int(newAmps))
+				tc.reduceAmpsInternal(newAmps)
+				tc.pid.Integral = 0
+				tc.lastHardSafetyEvent = now
+				tc.lastExecution = now
+				tc.setChargeStateInternal(ChargeThrottled, fmt.Sprintf("hard safety, max phase %.1fA", maxPhaseCurrent))
+			}
+		}
+		return true
+	}
+	tc.overcurrentStartTime = time.Time{}
+	return false
+}
+
+// fuseProtectionInternal acts on the thermal load of the fuses instead of the
+// instantaneous current, so short spikes are ridden out while sustained
+// overloads are cut as fast as the trip curve demands. It returns true when
+// the rest of the control loop should be skipped.
+func (tc *dawnConsumerService) fuseProtectionInternal(maxPhaseCurrent float64) bool {
+	now := tc.nowInternal()
+	load := tc.fuse.maxLoad(tc.safetyPhaseList(), now)
+	if load < tc.fuse.reduceLevel {
+		return false
+	}
+	if maxPhaseCurrent > tc.setpoint && tc.unresponsiveStopInternal(maxPhaseCurrent) {
+		return true
+	}
+
+	baseline := math.Min(tc.currentAmps, tc.actualAmps)
+	if baseline < tc.minimumAmps {
+		baseline = tc.currentAmps
+	}
+
+	var newAmps float64
+	if load >= tc.fuse.stopLevel {
+		if baseline <= tc.minimumAmps {
+			msg := fmt.Sprintf("CRITICAL OVERCURRENT (%.2fA, fuse load %.0f%%). Emergency stop of EV charger.", maxPhaseCurrent, load*100)
+			log.Printf("DAWN: %s", msg)
+			tc.haService.notify(NotifyEmergencyStop, SeverityCritical, msg, notificationAction{Action: ActionResumeCharging, Title: "Resume charging"})
+			tc.stopChargingInternal()
+			tc.setChargeStateInternal(ChargeEmergencyStopped, fmt.Sprintf("fuse load %.0f%% at minimum current", load*100))
+			return true
+		}
+		newAmps = tc.minimumAmps
+	} else {
+		if maxPhaseCurrent <= tc.setpoint || now.Sub(tc.lastHardSafetyEvent) <= 5*time.Second {
+			// Already back within limits (fuse cooling) or just acted
+			return maxPhaseCurrent > tc.setpoint
+		}
+		newAmps = math.Max(tc.minimumAmps, baseline-math.Ceil(maxPhaseCurrent-tc.setpoint))
+	}
+
+	if int(newAmps) != int(tc.currentAmps) {
+		log.Printf("DAWN: FUSE PROTECTION REDUCTION! Max phase %.2fA, fuse load %.0f%%. Reducing setting %vA -> %vA", maxPhaseCurrent, load*100, int(tc.currentAmps), int(newAmps))
+		tc.reduceAmpsInternal(newAmps)
+		tc.pid.Integral = 0
+		tc.lastHardSafetyEvent = now
+		tc.lastExecution = now
+		tc.setChargeStateInternal(ChargeThrottled, fmt.Sprintf("fuse load %.0f%%", load*100))
+	}
+	return true
+}
+
+// reportImbalanceInternal computes the phase spread and estimated neutral
+// current, updates the metrics and periodically publishes them to HA.
+func (tc *dawnConsumerService) reportImbalanceInternal() (float64, float64) {
+	phases := tc.phaseList()
+	currents := make([]float64, len(phases))
+	for n, i := range phases {
+		phaseKey := fmt.Sprintf("phase%d", i)
+		currents[n] = tc.currents[phaseKey] - tc.exports[phaseKey]
+	}
+	imbalance := phaseImbalance(currents)
+	neutral := neutralCurrent(currents)
+
+	metrics.setGauge("electricity_phase_imbalance_amps", imbalance)
+	metrics.setGauge("electricity_neutral_current_amps", neutral)
+
+	if tc.imbalance.sensorId != "" && time.Since(tc.lastImbalanceReport) > 30*time.Second {
+		tc.lastImbalanceReport = time.Now()
+		attributes := map[string]interface{}{
+			"unit_of_measurement": "A",
+			"device_class":        "current",
+			"friendly_name":       "Phase imbalance",
+			"neutral_current":     math.Round(neutral*100) / 100,
+			"imbalance_limit":     tc.imbalance.limit,
+			"neutral_limit":       tc.imbalance.neutralLimit,
+		}
+		state := fmt.Sprintf("%.2f", imbalance)
+		go func() {
+			if err := tc.haService.publishState(tc.imbalance.sensorId, state, attributes); err != nil {
+				log.Printf("DAWN: could not publish phase imbalance: %v", err)
+			}
+		}()
+	}
+	return imbalance, neutral
+}
+
+// imbalanceProtectionInternal relieves the heaviest phase when the spread or
+// the neutral current is over its limit. This only helps when the car draws
+// from fewer phases than the installation has, so the charger either switches
+// to all phases or reduces. It returns true when it has acted.
+func (tc *dawnConsumerService) imbalanceProtectionInternal(imbalance float64, neutral float64) bool {
+	over := 0.0
+	if tc.imbalance.limit > 0 {
+		over = math.Max(over, imbalance-tc.imbalance.limit)
+	}
+	if tc.imbalance.neutralLimit > 0 {
+		over = math.Max(over, neutral-tc.imbalance.neutralLimit)
+	}
+	if over <= 0 || time.Since(tc.lastImbalanceEvent) < 30*time.Second {
+		return false
+	}
+
+	control := tc.controlPhaseList()
+	if len(control) >= len(tc.phaseList()) {
+		// The car loads every phase equally and cannot change the spread
+		return false
+	}
+
+	heaviest, heaviestCurrent := 0, math.Inf(-1)
+	for _, i := range tc.phaseList() {
+		phaseKey := fmt.Sprintf("phase%d", i)
+		if c := tc.currents[phaseKey] - tc.exports[phaseKey]; c > heaviestCurrent {
+			heaviest, heaviestCurrent = i, c
+		}
+	}
+	onHeaviest := false
+	for _, i := range control {
+		if i == heaviest {
+			onHeaviest = true
+		}
+	}
+	if !onHeaviest {
+		return false
+	}
+
+	tc.lastImbalanceEvent = time.Now()
+	if tc.imbalance.phaseSwitchId != "" && !tc.phaseSwitchTried {
+		log.Printf("DAWN: Phase imbalance %.2fA (neutral %.2fA) over limit. Switching charger to all phases.", imbalance, neutral)
+		tc.phaseSwitchTried = true
+		tc.haService.setDawnSwitch(true, tc.imbalance.phaseSwitchId)
+		tc.activePhases = nil
+		tc.beginPhaseDetectionInternal()
+		tc.setChargeStateInternal(ChargeThrottled, fmt.Sprintf("phase imbalance %.1fA, switching to all phases", imbalance))
+		return true
+	}
+
+	newAmps := math.Max(tc.minimumAmps, tc.currentAmps-math.Ceil(over))
+	if int(newAmps) == int(tc.currentAmps) {
+		return false
+	}
+	log.Printf("DAWN: Phase imbalance %.2fA (neutral %.2fA) over limit on phase %d. Reducing setting %vA -> %vA", imbalance, neutral, heaviest, int(tc.currentAmps), int(newAmps))
+	tc.reduceAmpsInternal(newAmps)
+	tc.pid.Integral = 0
 	tc.lastExecution = time.Now()
+	tc.setChargeStateInternal(ChargeThrottled, fmt.Sprintf("phase imbalance %.1fA, neutral %.1fA", imbalance, neutral))
+	return true
 }
 
 func (tc *dawnConsumerService) stopCharging() {
@@ -369,8 +964,45 @@ func (tc *dawnConsumerService) stopCharging() {
 	tc.stopChargingInternal()
 }
 
+// resumeCharging restarts charging at the minimum current on request, e.g.
+// after an emergency stop. The safety layers stay active and stop it again if
+// the overload persists.
+func (tc *dawnConsumerService) resumeCharging() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.isCharging {
+		return
+	}
+	log.Printf("DAWN: Resuming EV charging on request.")
+	tc.stoppedOnRequest = false
+	if current, _, _ := tc.charge.current(); current == ChargePvShortageCooldown {
+		tc.setChargeStateInternal(ChargeIdle, "cooldown ended on request")
+	}
+	tc.isCharging = true
+	tc.setChargeStateInternal(ChargeStarting, "resumed on request")
+	tc.beginPhaseDetectionInternal()
+	tc.haService.setDawnSwitch(true, tc.dawnSwitch)
+	tc.setAmpsInternal(tc.minimumAmps)
+	tc.pid.Integral = 0
+	tc.overcurrentStartTime = time.Time{}
+	tc.pvSurplusStartTime = time.Time{}
+	tc.pvShortageStartTime = time.Time{}
+}
+
+// stopChargingOnRequest stops charging and keeps it stopped until resumed or
+// the car is unplugged.
+func (tc *dawnConsumerService) stopChargingOnRequest() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	log.Printf("DAWN: Stopping EV charging on request.")
+	tc.stoppedOnRequest = true
+	tc.stopChargingInternal()
+	tc.setChargeStateInternal(ChargeIdle, "stopped on request")
+}
+
 func (tc *dawnConsumerService) stopChargingInternal() {
 	tc.isCharging = false
+	tc.phaseSwitchTried = false
 	tc.haService.setDawnSwitch(false, tc.dawnSwitch)
 	tc.overcurrentStartTime = time.Time{}
 	tc.pvShortageStartTime = time.Time{}
@@ -384,7 +1016,7 @@ func (tc *dawnConsumerService) getMinExport() float64 {
 
 func (tc *dawnConsumerService) getMinExportInternal() float64 {
 	min := 999.0
-	if len(tc.exports) < 3 {
+	if len(tc.exports) < len(tc.phaseList()) {
 		return 0
 	}
 	for _, value := range tc.exports {
@@ -395,9 +1027,44 @@ func (tc *dawnConsumerService) getMinExportInternal() float64 {
 	return min
 }
 
+// getAvailableExportInternal returns the surplus available to the charger,
+// expressed as the equivalent net export summed over the phases, using the
+// configured accounting model.
+func (tc *dawnConsumerService) getAvailableExportInternal() float64 {
+	switch tc.accounting {
+	case AccountingPerPhaseStrict:
+		// The charger loads its phases equally, so the charger phase with the
+		// least surplus decides how much can be drawn without importing.
+		chargerPhases := tc.controlPhaseList()
+		min := math.Inf(1)
+		for _, i := range chargerPhases {
+			phaseKey := fmt.Sprintf("phase%d", i)
+			net := tc.exports[phaseKey] - tc.currents[phaseKey]
+			if net < min {
+				min = net
+			}
+		}
+		return min * float64(len(chargerPhases))
+	case AccountingPerPhaseWeighted:
+		weight := tc.importWeight
+		if weight <= 0 {
+			weight = 1.0
+		}
+		net := 0.0
+		for _, i := range tc.phaseList() {
+			phaseKey := fmt.Sprintf("phase%d", i)
+			net += tc.exports[phaseKey]
+			net -= tc.currents[phaseKey] * weight
+		}
+		return net
+	default:
+		return tc.getNetExportInternal()
+	}
+}
+
 func (tc *dawnConsumerService) getNetExportInternal() float64 {
 	net := 0.0
-	for i := 1; i <= 3; i++ {
+	for _, i := range tc.phaseList() {
 		phaseKey := fmt.Sprintf("phase%d", i)
 		net += tc.exports[phaseKey]
 		net -= tc.currents[phaseKey]
@@ -405,6 +1072,108 @@ func (tc *dawnConsumerService) getNetExportInternal() float64 {
 	return net
 }
 
+// phaseList returns the installation phases, defaulting to three phases.
+func (tc *dawnConsumerService) phaseList() []int {
+	if len(tc.phases) == 0 {
+		return TopologyThreePhase.phases()
+	}
+	return tc.phases
+}
+
+// chargerPhaseList returns the phases the charger is wired to, defaulting to
+// all installation phases.
+func (tc *dawnConsumerService) chargerPhaseList() []int {
+	if len(tc.chargerPhases) == 0 {
+		return tc.phaseList()
+	}
+	return tc.chargerPhases
+}
+
+// controlPhaseList returns the phases the car actually draws from once that
+// has been detected. Before that it is the phase of the charger's L1 when a
+// phase rotation is configured (a single-phase car), otherwise all charger
+// phases.
+func (tc *dawnConsumerService) controlPhaseList() []int {
+	if len(tc.activePhases) > 0 {
+		return tc.activePhases
+	}
+	if tc.assumeFirstPhase && !tc.phaseSwitchTried && len(tc.chargerPhases) > 0 {
+		return tc.chargerPhases[:1]
+	}
+	return tc.chargerPhaseList()
+}
+
+// safetyPhaseList returns the phases hard safety watches. Until the car's
+// phases are detected that is every charger phase, so a wrong assumption
+// about the car cannot hide an overload.
+func (tc *dawnConsumerService) safetyPhaseList() []int {
+	if len(tc.activePhases) > 0 {
+		return tc.activePhases
+	}
+	return tc.chargerPhaseList()
+}
+
+// beginPhaseDetectionInternal snapshots the per-phase load just before the car
+// starts drawing, so the phases it uses can be told apart afterwards.
+func (tc *dawnConsumerService) beginPhaseDetectionInternal() {
+	tc.phaseBaseline = make(map[string]float64)
+	for _, i := range tc.chargerPhaseList() {
+		phaseKey := fmt.Sprintf("phase%d", i)
+		tc.phaseBaseline[phaseKey] = tc.currents[phaseKey] - tc.exports[phaseKey]
+	}
+	tc.phaseDetectStart = time.Now()
+}
+
+// detectPhasesInternal compares the per-phase load against the snapshot taken
+// at start and records the phases that rose with the car's draw.
+func (tc *dawnConsumerService) detectPhasesInternal() {
+	if tc.phaseBaseline == nil || time.Since(tc.phaseDetectStart) < phaseDetectDelay {
+		return
+	}
+	if tc.actualTotalAmps < tc.minimumAmps*0.5 {
+		// The car is not drawing yet
+		return
+	}
+
+	deltas := make(map[int]float64)
+	maxDelta := 0.0
+	for _, i := range tc.chargerPhaseList() {
+		phaseKey := fmt.Sprintf("phase%d", i)
+		delta := tc.currents[phaseKey] - tc.exports[phaseKey] - tc.phaseBaseline[phaseKey]
+		deltas[i] = delta
+		if delta > maxDelta {
+			maxDelta = delta
+		}
+	}
+	tc.phaseBaseline = nil
+
+	var active []int
+	for _, i := range tc.chargerPhaseList() {
+		if deltas[i] >= phaseDetectMinDelta && deltas[i] >= maxDelta*0.5 {
+			active = append(active, i)
+		}
+	}
+	if len(active) == 0 {
+		log.Printf("DAWN: Could not detect car phase usage (deltas %v). Assuming all charger phases.", deltas)
+		return
+	}
+
+	tc.activePhases = active
+	tc.actualAmps = tc.actualTotalAmps / float64(len(active))
+	log.Printf("DAWN: Car detected drawing on phases %v (deltas %v).", active, deltas)
+}
+
+// getMaxPhaseCurrentInternal returns the highest import current among phases.
+func (tc *dawnConsumerService) getMaxPhaseCurrentInternal(phases []int) float64 {
+	max := 0.0
+	for _, i := range phases {
+		if value := tc.currents[fmt.Sprintf("phase%d", i)]; value > max {
+			max = value
+		}
+	}
+	return max
+}
+
 func (tc *dawnConsumerService) setAmps(amps float64) {
 	tc.mu.Lock()
 	defer tc.mu.Unlock()
@@ -413,7 +1182,22 @@ func (tc *dawnConsumerService) setAmps(amps float64) {
 
 func (tc *dawnConsumerService) setAmpsInternal(amps float64) {
 	tc.currentAmps = amps
-	tc.haService.updateAmpsDawn(int(tc.currentAmps), tc.dawnId)
+	if tc.actuator == nil {
+		tc.haService.updateAmpsDawn(int(tc.currentAmps), tc.dawnId)
+		return
+	}
+	tc.actuator.setAmps(tc.dawnId, int(tc.currentAmps), false)
+}
+
+// reduceAmpsInternal is setAmpsInternal for safety reductions, which bypass
+// the actuator's minimum command interval.
+func (tc *dawnConsumerService) reduceAmpsInternal(amps float64) {
+	tc.currentAmps = amps
+	if tc.actuator == nil {
+		tc.haService.updateAmpsDawn(int(tc.currentAmps), tc.dawnId)
+		return
+	}
+	tc.actuator.setAmps(tc.dawnId, int(tc.currentAmps), true)
 }
 
 func (tc *dawnConsumerService) getMaxCurrent() float64 {
@@ -87,3 +87,167 @@ func TestParseFloat(t *testing.T) {
 	assert.Equal(t, 0.0, parseFloat("invalid"))
 	assert.Equal(t, 10.0, parseFloat(10))
 }
+
+func TestDawnConsumer_PIDTuning(t *testing.T) {
+	tc := &dawnConsumerService{
+		haService: &haService{},
+		pid:       &PIDController{},
+		pidConfig: &pidConfig{
+			fuse:       defaultPIDTuning,
+			pv:         defaultPIDTuning,
+			fuseEntity: "input_text.pid_fuse",
+			pvEntity:   "input_text.pid_pv",
+		},
+	}
+
+	tc.pidTuningStateInternal("input_text.pid_pv", "kp=0.8,deadband=1")
+	assert.Equal(t, 0.8, tc.pidConfig.pv.Kp)
+	assert.Equal(t, 1.0, tc.pidConfig.pv.Deadband)
+	assert.Equal(t, defaultPIDTuning, tc.pidConfig.fuse)
+
+	tc.pidTuningStateInternal("input_text.pid_fuse", "kp=lots")
+	assert.Equal(t, defaultPIDTuning, tc.pidConfig.fuse, "invalid tuning ignored")
+	tc.pidTuningStateInternal("input_text.pid_fuse", "unavailable")
+	assert.Equal(t, defaultPIDTuning, tc.pidConfig.fuse)
+}
+
+func TestDawnConsumer_ReadingsOnlyRunSafety(t *testing.T) {
+	newService := func() *dawnConsumerService {
+		return &dawnConsumerService{
+			isCharging:         true,
+			currentAmps:        10.0,
+			actualAmps:         10.0,
+			minimumAmps:        6.0,
+			maximumAmps:        16.0,
+			setpoint:           20.0,
+			currents:           make(map[string]float64),
+			hasDirectionalData: make(map[string]bool),
+			exports:            make(map[string]float64),
+			haService:          &haService{},
+			connectorStatus:    "charging",
+			pid:                &PIDController{Setpoint: 20.0, Kp: 0.4, Ki: 0.01},
+		}
+	}
+
+	// Headroom: a reading changes nothing until the control pass
+	service := newService()
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 12.0})
+	assert.Equal(t, 10.0, service.currentAmps)
+	service.calculateAndSetAmps()
+	assert.Greater(t, service.currentAmps, 10.0)
+
+	// Overcurrent is acted on at the reading
+	service = newService()
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 24.0})
+	assert.Equal(t, 6.0, service.currentAmps)
+	assert.False(t, service.lastHardSafetyEvent.IsZero())
+}
+
+func TestDawnConsumer_ControlPassIndependentOfMeterRate(t *testing.T) {
+	run := func(readings int) float64 {
+		service := &dawnConsumerService{
+			isCharging:         true,
+			currentAmps:        10.0,
+			actualAmps:         10.0,
+			minimumAmps:        6.0,
+			maximumAmps:        16.0,
+			setpoint:           20.0,
+			currents:           make(map[string]float64),
+			hasDirectionalData: make(map[string]bool),
+			exports:            make(map[string]float64),
+			haService:          &haService{},
+			connectorStatus:    "charging",
+			controlPeriod:      10 * time.Second,
+			pid:                &PIDController{Setpoint: 20.0, Kp: 0.1, Ki: 0.02, Kd: 0.5, DerivativeFilter: 20},
+		}
+		for pass := 0; pass < 3; pass++ {
+			for i := 0; i < readings; i++ {
+				service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 14.0 - float64(pass)})
+			}
+			service.calculateAndSetAmps()
+		}
+		return service.currentAmps
+	}
+	assert.Equal(t, run(1), run(50))
+
+}
+
+func TestDawnConsumer_StartHoldsPIDForAPeriod(t *testing.T) {
+	service := &dawnConsumerService{
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		currents:           map[string]float64{"phase1": 5.0},
+		hasDirectionalData: make(map[string]bool),
+		exports:            make(map[string]float64),
+		haService:          &haService{},
+		connectorStatus:    "charging",
+		pid:                &PIDController{Setpoint: 20.0, Kp: 0.4},
+	}
+
+	service.calculateAndSetAmps()
+	assert.True(t, service.isCharging)
+	assert.Equal(t, 6.0, service.currentAmps)
+
+	service.calculateAndSetAmps()
+	assert.Equal(t, 6.0, service.currentAmps, "the car has not followed yet")
+
+	service.lastExecution = time.Now().Add(-defaultControlPeriod)
+	service.calculateAndSetAmps()
+	assert.Greater(t, service.currentAmps, 6.0)
+}
+
+func TestDawnConsumer_PIDRunsOnFirstTickAfterLockout(t *testing.T) {
+	service := &dawnConsumerService{
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		currents:           map[string]float64{"phase1": 5.0},
+		hasDirectionalData: make(map[string]bool),
+		exports:            make(map[string]float64),
+		haService:          &haService{},
+		connectorStatus:    "charging",
+		pid:                &PIDController{Setpoint: 20.0, Kp: 0.4},
+	}
+	service.calculateAndSetAmps()
+	assert.True(t, service.isCharging)
+
+	// Half a period after the start the car has not followed yet
+	service.lastExecution = time.Now().Add(-defaultControlPeriod / 2)
+	service.calculateAndSetAmps()
+	assert.Equal(t, 6.0, service.currentAmps)
+
+	// The start was made 200ms into its tick, so the next tick comes
+	// slightly less than a period after it
+	service.lastExecution = time.Now().Add(-defaultControlPeriod + 200*time.Millisecond)
+	service.calculateAndSetAmps()
+	assert.Greater(t, service.currentAmps, 6.0)
+}
+
+func TestDawnConsumer_ZeroReadingKeepsOtherDirection(t *testing.T) {
+	fuse, err := newFuseModel("C", 20, 300*time.Second, 0.2, 0.6)
+	assert.NoError(t, err)
+	service := &dawnConsumerService{
+		currents:           make(map[string]float64),
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		fuse:               fuse,
+		pid:                &PIDController{},
+	}
+
+	// Separate HA import and export sensors, the idle export one reporting last
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 10})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 0})
+	assert.Equal(t, 10.0, service.currents["phase1"])
+	assert.Equal(t, 10.0, fuse.lastCurrent[1], "the fuse model sees the loaded phase")
+
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 5})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 0})
+	assert.Equal(t, 0.0, service.currents["phase1"])
+	assert.Equal(t, 5.0, service.exports["phase1"])
+
+	// Absolute current is ignored once directional data has been seen
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 7})
+	assert.Equal(t, 0.0, service.currents["phase1"])
+}
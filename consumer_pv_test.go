@@ -170,3 +170,70 @@ func TestDawnConsumer_PVOnlySwitchTrigger(t *testing.T) {
 	assert.True(t, mode, "PV mode should be ON")
 	assert.True(t, started, "PV surplus timer should have started immediately upon switch ON")
 }
+
+func TestDawnConsumer_AvailableExportAccounting(t *testing.T) {
+	service := &dawnConsumerService{
+		exports:      map[string]float64{"phase1": 10.0, "phase2": 8.0, "phase3": 0.0},
+		currents:     map[string]float64{"phase1": 0.0, "phase2": 0.0, "phase3": 2.0},
+		importWeight: 2.0,
+	}
+
+	// Summed: 10 + 8 - 2 = 16
+	service.accounting = AccountingSummed
+	assert.Equal(t, 16.0, service.getAvailableExportInternal())
+
+	// Per-phase strict: phase 3 imports 2A, so the charger may not add load anywhere
+	service.accounting = AccountingPerPhaseStrict
+	assert.Equal(t, -6.0, service.getAvailableExportInternal())
+
+	// Weighted: 10 + 8 - 2*2 = 14
+	service.accounting = AccountingPerPhaseWeighted
+	assert.Equal(t, 14.0, service.getAvailableExportInternal())
+}
+
+func TestDawnConsumer_PVStartConditionPerPhaseStrict(t *testing.T) {
+	service := &dawnConsumerService{
+		isCharging:         false,
+		pvOnlyMode:         true,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		accounting:         AccountingPerPhaseStrict,
+		exports:            make(map[string]float64),
+		currents:           make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+	}
+
+	// Summed net export is 20A, but phase 2 imports, so strict accounting must not start.
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 30.0})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 2, value: 10.0})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 3, value: 0.0})
+	service.calculateAndSetAmps()
+	assert.True(t, service.pvSurplusStartTime.IsZero(), "Strict accounting should not see a surplus")
+
+	// Every phase exports at least 6A.
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 7.0})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 2, value: 6.5})
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 3, value: 6.0})
+	service.calculateAndSetAmps()
+	assert.False(t, service.pvSurplusStartTime.IsZero(), "Strict accounting should start the surplus timer")
+
+	service.pvSurplusStartTime = time.Now().Add(-6 * time.Minute)
+	service.calculateAndSetAmps()
+	assert.True(t, service.isCharging)
+}
+
+func TestParseExportAccounting(t *testing.T) {
+	a, err := parseExportAccounting("per_phase")
+	assert.NoError(t, err)
+	assert.Equal(t, AccountingPerPhaseStrict, a)
+
+	a, err = parseExportAccounting("")
+	assert.NoError(t, err)
+	assert.Equal(t, AccountingSummed, a)
+
+	_, err = parseExportAccounting("bogus")
+	assert.Error(t, err)
+}
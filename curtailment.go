@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/tuomaz/gohaws"
+)
+
+const (
+	// curtailmentMargin is how close, in A, the export has to be to the
+	// feed-in limit to count as held there by the inverter.
+	curtailmentMargin = 0.5
+	// inverterLimitStep is the smallest inverter limit change written, in W.
+	inverterLimitStep = 100.0
+	// inverterLimitInterval is the minimum time between raising the limit.
+	inverterLimitInterval = 10 * time.Second
+)
+
+// curtailment handles an inverter that curtails production to stay within a
+// feed-in limit. The export sensors then only show the allowed export, so the
+// power held back is estimated from the production and the inverter rating.
+type curtailment struct {
+	feedInLimit      float64 // max export in W summed over the phases
+	hasFeedInLimit   bool    // feedInLimit is set, 0 is a zero export limit
+	phaseLimit       float64 // max export per phase in A, 0 disables
+	capacity         float64 // inverter AC rating in W, 0 when unknown
+	productionSensor string  // optional HA sensor of the PV production
+	sensor           string  // optional HA entity reporting active curtailment
+	limitEntity      string  // optional HA number the inverter power limit is written to, in W
+	rampStep         float64 // A per control cycle while uncovering curtailed power
+	voltage          float64
+
+	reported  bool // the curtailment sensor is on
+	limit     float64
+	limitTime time.Time
+}
+
+// parseCurtailedState reads the state of a curtailment sensor. Binary
+// sensors, "limited"/"curtailed" style enums and a nonzero curtailed power all
+// count as curtailing.
+func parseCurtailedState(state string) bool {
+	switch strings.ToLower(strings.TrimSpace(state)) {
+	case "on", "true", "yes", "active", "curtailed", "limited", "limiting":
+		return true
+	}
+	return parseFloat(state) > 0
+}
+
+// curtailmentStateInternal takes the production and curtailment sensor
+// updates. It returns false for other entities.
+func (tc *dawnConsumerService) curtailmentStateInternal(entity string, state *gohaws.State) bool {
+	c := tc.curtailment
+	if c == nil || entity == "" || state == nil {
+		return false
+	}
+	switch entity {
+	case c.productionSensor:
+		tc.production = toWatts(parseFloat(state.State), stateUnit(state))
+	case c.sensor:
+		reported := parseCurtailedState(fmt.Sprintf("%v", state.State))
+		if reported != c.reported {
+			log.Printf("DAWN: Inverter curtailment %v -> %v.", c.reported, reported)
+		}
+		c.reported = reported
+	default:
+		return false
+	}
+	return true
+}
+
+func (c *curtailment) nominalVoltage() float64 {
+	if c.voltage <= 0 {
+		return 230
+	}
+	return c.voltage
+}
+
+func (c *curtailment) amps(watts float64) float64 {
+	return watts / c.nominalVoltage()
+}
+
+// curtailedInternal reports whether the inverter is holding back production.
+// Without a curtailment sensor this is inferred from the export being held at
+// the feed-in limit while the inverter is producing below its rating.
+func (tc *dawnConsumerService) curtailedInternal() bool {
+	c := tc.curtailment
+	if c == nil {
+		return false
+	}
+	if c.sensor != "" {
+		return c.reported
+	}
+	if tc.production <= 0 || (c.capacity > 0 && tc.production >= c.capacity-inverterLimitStep) {
+		return false
+	}
+	if c.limitEntity != "" && c.limit > 0 && tc.production >= c.limit-inverterLimitStep {
+		return true
+	}
+	if c.hasFeedInLimit && tc.getNetExportInternal() >= c.amps(c.feedInLimit)-curtailmentMargin {
+		return true
+	}
+	if c.phaseLimit > 0 {
+		for _, i := range tc.phaseList() {
+			if tc.exports[fmt.Sprintf("phase%d", i)] >= c.phaseLimit-curtailmentMargin {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// curtailedHeadroomInternal estimates the current, summed over the phases,
+// that the inverter holds back. Without a known rating a curtailed inverter
+// is assumed to cover the minimum current on the charger phases.
+func (tc *dawnConsumerService) curtailedHeadroomInternal() float64 {
+	if !tc.curtailedInternal() {
+		return 0
+	}
+	c := tc.curtailment
+	if c.capacity <= 0 {
+		return tc.minimumAmps * float64(len(tc.controlPhaseList()))
+	}
+	return math.Max(0, c.amps(c.capacity-tc.production))
+}
+
+// curtailmentRampInternal returns the step to raise the charging current by
+// while the inverter is curtailed, or 0 when the PID should regulate.
+func (tc *dawnConsumerService) curtailmentRampInternal() float64 {
+	headroom := tc.curtailedHeadroomInternal()
+	if headroom <= 0 {
+		return 0
+	}
+	step := tc.curtailment.rampStep
+	if step <= 0 {
+		step = 1
+	}
+	return math.Min(step, headroom/float64(len(tc.controlPhaseList())))
+}
+
+// inverterLimitInternal writes the inverter power limit that keeps the export
+// at the feed-in limit: the local consumption plus the allowed export. A
+// raised charging current is followed by the limit, so the feed-in limit is
+// not exceeded while the charger ramps up. Lowering is written at once.
+func (tc *dawnConsumerService) inverterLimitInternal(now time.Time) {
+	c := tc.curtailment
+	if c == nil || c.limitEntity == "" || tc.production <= 0 {
+		return
+	}
+	consumption := tc.production - tc.getNetExportInternal()*c.nominalVoltage()
+	limit := math.Max(0, consumption+c.feedInLimit)
+	if c.capacity > 0 {
+		limit = math.Min(limit, c.capacity)
+	}
+	limit = math.Round(limit/inverterLimitStep) * inverterLimitStep
+	if math.Abs(limit-c.limit) < inverterLimitStep {
+		return
+	}
+	if limit > c.limit && now.Sub(c.limitTime) < inverterLimitInterval {
+		return
+	}
+	c.limit, c.limitTime = limit, now
+	value := fmt.Sprintf("%.0f", limit)
+	log.Printf("DAWN: Inverter limit %sW (consumption %.0fW, feed-in limit %.0fW).", value, consumption, c.feedInLimit)
+	tc.haService.sendCommand("number", "set_value", map[string]string{"value": value}, c.limitEntity, value)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuomaz/gohaws"
+)
+
+// newCurtailedConsumer is a PV-only consumer behind an inverter limited to
+// zero export, producing 3kW of a 10kW rating.
+func newCurtailedConsumer() *dawnConsumerService {
+	return &dawnConsumerService{
+		haService:          &haService{},
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        6,
+		setpoint:           20,
+		pvOnlyMode:         true,
+		currents:           map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0},
+		exports:            map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0},
+		hasDirectionalData: make(map[string]bool),
+		pid:                &PIDController{Kp: 0.4, Ki: 0.01, Kd: 0.05, Setpoint: 0.5},
+		production:         3000,
+		curtailment:        &curtailment{hasFeedInLimit: true, capacity: 10000, rampStep: 1, voltage: 230},
+	}
+}
+
+func TestCurtailment_Detection(t *testing.T) {
+	tc := newCurtailedConsumer()
+	assert.True(t, tc.curtailedInternal(), "export held at the zero feed-in limit")
+	assert.InDelta(t, 7000.0/230, tc.curtailedHeadroomInternal(), 1e-9)
+
+	tc.currents["phase1"] = 4
+	assert.False(t, tc.curtailedInternal(), "importing, so nothing is held back")
+
+	tc.currents["phase1"] = 0
+	tc.production = 10000
+	assert.False(t, tc.curtailedInternal(), "producing at the inverter rating")
+
+	tc.production = 0
+	assert.False(t, tc.curtailedInternal(), "no production")
+
+	// A per-phase cap
+	tc = newCurtailedConsumer()
+	tc.curtailment.feedInLimit = 6900
+	tc.curtailment.phaseLimit = 5
+	tc.exports = map[string]float64{"phase1": 5, "phase2": 0, "phase3": 0}
+	assert.True(t, tc.curtailedInternal())
+
+	// Only a per-phase cap: no total limit to be held at
+	tc = newCurtailedConsumer()
+	tc.curtailment.hasFeedInLimit = false
+	tc.curtailment.phaseLimit = 10
+	tc.exports = map[string]float64{"phase1": 1, "phase2": 0, "phase3": 0}
+	assert.False(t, tc.curtailedInternal(), "1A of export is far from the 10A phase cap")
+	assert.Equal(t, 0.0, tc.curtailedHeadroomInternal())
+	tc.exports["phase2"] = 9.8
+	assert.True(t, tc.curtailedInternal(), "held at the phase cap")
+
+	// Without a rating, a curtailed inverter is assumed to cover a start
+	tc = newCurtailedConsumer()
+	tc.curtailment.capacity = 0
+	assert.Equal(t, 18.0, tc.curtailedHeadroomInternal())
+}
+
+func TestCurtailment_Sensor(t *testing.T) {
+	tc := newCurtailedConsumer()
+	tc.curtailment.sensor = "binary_sensor.inverter_curtailed"
+	tc.curtailment.productionSensor = "sensor.pv_power"
+	assert.False(t, tc.curtailedInternal(), "the sensor decides")
+
+	assert.True(t, tc.curtailmentStateInternal("binary_sensor.inverter_curtailed", &gohaws.State{State: "on"}))
+	assert.True(t, tc.curtailedInternal())
+
+	assert.True(t, tc.curtailmentStateInternal("sensor.pv_power", &gohaws.State{State: "4.2", UnitOfMeasurement: "kW"}))
+	assert.Equal(t, 4200.0, tc.production)
+	assert.False(t, tc.curtailmentStateInternal("sensor.other", &gohaws.State{State: "1"}))
+
+	assert.True(t, parseCurtailedState("Limited"))
+	assert.True(t, parseCurtailedState("350"))
+	assert.False(t, parseCurtailedState("off"))
+	assert.False(t, parseCurtailedState("0"))
+}
+
+func TestCurtailment_StartsAndRampsUp(t *testing.T) {
+	tc := newCurtailedConsumer()
+
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.isCharging)
+	assert.False(t, tc.pvSurplusStartTime.IsZero(), "curtailed power counts as surplus")
+
+	tc.pvSurplusStartTime = time.Now().Add(-6 * time.Minute)
+	tc.calculateAndSetAmps()
+	assert.True(t, tc.isCharging)
+
+	// The export stays at the limit while the inverter follows the charger
+	tc.connectorStatus = "charging"
+	tc.lastExecution = time.Now().Add(-time.Minute)
+	tc.pid.LastTime = time.Now().Add(-time.Second)
+	tc.calculateAndSetAmps()
+	assert.Equal(t, 7.0, tc.currentAmps)
+
+	// Uncurtailed, the PID backs off from the missing export again
+	tc.production = 10000
+	tc.lastExecution = time.Now().Add(-time.Minute)
+	tc.pid.LastTime = time.Now().Add(-time.Second)
+	tc.calculateAndSetAmps()
+	assert.Less(t, tc.currentAmps, 7.0)
+}
+
+func TestCurtailment_InverterLimit(t *testing.T) {
+	tc := newCurtailedConsumer()
+	tc.curtailment.limitEntity = "number.inverter_power_limit"
+	tc.curtailment.feedInLimit = 500
+	// 3kW production, exporting 2.3kW, so the house uses 700W
+	tc.exports = map[string]float64{"phase1": 10, "phase2": 0, "phase3": 0}
+	now := time.Now()
+
+	tc.inverterLimitInternal(now)
+	assert.Equal(t, 1200.0, tc.curtailment.limit)
+
+	tc.currents = map[string]float64{"phase1": 20, "phase2": 0, "phase3": 0}
+	tc.exports = map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0}
+	tc.inverterLimitInternal(now.Add(time.Second))
+	assert.Equal(t, 1200.0, tc.curtailment.limit, "raised at most every 10s")
+	tc.inverterLimitInternal(now.Add(11 * time.Second))
+	assert.Equal(t, 8100.0, tc.curtailment.limit)
+
+	tc.currents = map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0}
+	tc.inverterLimitInternal(now.Add(12 * time.Second))
+	assert.Equal(t, 3500.0, tc.curtailment.limit, "lowered at once")
+
+	tc.production = 0
+	tc.inverterLimitInternal(now.Add(time.Minute))
+	assert.Equal(t, 3500.0, tc.curtailment.limit, "nothing written without production")
+}
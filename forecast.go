@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pvTimerDefault is the PV-only start and stop delay without a forecast.
+	pvTimerDefault = 5 * time.Minute
+	// pvTimerShort is used when the forecast confirms the measured trend.
+	pvTimerShort = 2 * time.Minute
+	// pvTimerLong rides out a shortage the forecast expects to pass.
+	pvTimerLong = 10 * time.Minute
+	// forecastRefresh is how often the forecast is read and published.
+	forecastRefresh = 15 * time.Minute
+)
+
+// forecastPoint is the forecast average PV production in W over a period.
+type forecastPoint struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Power float64   `json:"power"`
+}
+
+type forecastSource interface {
+	name() string
+	fetch() ([]forecastPoint, error)
+}
+
+// haForecastSource reads the forecast attributes of an HA sensor, e.g. the
+// Solcast or Forecast.Solar integrations.
+type haForecastSource struct {
+	ha     *haService
+	entity string
+}
+
+func (s *haForecastSource) name() string {
+	return "ha:" + s.entity
+}
+
+func (s *haForecastSource) fetch() ([]forecastPoint, error) {
+	if s.ha.client == nil {
+		return nil, errors.New("HA not connected")
+	}
+	state, ok := s.ha.client.GetState(s.entity)
+	if !ok || state == nil {
+		return nil, fmt.Errorf("%s not found", s.entity)
+	}
+	return parseForecastAttributes(state.Attributes)
+}
+
+// fileForecastSource reads a JSON list of {"start", "end", "power"} objects
+// with the power in W, or a Forecast.Solar API response.
+type fileForecastSource struct {
+	path string
+}
+
+func (s *fileForecastSource) name() string {
+	return "file:" + s.path
+}
+
+func (s *fileForecastSource) fetch() ([]forecastPoint, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var points []forecastPoint
+	if err := json.Unmarshal(data, &points); err == nil {
+		return points, nil
+	}
+	var response struct {
+		Result map[string]interface{} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &response); err != nil || response.Result == nil {
+		return nil, fmt.Errorf("invalid forecast file %s", s.path)
+	}
+	return parseForecastAttributes(response.Result)
+}
+
+// parseForecastAttributes reads Solcast style lists (detailedForecast,
+// detailedHourly) with pv_estimate in kW, and Forecast.Solar style "watts"
+// maps from a timestamp to W.
+func parseForecastAttributes(attributes map[string]interface{}) ([]forecastPoint, error) {
+	var points []forecastPoint
+	for _, key := range []string{"detailedForecast", "detailedHourly", "forecast"} {
+		entries, ok := attributes[key].([]interface{})
+		if !ok {
+			continue
+		}
+		var list []forecastPoint
+		for _, entry := range entries {
+			fields, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			start, ok := haTimeField(fields, "period_start", "start", "datetime")
+			if !ok {
+				continue
+			}
+			if kw, ok := haFloatField(fields, "pv_estimate"); ok {
+				list = append(list, forecastPoint{Start: start, Power: kw * 1000})
+			} else if watts, ok := haFloatField(fields, "power", "watts"); ok {
+				list = append(list, forecastPoint{Start: start, Power: watts})
+			}
+		}
+		points = append(points, withForecastEnds(list)...)
+		if len(list) > 0 {
+			break // detailedHourly repeats detailedForecast
+		}
+	}
+
+	if watts, ok := attributes["watts"].(map[string]interface{}); ok {
+		var list []forecastPoint
+		for key, value := range watts {
+			power, ok := value.(float64)
+			if !ok {
+				continue
+			}
+			start, err := time.Parse(time.RFC3339, key)
+			if err != nil {
+				if start, err = time.ParseInLocation("2006-01-02 15:04:05", key, time.Local); err != nil {
+					continue
+				}
+			}
+			list = append(list, forecastPoint{Start: start, Power: power})
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+		points = append(points, withForecastEnds(list)...)
+	}
+
+	if len(points) == 0 {
+		return nil, errors.New("no forecast in the sensor attributes")
+	}
+	return points, nil
+}
+
+// withForecastEnds sets each end to the next start, and the last one a step
+// after its start.
+func withForecastEnds(list []forecastPoint) []forecastPoint {
+	for i := range list {
+		if i+1 < len(list) {
+			list[i].End = list[i+1].Start
+		} else if i > 0 {
+			list[i].End = list[i].Start.Add(list[i].Start.Sub(list[i-1].Start))
+		} else {
+			list[i].End = list[i].Start.Add(time.Hour)
+		}
+	}
+	return list
+}
+
+// parseForecastSources reads a comma separated list such as
+// "ha:sensor.solcast_pv_forecast_forecast_today,ha:sensor.solcast_pv_forecast_forecast_tomorrow".
+// The forecasts of all sources are combined.
+func parseForecastSources(s string, ha *haService) ([]forecastSource, error) {
+	var sources []forecastSource
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		kind, arg, _ := strings.Cut(entry, ":")
+		switch strings.ToLower(kind) {
+		case "":
+			continue
+		case "ha":
+			if arg == "" {
+				return nil, fmt.Errorf("%q needs an entity, e.g. ha:sensor.solcast_pv_forecast_forecast_today", entry)
+			}
+			sources = append(sources, &haForecastSource{ha: ha, entity: arg})
+		case "file":
+			if arg == "" {
+				return nil, fmt.Errorf("%q needs a path", entry)
+			}
+			sources = append(sources, &fileForecastSource{path: arg})
+		default:
+			return nil, fmt.Errorf("unknown forecast source %q", entry)
+		}
+	}
+	return sources, nil
+}
+
+// solarForecaster turns a PV production forecast into surplus predictions
+// for PV-only charging: the start and stop delays, whether a start is worth
+// it, and how much of a requested charge solar can cover today.
+type solarForecaster struct {
+	sources  []forecastSource
+	baseLoad float64       // expected household use in W, subtracted from the production
+	minRun   time.Duration // how long the surplus has to last to start
+	minPower float64       // charging power in W at the minimum current
+	maxPower float64       // charging power in W at the maximum current
+
+	ha            *haService
+	sensor        string // HA sensor the solar coverage is published to
+	requestEntity string // optional HA entity with the requested charge in kWh
+
+	mu     sync.RWMutex
+	points []forecastPoint
+}
+
+// update reads and combines all sources. The forecast of a failing source is
+// left out until it recovers.
+func (f *solarForecaster) update() error {
+	var points []forecastPoint
+	var errs []string
+	for _, source := range f.sources {
+		list, err := source.fetch()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source.name(), err))
+			continue
+		}
+		points = append(points, list...)
+	}
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Start.Before(points[j].Start) })
+	unique := points[:0]
+	for _, p := range points {
+		if len(unique) > 0 && !p.Start.After(unique[len(unique)-1].Start) {
+			continue
+		}
+		unique = append(unique, p)
+	}
+	if len(unique) > 0 {
+		f.mu.Lock()
+		f.points = unique
+		f.mu.Unlock()
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// surplus returns the lowest forecast surplus in W over [from, to), and false
+// when the forecast does not cover the whole period.
+func (f *solarForecaster) surplus(from time.Time, to time.Time) (float64, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	lowest := math.Inf(1)
+	covered := from
+	for _, p := range f.points {
+		if !p.End.After(covered) || !p.Start.Before(to) {
+			continue
+		}
+		if p.Start.After(covered) {
+			return 0, false
+		}
+		lowest = math.Min(lowest, p.Power-f.baseLoad)
+		covered = p.End
+		if !covered.Before(to) {
+			return lowest, true
+		}
+	}
+	return 0, false
+}
+
+// startDelay returns how long a measured surplus has to last before PV-only
+// charging starts, and whether starting is worth it at all. A forecast surplus
+// that lasts at least minRun shortens the delay, one that does not prevents
+// the start. The delay is the default without a forecast.
+func (f *solarForecaster) startDelay(now time.Time) (time.Duration, bool) {
+	if f == nil {
+		return pvTimerDefault, true
+	}
+	lowest, known := f.surplus(now, now.Add(f.minRun))
+	switch {
+	case !known:
+		return pvTimerDefault, true
+	case lowest >= f.minPower:
+		return pvTimerShort, true
+	}
+	return pvTimerDefault, false
+}
+
+// stopDelay returns how long a PV shortage at the minimum current lasts
+// before charging stops. A surplus forecast for the coming minRun means a
+// passing cloud, a forecast without surplus the end of the day.
+func (f *solarForecaster) stopDelay(now time.Time) time.Duration {
+	if f == nil {
+		return pvTimerDefault
+	}
+	lowest, known := f.surplus(now, now.Add(f.minRun))
+	switch {
+	case !known:
+		return pvTimerDefault
+	case lowest >= f.minPower:
+		return pvTimerLong
+	}
+	return pvTimerShort
+}
+
+// coverage estimates the energy in kWh solar can charge from now until the
+// end of the day, up to requested (0 is unlimited). Periods with a surplus
+// below the minimum charging power do not count. until is when the last
+// of it is charged.
+func (f *solarForecaster) coverage(now time.Time, requested float64) (float64, time.Time) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	endOfDay := startOfDay(now.In(time.Local)).AddDate(0, 0, 1)
+	energy := 0.0
+	var until time.Time
+	for _, p := range f.points {
+		start, end := p.Start, p.End
+		if start.Before(now) {
+			start = now
+		}
+		if end.After(endOfDay) {
+			end = endOfDay
+		}
+		surplus := p.Power - f.baseLoad
+		if !end.After(start) || surplus < f.minPower {
+			continue
+		}
+		if f.maxPower > 0 {
+			surplus = math.Min(surplus, f.maxPower)
+		}
+		kwh := surplus / 1000 * end.Sub(start).Hours()
+		if requested > 0 && energy+kwh >= requested {
+			return requested, start.Add(time.Duration((requested - energy) / kwh * float64(end.Sub(start))))
+		}
+		energy += kwh
+		until = end
+	}
+	return energy, until
+}
+
+// publish publishes the solar coverage of the requested charge.
+func (f *solarForecaster) publish(now time.Time) {
+	if f.sensor == "" {
+		return
+	}
+	requested := 0.0
+	if f.requestEntity != "" {
+		if state, ok := f.ha.readEntityState(f.requestEntity); ok {
+			requested = math.Max(0, parseFloat(state))
+		}
+	}
+	covered, until := f.coverage(now, requested)
+	_, worthwhile := f.startDelay(now)
+	attributes := map[string]interface{}{
+		"friendly_name":       "Solar charging forecast",
+		"unit_of_measurement": "kWh",
+		"surplus_lasts":       worthwhile,
+	}
+	if requested > 0 {
+		attributes["requested"] = requested
+		attributes["percent"] = math.Round(covered / requested * 100)
+	}
+	if !until.IsZero() {
+		attributes["until"] = until.Format(time.RFC3339)
+	}
+	if err := f.ha.publishState(f.sensor, fmt.Sprintf("%.1f", covered), attributes); err != nil {
+		log.Printf("FORECAST: could not publish %s: %v", f.sensor, err)
+	}
+}
+
+// run reads the forecast and publishes the coverage every forecastRefresh.
+func (f *solarForecaster) run(ctx context.Context) {
+	for {
+		if err := f.update(); err != nil {
+			log.Printf("FORECAST: %v", err)
+		}
+		f.publish(time.Now())
+		if !sleepContext(ctx, forecastRefresh) {
+			return
+		}
+	}
+}
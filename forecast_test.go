@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestForecaster forecasts 3kW, 5.5kW and 6kW from 10:00 on 2025-06-01,
+// for a 3-phase charger behind a 0.5kW base load.
+func newTestForecaster(t *testing.T) *solarForecaster {
+	f := &solarForecaster{
+		sources:  []forecastSource{&fileForecastSource{path: "testdata/forecast_solar.json"}},
+		baseLoad: 500,
+		minRun:   time.Hour,
+		minPower: 6 * 3 * 230,
+		maxPower: 16 * 3 * 230,
+	}
+	assert.NoError(t, f.update())
+	return f
+}
+
+func TestParseForecastAttributes(t *testing.T) {
+	// Solcast
+	points, err := parseForecastAttributes(map[string]interface{}{
+		"detailedForecast": []interface{}{
+			map[string]interface{}{"period_start": "2025-06-01T10:00:00+02:00", "pv_estimate": 2.5, "pv_estimate10": 1.0},
+			map[string]interface{}{"period_start": "2025-06-01T10:30:00+02:00", "pv_estimate": 3.0},
+		},
+		"detailedHourly": []interface{}{
+			map[string]interface{}{"period_start": "2025-06-01T10:00:00+02:00", "pv_estimate": 2.75},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, 2500.0, points[0].Power)
+	assert.Equal(t, 30*time.Minute, points[1].End.Sub(points[1].Start))
+
+	// Forecast.Solar
+	points, err = parseForecastAttributes(map[string]interface{}{
+		"watts": map[string]interface{}{"2025-06-01 11:00:00": 1200.0, "2025-06-01 10:00:00": 800.0},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, 800.0, points[0].Power)
+	assert.Equal(t, 10, points[0].Start.In(time.Local).Hour())
+
+	_, err = parseForecastAttributes(map[string]interface{}{"unit_of_measurement": "kWh"})
+	assert.Error(t, err)
+}
+
+func TestParseForecastSources(t *testing.T) {
+	sources, err := parseForecastSources("ha:sensor.solcast_pv_forecast_forecast_today, file:testdata/forecast_solar.json", &haService{})
+	assert.NoError(t, err)
+	assert.Len(t, sources, 2)
+	assert.Equal(t, "file:testdata/forecast_solar.json", sources[1].name())
+
+	_, err = parseForecastSources("solcast", &haService{})
+	assert.Error(t, err)
+}
+
+func TestSolarForecaster_Delays(t *testing.T) {
+	f := newTestForecaster(t)
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2025, 6, 1, hour, minute, 0, 0, time.FixedZone("CEST", 2*3600))
+	}
+
+	_, worthwhile := f.startDelay(at(10, 0))
+	assert.False(t, worthwhile, "2.5kW surplus does not cover the 4.1kW minimum")
+	delay, worthwhile := f.startDelay(at(11, 0))
+	assert.True(t, worthwhile)
+	assert.Equal(t, pvTimerShort, delay)
+	delay, worthwhile = f.startDelay(at(12, 30))
+	assert.True(t, worthwhile, "beyond the forecast")
+	assert.Equal(t, pvTimerDefault, delay)
+
+	assert.Equal(t, pvTimerLong, f.stopDelay(at(11, 0)), "a passing cloud")
+	assert.Equal(t, pvTimerShort, f.stopDelay(at(10, 0)))
+	assert.Equal(t, pvTimerDefault, f.stopDelay(at(9, 0)), "before the forecast")
+
+	var none *solarForecaster
+	delay, worthwhile = none.startDelay(at(11, 0))
+	assert.Equal(t, pvTimerDefault, delay)
+	assert.True(t, worthwhile)
+	assert.Equal(t, pvTimerDefault, none.stopDelay(at(11, 0)))
+}
+
+func TestSolarForecaster_Coverage(t *testing.T) {
+	f := newTestForecaster(t)
+	now := time.Date(2025, 6, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+
+	energy, until := f.coverage(now, 0)
+	assert.InDelta(t, 10.5, energy, 1e-9, "5kWh and 5.5kWh, the first hour is below the minimum")
+	assert.True(t, until.Equal(now.Add(3*time.Hour)))
+
+	energy, until = f.coverage(now, 7)
+	assert.Equal(t, 7.0, energy)
+	assert.WithinDuration(t, now.Add(2*time.Hour+1309*time.Second), until, time.Second)
+
+	energy, _ = f.coverage(now.Add(2*time.Hour+30*time.Minute), 0)
+	assert.InDelta(t, 2.75, energy, 1e-9)
+}
+
+func TestDawnConsumer_PVStartHeldByForecast(t *testing.T) {
+	f := &solarForecaster{baseLoad: 500, minRun: time.Hour, minPower: 6 * 3 * 230}
+	now := time.Now()
+	f.points = []forecastPoint{{Start: now.Add(-time.Hour), End: now.Add(2 * time.Hour), Power: 2000}}
+	service := &dawnConsumerService{
+		pvOnlyMode:         true,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		exports:            map[string]float64{"phase1": 7, "phase2": 7, "phase3": 7},
+		currents:           map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0},
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+		forecast:           f,
+	}
+
+	service.pvSurplusStartTime = time.Now().Add(-6 * time.Minute)
+	service.calculateAndSetAmps()
+	assert.False(t, service.isCharging, "the surplus is not forecast to last")
+
+	f.points[0].Power = 6000
+	service.pvSurplusStartTime = time.Now().Add(-3 * time.Minute)
+	service.calculateAndSetAmps()
+	assert.True(t, service.isCharging, "a forecast surplus shortens the timer")
+}
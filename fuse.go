@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fuseBackstopTripTime is the trip time below which the instantaneous
+// threshold still reduces at once with a trip curve configured. Longer trip
+// times are left to the thermal load, so a kettle or compressor start that
+// lasts minutes does not cut charging.
+const fuseBackstopTripTime = 30 * time.Second
+
+// tripPoint is one point on a fuse time-current characteristic: a current of
+// multiple × rating trips the fuse after seconds.
+type tripPoint struct {
+	multiple float64
+	seconds  float64
+}
+
+// fuseCurves are conservative (lower tolerance band) trip characteristics.
+// Below the first multiple the fuse never trips.
+var fuseCurves = map[string][]tripPoint{
+	// gG fuse link (IEC 60269), 16-63A
+	"gg": {{1.25, 3600}, {1.6, 1800}, {2, 120}, {3, 15}, {4, 4}, {6, 0.8}, {10, 0.1}},
+	// Type B MCB (IEC 60898), magnetic trip from 3x
+	"b": {{1.13, 3600}, {1.45, 600}, {2, 15}, {3, 0.01}},
+	// Type C MCB (IEC 60898), magnetic trip from 5x
+	"c": {{1.13, 3600}, {1.45, 600}, {2, 15}, {3, 4}, {4, 2}, {5, 0.01}},
+}
+
+// fuseModel tracks the thermal load of each phase fuse. A load of 1.0 means
+// the fuse is expected to trip. Overload heats the fuse by dt/tripTime and
+// the load decays exponentially while below the trip region.
+type fuseModel struct {
+	rating      float64
+	curve       []tripPoint
+	coolingTau  time.Duration
+	reduceLevel float64 // load at which the charger is reduced
+	stopLevel   float64 // load at which the charger is forced to minimum or stopped
+
+	load        map[int]float64
+	lastCurrent map[int]float64
+	lastUpdate  map[int]time.Time
+}
+
+func newFuseModel(curve string, rating float64, coolingTau time.Duration, reduceLevel float64, stopLevel float64) (*fuseModel, error) {
+	points, ok := fuseCurves[strings.ToLower(strings.TrimSpace(curve))]
+	if !ok {
+		names := make([]string, 0, len(fuseCurves))
+		for name := range fuseCurves {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown fuse curve %q (known: %s)", curve, strings.Join(names, ", "))
+	}
+	if rating <= 0 {
+		return nil, fmt.Errorf("fuse rating must be positive, got %.2f", rating)
+	}
+	if reduceLevel <= 0 || stopLevel <= reduceLevel || stopLevel > 1 {
+		return nil, fmt.Errorf("fuse levels must satisfy 0 < reduce (%.2f) < stop (%.2f) <= 1", reduceLevel, stopLevel)
+	}
+
+	return &fuseModel{
+		rating:      rating,
+		curve:       points,
+		coolingTau:  coolingTau,
+		reduceLevel: reduceLevel,
+		stopLevel:   stopLevel,
+		load:        make(map[int]float64),
+		lastCurrent: make(map[int]float64),
+		lastUpdate:  make(map[int]time.Time),
+	}, nil
+}
+
+// tripTime returns how many seconds the given current can be carried before
+// the fuse trips, interpolating the curve log-log. +Inf means never.
+func (f *fuseModel) tripTime(current float64) float64 {
+	m := current / f.rating
+	if m < f.curve[0].multiple {
+		return math.Inf(1)
+	}
+	for i := 1; i < len(f.curve); i++ {
+		lo, hi := f.curve[i-1], f.curve[i]
+		if m <= hi.multiple {
+			frac := (math.Log(m) - math.Log(lo.multiple)) / (math.Log(hi.multiple) - math.Log(lo.multiple))
+			return math.Exp(math.Log(lo.seconds) + frac*(math.Log(hi.seconds)-math.Log(lo.seconds)))
+		}
+	}
+	return f.curve[len(f.curve)-1].seconds
+}
+
+// advance applies the given current over dt to a load value.
+func (f *fuseModel) advance(load float64, current float64, dt float64) float64 {
+	if dt <= 0 {
+		return load
+	}
+	if t := f.tripTime(current); !math.IsInf(t, 1) {
+		return load + dt/t
+	}
+	if f.coolingTau <= 0 {
+		return 0
+	}
+	return load * math.Exp(-dt/f.coolingTau.Seconds())
+}
+
+// update records a new current sample for a phase. The previous sample is
+// assumed to have been flowing since it was reported.
+func (f *fuseModel) update(phase int, current float64, now time.Time) float64 {
+	if last, ok := f.lastUpdate[phase]; ok {
+		f.load[phase] = f.advance(f.load[phase], f.lastCurrent[phase], now.Sub(last).Seconds())
+	}
+	f.lastCurrent[phase] = current
+	f.lastUpdate[phase] = now
+	return f.load[phase]
+}
+
+// loadAt returns the thermal load of a phase at the given time, assuming the
+// last reported current is still flowing.
+func (f *fuseModel) loadAt(phase int, now time.Time) float64 {
+	last, ok := f.lastUpdate[phase]
+	if !ok {
+		return 0
+	}
+	return f.advance(f.load[phase], f.lastCurrent[phase], now.Sub(last).Seconds())
+}
+
+// maxLoad returns the highest thermal load among the given phases.
+func (f *fuseModel) maxLoad(phases []int, now time.Time) float64 {
+	max := 0.0
+	for _, phase := range phases {
+		if load := f.loadAt(phase, now); load > max {
+			max = load
+		}
+	}
+	return max
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFuse(t *testing.T) *fuseModel {
+	fuse, err := newFuseModel("C", 20, 300*time.Second, 0.2, 0.6)
+	assert.NoError(t, err)
+	return fuse
+}
+
+// simulate feeds a constant current for the given duration in 1s meter steps.
+func simulate(fuse *fuseModel, phase int, current float64, start time.Time, duration time.Duration) time.Time {
+	now := start
+	for elapsed := time.Duration(0); elapsed < duration; elapsed += time.Second {
+		fuse.update(phase, current, now)
+		now = now.Add(time.Second)
+	}
+	return now
+}
+
+func TestFuseModel_TripTime(t *testing.T) {
+	fuse := newTestFuse(t)
+
+	assert.True(t, math.IsInf(fuse.tripTime(20), 1), "Rated current never trips")
+	assert.True(t, math.IsInf(fuse.tripTime(22), 1), "Below 1.13x never trips")
+	assert.InDelta(t, 15.0, fuse.tripTime(40), 0.001)
+	assert.Greater(t, fuse.tripTime(35), fuse.tripTime(40), "Trip time falls with current")
+	assert.InDelta(t, 0.01, fuse.tripTime(200), 0.001, "Magnetic trip region")
+
+	_, err := newFuseModel("Z", 20, time.Minute, 0.2, 0.6)
+	assert.Error(t, err)
+	_, err = newFuseModel("gG", 20, time.Minute, 0.6, 0.2)
+	assert.Error(t, err)
+}
+
+func TestFuseModel_KettleSpikeIsTolerated(t *testing.T) {
+	fuse := newTestFuse(t)
+	start := time.Now()
+
+	// 15A household load, then a 30s kettle spike to 28A (1.4x).
+	now := simulate(fuse, 1, 15, start, time.Minute)
+	now = simulate(fuse, 1, 28, now, 30*time.Second)
+	assert.Less(t, fuse.loadAt(1, now), fuse.reduceLevel)
+
+	// A 0.3s heat-pump compressor inrush at 3x.
+	fuse.update(1, 60, now)
+	now = now.Add(300 * time.Millisecond)
+	fuse.update(1, 15, now)
+	assert.Less(t, fuse.loadAt(1, now), fuse.reduceLevel)
+}
+
+func TestFuseModel_SustainedOverloadIsCut(t *testing.T) {
+	fuse := newTestFuse(t)
+	start := time.Now()
+
+	// 40A (2x) on a C20 MCB trips in about 15s, so the stop level must be
+	// reached well before today's 10s emergency timer would have fired.
+	now := start
+	for fuse.loadAt(1, now) < fuse.stopLevel {
+		now = simulate(fuse, 1, 40, now, time.Second)
+		if now.Sub(start) > time.Minute {
+			t.Fatal("Sustained overload never reached the stop level")
+		}
+	}
+	assert.LessOrEqual(t, now.Sub(start), 10*time.Second)
+}
+
+func TestFuseModel_Cooling(t *testing.T) {
+	fuse := newTestFuse(t)
+	start := time.Now()
+
+	now := simulate(fuse, 1, 40, start, 5*time.Second)
+	heated := fuse.loadAt(1, now)
+	assert.Greater(t, heated, 0.0)
+
+	now = simulate(fuse, 1, 10, now, 5*time.Minute)
+	assert.Less(t, fuse.loadAt(1, now), heated*0.5, "Load should decay below the trip region")
+}
+
+func TestDawnConsumer_FuseProtection(t *testing.T) {
+	newService := func() *dawnConsumerService {
+		return &dawnConsumerService{
+			isCharging:         true,
+			currentAmps:        16.0,
+			actualAmps:         16.0,
+			minimumAmps:        6.0,
+			maximumAmps:        16.0,
+			setpoint:           20.0,
+			currents:           make(map[string]float64),
+			hasDirectionalData: make(map[string]bool),
+			exports:            make(map[string]float64),
+			haService:          &haService{},
+			fuse:               newTestFuse(t),
+			pid:                &PIDController{Setpoint: 20.0},
+		}
+	}
+
+	// A 28A spike that just started must not cut charging.
+	service := newService()
+	service.currents["phase1"] = 28.0
+	service.fuse.update(1, 28.0, time.Now().Add(-3*time.Second))
+	service.calculateAndSetAmps()
+	assert.Equal(t, 16.0, service.currentAmps, "Short spike should be ridden out")
+
+	// 30A sustained for a while heats the fuse past the reduce level.
+	service = newService()
+	service.currents["phase1"] = 30.0
+	service.fuse.update(1, 30.0, time.Now().Add(-90*time.Second))
+	service.calculateAndSetAmps()
+	assert.Equal(t, 6.0, service.currentAmps, "Reduce by ceil(30 - 20) = 10A")
+
+	// 40A for 10s is close to tripping: force minimum, then stop.
+	service = newService()
+	service.currents["phase1"] = 40.0
+	service.fuse.update(1, 40.0, time.Now().Add(-10*time.Second))
+	service.calculateAndSetAmps()
+	assert.Equal(t, 6.0, service.currentAmps)
+	assert.True(t, service.isCharging)
+
+	service.actualAmps = 6.0
+	service.calculateAndSetAmps()
+	assert.False(t, service.isCharging, "Should emergency stop when at minimum and near tripping")
+
+	// The instantaneous threshold stays a backstop for currents the fuse
+	// trips on within fuseBackstopTripTime: 45A (2.25x) trips a C20 in ~10s
+	service = newService()
+	service.currents["phase1"] = 45.0
+	service.fuse.update(1, 45.0, time.Now())
+	service.safetyCheck()
+	assert.Equal(t, 6.0, service.currentAmps, "Reduce by ceil(45 - 20) = 25A, to the minimum")
+}
+
+// simulateConsumer feeds the charger phase current to the consumer once a
+// second on a simulated clock and returns when charging was first reduced
+// or stopped, or zero.
+func simulateConsumer(service *dawnConsumerService, load func(second int) float64, duration time.Duration) time.Duration {
+	start := time.Now()
+	now := start
+	service.now = func() time.Time { return now }
+	for second := 0; time.Duration(second)*time.Second < duration; second++ {
+		now = start.Add(time.Duration(second) * time.Second)
+		amps := service.currentAmps
+		service.updateCurrents(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: load(second)})
+		if service.currentAmps < amps || !service.isCharging {
+			return now.Sub(start)
+		}
+	}
+	return 0
+}
+
+func TestDawnConsumer_FuseCurveSimulation(t *testing.T) {
+	newService := func(amps float64) *dawnConsumerService {
+		return &dawnConsumerService{
+			isCharging:         true,
+			currentAmps:        amps,
+			actualAmps:         amps,
+			minimumAmps:        6.0,
+			maximumAmps:        16.0,
+			setpoint:           20.0,
+			currents:           make(map[string]float64),
+			hasDirectionalData: make(map[string]bool),
+			exports:            make(map[string]float64),
+			haService:          &haService{},
+			fuse:               newTestFuse(t),
+			pid:                &PIDController{Setpoint: 20.0},
+			phases:             []int{1},
+			chargerPhases:      []int{1},
+		}
+	}
+
+	// 16A charging on a 4A base load, then a 45s kettle adding 10A: 30A is
+	// over the threshold but carried by the fuse for minutes
+	kettle := func(second int) float64 {
+		if second >= 60 && second < 105 {
+			return 30
+		}
+		return 20
+	}
+	service := newService(16)
+	assert.Zero(t, simulateConsumer(service, kettle, 5*time.Minute), "the kettle must not reduce charging")
+	assert.Equal(t, 16.0, service.currentAmps)
+	assert.True(t, service.isCharging)
+
+	// The same kettle without a curve is reduced at once
+	service = newService(16)
+	service.fuse = nil
+	assert.Equal(t, 60*time.Second, simulateConsumer(service, kettle, 5*time.Minute))
+
+	// A sustained 45A overload at the minimum current stops charging before
+	// the 10s timer without a curve would
+	overload := func(int) float64 { return 45 }
+	service = newService(6)
+	withCurve := simulateConsumer(service, overload, time.Minute)
+	assert.False(t, service.isCharging)
+	service = newService(6)
+	service.fuse = nil
+	withoutCurve := simulateConsumer(service, overload, time.Minute)
+	assert.False(t, service.isCharging)
+	assert.Greater(t, withCurve, time.Duration(0))
+	assert.Less(t, withCurve, withoutCurve)
+	assert.Less(t, withCurve, 10*time.Second)
+}
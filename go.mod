@@ -9,6 +9,7 @@ require (
 	github.com/stretchr/testify v1.11.1
 	github.com/tuomaz/gohaws v0.0.0-20260215094358-74956dd4016d
 	github.com/tuomaz/nordpool v0.0.0-20230911180659-0d2f7d98b006
+	nhooyr.io/websocket v1.8.17
 )
 
 require (
@@ -20,5 +21,4 @@ require (
 	go.uber.org/atomic v1.11.0 // indirect
 	golang.org/x/net v0.50.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
-	nhooyr.io/websocket v1.8.17 // indirect
 )
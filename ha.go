@@ -1,9 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tuomaz/gohaws"
@@ -16,6 +22,7 @@ func newHaService(ctx context.Context, uri string, token string, notifyDevice st
 		context:      ctx,
 		notifyDevice: notifyDevice,
 	}
+	ha.commands = newCommandVerifier(ha.callEntityService, ha.readEntityState)
 	go ha.manageConnection()
 	return ha
 }
@@ -28,6 +35,17 @@ type haService struct {
 	notifyDevice    string
 	startupNotified bool
 	subscriptions   []*subscription
+	commands        *commandVerifier // nil sends commands unverified
+	notifier        *notifier        // nil notifies notifyDevice directly
+	linkDown        bool
+	requestMu       sync.Mutex // one HA request at a time, see callService
+
+	mu              sync.Mutex
+	mqtt            *mqttClient
+	mqttDiscovery   bool
+	discoveryPrefix string
+	baseTopic       string
+	discovered      map[string]bool
 }
 
 type subscription struct {
@@ -51,9 +69,13 @@ func (ha *haService) manageConnection() {
 			ha.client = client
 
 			if !ha.startupNotified && ha.notifyDevice != "" {
-				ha.sendNotification("Electricity Management Service started and connected", ha.notifyDevice)
+				ha.notify(NotifyStartup, SeverityInfo, "Electricity Management Service started and connected")
 				ha.startupNotified = true
 			}
+			if ha.linkDown {
+				ha.linkDown = false
+				ha.notify(NotifyHaLink, SeverityInfo, "Connection to Home Assistant restored.")
+			}
 
 			// Re-subscribe existing entities
 			for _, sub := range ha.subscriptions {
@@ -65,7 +87,10 @@ func (ha *haService) manageConnection() {
 
 			// Fetch current states so we are aware of reality immediately
 			log.Printf("HA service: fetching current states")
-			if err := ha.client.FetchStates(ha.context); err != nil {
+			ha.requestMu.Lock()
+			err = ha.client.FetchStates(ha.context)
+			ha.requestMu.Unlock()
+			if err != nil {
 				log.Printf("HA service: warning: could not fetch initial states: %v", err)
 			} else {
 				ha.injectCurrentStates()
@@ -75,6 +100,10 @@ func (ha *haService) manageConnection() {
 			ha.run()
 
 			log.Printf("HA service: connection lost, retrying in 5 seconds...")
+			if !ha.linkDown {
+				ha.linkDown = true
+				ha.notify(NotifyHaLink, SeverityWarning, "Connection to Home Assistant lost. Fuse protection continues on direct meter inputs only.")
+			}
 			time.Sleep(5 * time.Second)
 		}
 	}
@@ -110,6 +139,15 @@ func (ha *haService) subscribe(entity string, channel chan *gohaws.Message) {
 
 func (ha *haService) subscribeMulti(entities []string, channel chan *gohaws.Message) {
 	for _, entity := range entities {
+		if binding, ok := parseMqttEntity(entity); ok {
+			if ha.mqtt == nil {
+				log.Printf("HA service: %s needs MQTT_BROKER to be configured", entity)
+				continue
+			}
+			ha.subscribeMqtt(entity, binding, channel)
+			continue
+		}
+
 		found := false
 		for _, sub := range ha.subscriptions {
 			if sub.channel == channel {
@@ -134,30 +172,125 @@ func (ha *haService) subscribeMulti(entities []string, channel chan *gohaws.Mess
 	}
 }
 
-func (ha *haService) updateAmpsDawn(amps int, dawnID string) {
+// callEntityService calls a service on an entity over the transport it is
+// bound to.
+func (ha *haService) callEntityService(domain string, service string, data map[string]string, entity string) error {
+	if binding, ok := parseMqttEntity(entity); ok {
+		return ha.mqttCommand(binding, service, data)
+	}
 	if ha.client == nil {
+		return errors.New("HA: not connected")
+	}
+	return ha.callService(domain, service, data, entity)
+}
+
+// callService calls an HA service. gohaws takes the next message on a
+// channel shared by all requests as the reply, without matching its ID, so
+// concurrent requests could get each other's results. Requests are made one
+// at a time.
+func (ha *haService) callService(domain string, service string, data interface{}, target string) error {
+	ha.requestMu.Lock()
+	defer ha.requestMu.Unlock()
+	return ha.client.CallService(ha.context, domain, service, data, target)
+}
+
+// readEntityState returns the last known state of an HA entity. MQTT bound
+// entities have no state to read back.
+func (ha *haService) readEntityState(entity string) (string, bool) {
+	if _, ok := parseMqttEntity(entity); ok || ha.client == nil {
+		return "", false
+	}
+	state, ok := ha.client.GetState(entity)
+	if !ok || state == nil {
+		return "", false
+	}
+	return fmt.Sprintf("%v", state.State), true
+}
+
+// sendCommand delivers a command, verified and retried when a verifier is
+// set up. MQTT bound entities have no state to verify against.
+func (ha *haService) sendCommand(domain string, service string, data map[string]string, entity string, expected string) {
+	if _, ok := parseMqttEntity(entity); ok {
+		expected = ""
+	}
+	if ha.commands == nil {
+		if err := ha.callEntityService(domain, service, data, entity); err != nil {
+			log.Printf("HA service: %s %s on %s failed: %v", domain, service, entity, err)
+		}
 		return
 	}
+	ha.commands.send(ha.context, domain, service, data, entity, expected)
+}
+
+// onCommandResult registers a listener for the final outcome of commands.
+func (ha *haService) onCommandResult(listener func(entity string, err error)) {
+	if ha.commands != nil {
+		ha.commands.onResult(listener)
+	}
+}
+
+func (ha *haService) updateAmpsDawn(amps int, dawnID string) {
 	if amps < 6 {
 		amps = 6
 	}
 	if amps > 16 {
 		amps = 16
 	}
-	data := map[string]string{"value": fmt.Sprintf("%d", amps)}
-	ha.client.CallService(ha.context, "number", "set_value", data, dawnID)
+	value := fmt.Sprintf("%d", amps)
+	ha.sendCommand("number", "set_value", map[string]string{"value": value}, dawnID, value)
 }
 
 func (ha *haService) setDawnSwitch(on bool, switchID string) {
-	if ha.client == nil {
-		return
-	}
-	service := "turn_off"
+	service, expected := "turn_off", "off"
 	if on {
-		service = "turn_on"
+		service, expected = "turn_on", "on"
 	}
 	log.Printf("HA service: setting Dawn switch %s to %v", switchID, on)
-	ha.client.CallService(ha.context, "switch", service, nil, switchID)
+	ha.sendCommand("switch", service, nil, switchID, expected)
+}
+
+// setLoadSwitch turns a switchable load on or off through its own domain
+// (switch, input_boolean, light, ...).
+func (ha *haService) setLoadSwitch(entity string, on bool) {
+	domain, _, ok := strings.Cut(entity, ".")
+	if !ok || strings.HasPrefix(entity, mqttEntityPrefix) {
+		domain = "switch"
+	}
+	service, expected := "turn_off", "off"
+	if on {
+		service, expected = "turn_on", "on"
+	}
+	log.Printf("HA service: setting load %s to %v", entity, on)
+	ha.sendCommand(domain, service, nil, entity, expected)
+}
+
+// notify sends a notification through the notifier, or straight to the
+// notify device when none is set up.
+func (ha *haService) notify(kind NotificationType, severity NotificationSeverity, message string, actions ...notificationAction) {
+	ha.mu.Lock()
+	n := ha.notifier
+	ha.mu.Unlock()
+	if n != nil {
+		n.notify(kind, severity, message, actions...)
+		return
+	}
+	ha.sendNotification(message, ha.notifyDevice)
+}
+
+func (ha *haService) setNotifier(n *notifier) {
+	ha.mu.Lock()
+	defer ha.mu.Unlock()
+	ha.notifier = n
+}
+
+// onNotificationAction registers the handler for a notification action.
+func (ha *haService) onNotificationAction(action string, handler func()) {
+	ha.mu.Lock()
+	n := ha.notifier
+	ha.mu.Unlock()
+	if n != nil {
+		n.onAction(action, handler)
+	}
 }
 
 func (ha *haService) sendNotification(message string, device string) {
@@ -165,12 +298,16 @@ func (ha *haService) sendNotification(message string, device string) {
 		return
 	}
 	sd := map[string]string{"title": "Electricity", "message": message}
-	ha.client.CallService(ha.context, "notify", device, sd, "")
+	if err := ha.callService("notify", device, sd, ""); err != nil {
+		log.Printf("HA service: notify %s failed: %v", device, err)
+	}
 }
 
 func (ha *haService) run() {
 	log.Printf("HA service: start listening to message from HA")
+	ha.requestMu.Lock()
 	err := ha.client.SubscribeToUpdates(ha.context)
+	ha.requestMu.Unlock()
 	if err != nil {
 		log.Printf("HA service: failed to subscribe: %v", err)
 		return
@@ -206,3 +343,60 @@ func (ha *haService) sendEventToSubscribers(message *gohaws.Message) {
 		}
 	}
 }
+
+// publishState creates or updates an entity in HA through the REST API. HA
+// owns no integration for these entities, so they are recreated after an HA
+// restart on the next publish.
+func (ha *haService) publishState(entityID string, state string, attributes map[string]interface{}) error {
+	if ha.mqtt != nil && ha.mqttDiscovery {
+		return ha.publishMqttState(entityID, state, attributes)
+	}
+	if ha.uri == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"state":      state,
+		"attributes": attributes,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := ha.context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ha.restURL()+"/api/states/"+entityID, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+ha.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return errors.New("HA: could not publish state for " + entityID + ": " + resp.Status)
+	}
+	return nil
+}
+
+// restURL turns the WebSocket base URI into the matching HTTP base URL.
+func (ha *haService) restURL() string {
+	uri := strings.TrimSuffix(ha.uri, "/")
+	uri = strings.TrimSuffix(uri, "/api/websocket")
+	if strings.HasPrefix(uri, "wss://") {
+		return "https://" + strings.TrimPrefix(uri, "wss://")
+	}
+	if strings.HasPrefix(uri, "ws://") {
+		return "http://" + strings.TrimPrefix(uri, "ws://")
+	}
+	return uri
+}
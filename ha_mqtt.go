@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tuomaz/gohaws"
+)
+
+// Entities prefixed with mqttEntityPrefix are bound to MQTT instead of HA:
+//
+//	mqtt:<topic>[|<json.field.path>[|<unit>]]
+//
+// For sensors the topic is the state topic, for actuators the command topic.
+const mqttEntityPrefix = "mqtt:"
+
+type mqttBinding struct {
+	topic string
+	field string
+	unit  string
+}
+
+func parseMqttEntity(entity string) (mqttBinding, bool) {
+	if !strings.HasPrefix(entity, mqttEntityPrefix) {
+		return mqttBinding{}, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(entity, mqttEntityPrefix), "|", 3)
+	binding := mqttBinding{topic: parts[0]}
+	if len(parts) > 1 {
+		binding.field = parts[1]
+	}
+	if len(parts) > 2 {
+		binding.unit = parts[2]
+	}
+	return binding, true
+}
+
+// value extracts the bound value from a payload. Without a field the whole
+// payload is the value; with one the payload is JSON and the dot separated
+// path is followed (Zigbee2MQTT, Tasmota).
+func (b mqttBinding) value(payload []byte) (interface{}, error) {
+	if b.field == "" {
+		return strings.TrimSpace(string(payload)), nil
+	}
+	var current interface{}
+	if err := json.Unmarshal(payload, &current); err != nil {
+		return nil, err
+	}
+	for _, key := range strings.Split(b.field, ".") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("no field %q in payload", b.field)
+		}
+		if current, ok = object[key]; !ok {
+			return nil, fmt.Errorf("no field %q in payload", b.field)
+		}
+	}
+	return current, nil
+}
+
+// setMqtt enables the MQTT transport. It must be called before services
+// subscribe. With discovery enabled, published states go to MQTT with HA
+// discovery configs instead of the REST API.
+func (ha *haService) setMqtt(client *mqttClient, discoveryPrefix string, baseTopic string, discovery bool) {
+	ha.mqtt = client
+	ha.discoveryPrefix = discoveryPrefix
+	ha.baseTopic = baseTopic
+	ha.mqttDiscovery = discovery
+	ha.discovered = make(map[string]bool)
+}
+
+// subscribeMqtt delivers messages on an MQTT bound entity to the channel in
+// the same shape as HA state changes.
+func (ha *haService) subscribeMqtt(entity string, binding mqttBinding, channel chan *gohaws.Message) {
+	ha.mqtt.subscribe(binding.topic, func(topic string, payload []byte) {
+		value, err := binding.value(payload)
+		if err != nil {
+			return
+		}
+		msg := &gohaws.Message{
+			Event: &gohaws.Event{
+				Data: &gohaws.Data{
+					EntityID: entity,
+					NewState: &gohaws.State{
+						EntityID:          entity,
+						State:             value,
+						UnitOfMeasurement: binding.unit,
+					},
+				},
+			},
+		}
+		select {
+		case channel <- msg:
+		default:
+		}
+	})
+}
+
+// mqttCommand publishes a service call for an MQTT bound actuator.
+func (ha *haService) mqttCommand(binding mqttBinding, service string, data map[string]string) error {
+	if ha.mqtt == nil {
+		return errors.New("MQTT: no broker configured")
+	}
+
+	var value string
+	switch service {
+	case "turn_on":
+		value = "ON"
+	case "turn_off":
+		value = "OFF"
+	case "set_value":
+		value = data["value"]
+	default:
+		return fmt.Errorf("MQTT: unsupported service %s", service)
+	}
+
+	payload := []byte(value)
+	if binding.field != "" {
+		var err error
+		if payload, err = json.Marshal(map[string]string{binding.field: value}); err != nil {
+			return err
+		}
+	}
+	return ha.mqtt.publish(binding.topic, payload, false)
+}
+
+// publishMqttState publishes an entity state and attributes, announcing the
+// entity through HA MQTT discovery the first time.
+func (ha *haService) publishMqttState(entityID string, state string, attributes map[string]interface{}) error {
+	domain, objectID, ok := strings.Cut(entityID, ".")
+	if !ok {
+		return fmt.Errorf("MQTT: invalid entity id %s", entityID)
+	}
+	stateTopic := fmt.Sprintf("%s/%s/state", ha.baseTopic, objectID)
+	attributesTopic := fmt.Sprintf("%s/%s/attributes", ha.baseTopic, objectID)
+
+	ha.mu.Lock()
+	announced := ha.discovered[entityID]
+	ha.discovered[entityID] = true
+	ha.mu.Unlock()
+
+	if !announced {
+		config := map[string]interface{}{
+			"name":                  attributes["friendly_name"],
+			"object_id":             objectID,
+			"unique_id":             "electricity_" + objectID,
+			"state_topic":           stateTopic,
+			"json_attributes_topic": attributesTopic,
+			"device": map[string]interface{}{
+				"identifiers": []string{ha.baseTopic},
+				"name":        "Electricity",
+			},
+		}
+		if config["name"] == nil {
+			config["name"] = objectID
+		}
+		for _, key := range []string{"unit_of_measurement", "device_class", "state_class"} {
+			if value, ok := attributes[key]; ok {
+				config[key] = value
+			}
+		}
+		if domain == "binary_sensor" {
+			config["payload_on"] = "on"
+			config["payload_off"] = "off"
+		}
+		payload, err := json.Marshal(config)
+		if err != nil {
+			return err
+		}
+		if err := ha.mqtt.publish(fmt.Sprintf("%s/%s/%s/config", ha.discoveryPrefix, domain, objectID), payload, true); err != nil {
+			ha.mu.Lock()
+			delete(ha.discovered, entityID)
+			ha.mu.Unlock()
+			return err
+		}
+	}
+
+	payload, err := json.Marshal(attributes)
+	if err != nil {
+		return err
+	}
+	if err := ha.mqtt.publish(attributesTopic, payload, true); err != nil {
+		return err
+	}
+	return ha.mqtt.publish(stateTopic, []byte(state), true)
+}
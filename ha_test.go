@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuomaz/gohaws"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestHaService_RestURL(t *testing.T) {
+	assert.Equal(t, "http://ha.local:8123", (&haService{uri: "ws://ha.local:8123"}).restURL())
+	assert.Equal(t, "https://ha.example.com", (&haService{uri: "wss://ha.example.com/api/websocket"}).restURL())
+}
+
+func TestHaService_PublishState(t *testing.T) {
+	var path, auth string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("Authorization")
+		json.NewDecoder(r.Body).Decode(&body)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	ha := &haService{uri: server.URL, token: "secret", context: context.Background()}
+	err := ha.publishState("sensor.test", "1.25", map[string]interface{}{"unit_of_measurement": "A"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "/api/states/sensor.test", path)
+	assert.Equal(t, "Bearer secret", auth)
+	assert.Equal(t, "1.25", body["state"])
+}
+
+func TestHaService_ConcurrentCallsGetTheirOwnResult(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A fake HA that answers failing calls at once and the others later, so
+	// replies to overlapping requests would arrive out of order
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close(websocket.StatusNormalClosure, "")
+		wsjson.Write(ctx, c, gohaws.Message{Type: "auth_required"})
+		var auth gohaws.Message
+		wsjson.Read(ctx, c, &auth)
+		wsjson.Write(ctx, c, gohaws.Message{Type: "auth_ok"})
+		for {
+			var request gohaws.Message
+			if err := wsjson.Read(ctx, c, &request); err != nil {
+				return
+			}
+			go func(request gohaws.Message) {
+				if request.Domain != "fail" {
+					time.Sleep(5 * time.Millisecond)
+				}
+				wsjson.Write(ctx, c, gohaws.Message{ID: request.ID, Type: "result", Success: request.Domain != "fail"})
+			}(request)
+		}
+	}))
+	defer server.Close()
+
+	client, err := gohaws.New(ctx, strings.Replace(server.URL, "http", "ws", 1), "token")
+	assert.NoError(t, err)
+	ha := &haService{context: ctx, client: client}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			domain := "switch"
+			if i%2 == 0 {
+				domain = "fail"
+			}
+			err := ha.callEntityService(domain, "turn_on", nil, fmt.Sprintf("switch.load_%d", i))
+			assert.Equal(t, domain == "fail", err != nil, "call %d", i)
+		}(i)
+	}
+	wg.Wait()
+}
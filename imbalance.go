@@ -0,0 +1,33 @@
+package main
+
+import "math"
+
+// phaseImbalance returns the spread between the most and least loaded phase.
+// Currents are signed: import positive, export negative.
+func phaseImbalance(currents []float64) float64 {
+	if len(currents) < 2 {
+		return 0
+	}
+	min, max := currents[0], currents[0]
+	for _, c := range currents[1:] {
+		min = math.Min(min, c)
+		max = math.Max(max, c)
+	}
+	return max - min
+}
+
+// neutralCurrent estimates the neutral current from the phase currents,
+// assuming unity power factor. Three-phase currents are 120° apart and
+// split-phase legs 180° apart. A single phase returns its own current.
+func neutralCurrent(currents []float64) float64 {
+	switch len(currents) {
+	case 1:
+		return math.Abs(currents[0])
+	case 2:
+		return math.Abs(currents[0] - currents[1])
+	case 3:
+		a, b, c := currents[0], currents[1], currents[2]
+		return math.Sqrt(math.Max(0, a*a+b*b+c*c-a*b-b*c-c*a))
+	}
+	return 0
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhaseImbalance(t *testing.T) {
+	assert.Equal(t, 0.0, phaseImbalance([]float64{10}))
+	assert.Equal(t, 12.0, phaseImbalance([]float64{14, 2, 5}))
+	assert.Equal(t, 15.0, phaseImbalance([]float64{10, -5, 0}), "Export counts as negative current")
+}
+
+func TestNeutralCurrent(t *testing.T) {
+	assert.InDelta(t, 0.0, neutralCurrent([]float64{10, 10, 10}), 0.001, "Balanced load has no neutral current")
+	assert.InDelta(t, 10.0, neutralCurrent([]float64{10, 0, 0}), 0.001)
+	assert.InDelta(t, 8.66, neutralCurrent([]float64{10, 5, 0}), 0.01)
+	assert.InDelta(t, 4.0, neutralCurrent([]float64{12, 8}), 0.001, "Split-phase legs cancel")
+}
+
+func TestDawnConsumer_ImbalanceLimit(t *testing.T) {
+	service := &dawnConsumerService{
+		isCharging:         true,
+		currentAmps:        16.0,
+		actualAmps:         16.0,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           25.0,
+		activePhases:       []int{1},
+		currents:           map[string]float64{"phase1": 20.0, "phase2": 4.0, "phase3": 2.0},
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		imbalance:          imbalanceConfig{limit: 16.0},
+		pid:                &PIDController{Setpoint: 25.0},
+	}
+
+	// Spread is 18A against a 16A limit, on the car's phase.
+	service.calculateAndSetAmps()
+	assert.Equal(t, 14.0, service.currentAmps)
+	assert.Equal(t, 18.0, metrics.gauge("electricity_phase_imbalance_amps"))
+
+	// With a phase switch configured, spreading the load is tried first.
+	service.currentAmps = 16.0
+	service.lastImbalanceEvent = service.lastImbalanceEvent.AddDate(-1, 0, 0)
+	service.imbalance.phaseSwitchId = "switch.dawn_three_phase"
+	service.calculateAndSetAmps()
+	assert.Equal(t, 16.0, service.currentAmps)
+	assert.True(t, service.phaseSwitchTried)
+	assert.Nil(t, service.activePhases, "Phase usage must be detected again after switching")
+
+	// A car drawing on all phases cannot change the spread.
+	service.activePhases = nil
+	service.lastImbalanceEvent = service.lastImbalanceEvent.AddDate(-1, 0, 0)
+	assert.False(t, service.imbalanceProtectionInternal(18.0, 17.0))
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := newMetricsRegistry()
+	registry.setGauge("test_gauge", 1.5)
+	registry.addCounter("test_total", 2)
+	registry.addCounter("test_total", 3)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Contains(t, recorder.Body.String(), "test_gauge 1.5\n")
+	assert.Contains(t, recorder.Body.String(), "test_total 5\n")
+}
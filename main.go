@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -21,6 +23,13 @@ func signalHandler(cancel context.CancelFunc, sigs chan os.Signal) {
 const MAX_PHASE_CURRENT = 20
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "autotune" {
+		if err := runAutotune(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("autotune: %v", err)
+		}
+		return
+	}
+
 	log.Print("Starting up alpha version 1")
 	baseCtx := context.Background()
 	ctx, cancel := context.WithCancel(baseCtx)
@@ -31,30 +40,301 @@ func main() {
 
 	haUri, haToken, area, dawn, dawnSwitch, notifyDevice, dawnCurrent, pvOnlySwitchId, dawnUserLimit, phase1, phase2, phase3, export1, export2, export3, voltage1, voltage2, voltage3, import1, import2, import3 := readEnv()
 
+	accounting, err := parseExportAccounting(getEnvOrDefault("PV_ACCOUNTING", "summed"))
+	if err != nil {
+		log.Fatalf("invalid PV_ACCOUNTING: %v", err)
+	}
+	importWeight := getEnvFloat("PV_IMPORT_WEIGHT", 2.0)
+
+	topology, err := parsePhaseTopology(getEnvOrDefault("PHASE_TOPOLOGY", "3phase"))
+	if err != nil {
+		log.Fatalf("invalid PHASE_TOPOLOGY: %v", err)
+	}
+	chargerPhases, err := parseChargerPhases(getEnvOrDefault("CHARGER_PHASES", ""), topology)
+	if err != nil {
+		log.Fatalf("invalid CHARGER_PHASES: %v", err)
+	}
+	rotationSpec := getEnvOrDefault("CHARGER_PHASE_ROTATION", "")
+	rotation, err := parsePhaseRotation(rotationSpec, topology)
+	if err != nil {
+		log.Fatalf("invalid CHARGER_PHASE_ROTATION: %v", err)
+	}
+	chargerPhases = mapChargerPhases(rotation, chargerPhases)
+	log.Printf("Phase topology: %s, charger terminals L1.. wired to phases %v", topology, chargerPhases)
+
+	var fuse *fuseModel
+	if curve := getEnvOrDefault("FUSE_CURVE", ""); curve != "" {
+		fuse, err = newFuseModel(curve,
+			getEnvFloat("FUSE_RATING", MAX_PHASE_CURRENT),
+			time.Duration(getEnvFloat("FUSE_COOLING_TIME", 300))*time.Second,
+			getEnvFloat("FUSE_REDUCE_LEVEL", 0.2),
+			getEnvFloat("FUSE_STOP_LEVEL", 0.6))
+		if err != nil {
+			log.Fatalf("invalid fuse configuration: %v", err)
+		}
+		log.Printf("Fuse protection: %s curve, %.0fA rating", curve, fuse.rating)
+	}
+
+	imbalance := imbalanceConfig{
+		limit:         getEnvFloat("IMBALANCE_LIMIT", 0),
+		neutralLimit:  getEnvFloat("NEUTRAL_LIMIT", 0),
+		phaseSwitchId: getEnvOrDefault("CHARGER_PHASE_SWITCH", ""),
+		sensorId:      getEnvOrDefault("IMBALANCE_SENSOR", "sensor.electricity_phase_imbalance"),
+	}
+
+	modbus := modbusSource{
+		meterAddress:    getEnvOrDefault("MODBUS_METER_ADDRESS", ""),
+		meterType:       strings.ToLower(getEnvOrDefault("MODBUS_METER_TYPE", "sdm630")),
+		meterUnit:       byte(getEnvFloat("MODBUS_METER_UNIT", 1)),
+		inverterAddress: getEnvOrDefault("MODBUS_INVERTER_ADDRESS", ""),
+		inverterUnit:    byte(getEnvFloat("MODBUS_INVERTER_UNIT", 1)),
+		interval:        time.Duration(getEnvFloat("MODBUS_POLL_INTERVAL", 1) * float64(time.Second)),
+	}
+	if _, ok := meterMaps[modbus.meterType]; modbus.meterAddress != "" && !ok {
+		log.Fatalf("unknown MODBUS_METER_TYPE %q", modbus.meterType)
+	}
+	if modbus.interval <= 0 {
+		log.Fatalf("invalid MODBUS_POLL_INTERVAL: must be positive")
+	}
+
+	statusMap, err := newConnectorStatusMap(getEnvOrDefault("CHARGER_STATUS_PRESET", "dawn"), getEnvOrDefault("CHARGER_STATUS_MAP", ""))
+	if err != nil {
+		log.Fatalf("invalid charger status mapping: %v", err)
+	}
+
 	events := make(chan *event)
 
 	haService := newHaService(ctx, haUri, haToken, notifyDevice)
-	_ = newPowerService(ctx, events, haService,
-		phase1, phase2, phase3,
-		export1, export2, export3,
-		import1, import2, import3,
-		voltage1, voltage2, voltage3,
-		MAX_PHASE_CURRENT)
-	priceService := newPriceService(area)
-	dawnService := newDawnConsumerService(ctx, events, haService, "sensor.dawn_status_connector", dawn, dawnSwitch, notifyDevice, dawnCurrent, MAX_PHASE_CURRENT, pvOnlySwitchId, dawnUserLimit)
-
-	// TODO: move this inside service
-	s := gocron.NewScheduler(time.UTC)
-	job, err := s.Every(30).Minutes().Do(func() {
-		updated, _ := priceService.updatePrices()
-		if updated {
-			log.Printf("Prices updated!")
+	notifier := newNotifierFromEnv(haService, notifyDevice)
+	haService.setNotifier(notifier)
+	if broker := getEnvOrDefault("MQTT_BROKER", ""); broker != "" {
+		client := newMqttClient(ctx, broker,
+			getEnvOrDefault("MQTT_CLIENT_ID", "electricity"),
+			getEnvOrDefault("MQTT_USERNAME", ""),
+			getEnvOrDefault("MQTT_PASSWORD", ""))
+		haService.setMqtt(client,
+			getEnvOrDefault("MQTT_DISCOVERY_PREFIX", "homeassistant"),
+			getEnvOrDefault("MQTT_BASE_TOPIC", "electricity"),
+			getEnvOrDefault("MQTT_DISCOVERY", "true") == "true")
+		log.Printf("MQTT: using broker %s", broker)
+	}
+	_ = newPowerService(ctx, events, haService, []phaseSensors{
+		{current: phase1, export: export1, import_: import1, voltage: voltage1, powerFactor: getEnvOrDefault("PHASE_1_POWER_FACTOR", "")},
+		{current: phase2, export: export2, import_: import2, voltage: voltage2, powerFactor: getEnvOrDefault("PHASE_2_POWER_FACTOR", "")},
+		{current: phase3, export: export3, import_: import3, voltage: voltage3, powerFactor: getEnvOrDefault("PHASE_3_POWER_FACTOR", "")},
+	}, topology, MAX_PHASE_CURRENT, p1Source{
+		device:  getEnvOrDefault("P1_DEVICE", ""),
+		address: getEnvOrDefault("P1_ADDRESS", ""),
+	}, modbus)
+	actuator := newChargerActuator(haService, time.Duration(getEnvFloat("CHARGER_MIN_COMMAND_INTERVAL", 0)*float64(time.Second)))
+	priceSources, err := parsePriceSources(getEnvOrDefault("PRICE_SOURCES", "nordpool"), haService,
+		getEnvOrDefault("ENTSOE_TOKEN", ""), getEnvFloat("ENTSOE_EXCHANGE_RATE", 1))
+	if err != nil {
+		log.Fatalf("invalid PRICE_SOURCES: %v", err)
+	}
+	priceService := newPriceService(area, priceSources...)
+	pricing := newTariffFromEnv(priceService)
+	cheapLevel, err := parsePriceLevel(getEnvOrDefault("PRICE_CHEAP_LEVEL", "cheap"))
+	if err != nil {
+		log.Fatalf("invalid PRICE_CHEAP_LEVEL: %v", err)
+	}
+	publisher := &pricePublisher{
+		prices:        priceService,
+		pricer:        &tariff{spot: priceService},
+		ha:            haService,
+		prefix:        getEnvOrDefault("PRICE_SENSOR_PREFIX", "electricity_price"),
+		unit:          getEnvOrDefault("PRICE_UNIT", "SEK/kWh"),
+		window:        time.Duration(getEnvFloat("PRICE_CHEAPEST_WINDOW", 3) * float64(time.Hour)).Round(15 * time.Minute),
+		averageWindow: time.Duration(getEnvFloat("PRICE_AVERAGE_DAYS", 3) * 24 * float64(time.Hour)),
+		cheapLevel:    cheapLevel,
+	}
+	if getEnvOrDefault("PRICE_INCLUDE_TARIFF", "false") == "true" {
+		publisher.pricer = pricing
+	}
+	if publisher.window <= 0 {
+		log.Fatalf("invalid PRICE_CHEAPEST_WINDOW: must be at least 15 minutes")
+	}
+	var override *priceOverride
+	if getEnvOrDefault("PRICE_OVERRIDE_BELOW", "") != "" {
+		peakPeriods, err := parsePeakPeriods(getEnvOrDefault("PEAK_LIMIT_PERIODS", ""))
+		if err != nil {
+			log.Fatalf("invalid PEAK_LIMIT_PERIODS: %v", err)
+		}
+		var price energyPricer = &tariff{spot: priceService}
+		if getEnvOrDefault("PRICE_OVERRIDE_INCLUDE_TARIFF", "false") == "true" {
+			price = pricing
+		}
+		override = &priceOverride{
+			price:       price.importPrice,
+			below:       getEnvFloat("PRICE_OVERRIDE_BELOW", 0),
+			peakLimit:   getEnvFloat("PEAK_LIMIT_KW", 0) * 1000,
+			peakPeriods: peakPeriods,
+			voltage:     topology.nominalVoltage(),
+		}
+		for _, entity := range strings.Split(getEnvOrDefault("PRICE_OVERRIDE_SWITCHES", ""), ",") {
+			if entity = strings.TrimSpace(entity); entity != "" {
+				override.switches = append(override.switches, entity)
+			}
 		}
+		log.Printf("Low price charging below %.3f, %d extra loads", override.below, len(override.switches))
+	}
+	var curtail *curtailment
+	feedInLimit := getEnvOrDefault("PV_FEED_IN_LIMIT_KW", "")
+	if feedInLimit != "" || getEnvOrDefault("PV_FEED_IN_PHASE_LIMIT", "") != "" || getEnvOrDefault("PV_CURTAILMENT_SENSOR", "") != "" {
+		curtail = &curtailment{
+			feedInLimit:      getEnvFloat("PV_FEED_IN_LIMIT_KW", 0) * 1000,
+			hasFeedInLimit:   feedInLimit != "",
+			phaseLimit:       getEnvFloat("PV_FEED_IN_PHASE_LIMIT", 0),
+			capacity:         getEnvFloat("PV_INVERTER_CAPACITY_KW", 0) * 1000,
+			productionSensor: getEnvOrDefault("PV_PRODUCTION_SENSOR", ""),
+			sensor:           getEnvOrDefault("PV_CURTAILMENT_SENSOR", ""),
+			limitEntity:      getEnvOrDefault("PV_INVERTER_LIMIT", ""),
+			rampStep:         getEnvFloat("PV_CURTAILMENT_RAMP", 1),
+			voltage:          topology.nominalVoltage(),
+		}
+		if curtail.rampStep <= 0 {
+			log.Fatalf("invalid PV_CURTAILMENT_RAMP: must be positive")
+		}
+		if curtail.limitEntity != "" && feedInLimit == "" {
+			log.Fatalf("PV_INVERTER_LIMIT needs PV_FEED_IN_LIMIT_KW")
+		}
+		log.Printf("Feed-in limit %.0fW, inverter %.0fW", curtail.feedInLimit, curtail.capacity)
+	}
+	var forecaster *solarForecaster
+	if spec := getEnvOrDefault("SOLAR_FORECAST", ""); spec != "" {
+		sources, err := parseForecastSources(spec, haService)
+		if err != nil {
+			log.Fatalf("invalid SOLAR_FORECAST: %v", err)
+		}
+		chargerWatts := float64(len(chargerPhases)) * topology.nominalVoltage()
+		forecaster = &solarForecaster{
+			sources:       sources,
+			baseLoad:      getEnvFloat("SOLAR_FORECAST_BASE_LOAD_KW", 0.5) * 1000,
+			minRun:        time.Duration(getEnvFloat("SOLAR_FORECAST_MIN_RUN", 1) * float64(time.Hour)),
+			minPower:      6 * chargerWatts,
+			maxPower:      16 * chargerWatts,
+			ha:            haService,
+			sensor:        getEnvOrDefault("SOLAR_FORECAST_SENSOR", "sensor.electricity_solar_forecast"),
+			requestEntity: getEnvOrDefault("SOLAR_CHARGE_REQUEST", ""),
+		}
+		if forecaster.minRun <= 0 {
+			log.Fatalf("invalid SOLAR_FORECAST_MIN_RUN: must be positive")
+		}
+		go forecaster.run(ctx)
+		log.Printf("Solar forecast from %d sources", len(sources))
+	}
+	var baseLoad *baseLoadForecaster
+	if path := getEnvOrDefault("BASELOAD_FILE", ""); path != "" {
+		baseLoad = newBaseLoadForecaster(topology, nil)
+		baseLoad.ha = haService
+		baseLoad.sensor = getEnvOrDefault("BASELOAD_SENSOR", "sensor.electricity_base_load_forecast")
+		baseLoad.path = path
+		baseLoad.lookahead = time.Duration(getEnvFloat("BASELOAD_LOOKAHEAD", 30) * float64(time.Minute))
+		if err := baseLoad.load(); err != nil && !os.IsNotExist(err) {
+			log.Printf("BASELOAD: could not load %s: %v", path, err)
+		}
+	}
+	tuning := &pidConfig{
+		fuseEntity: getEnvOrDefault("PID_FUSE_ENTITY", ""),
+		pvEntity:   getEnvOrDefault("PID_PV_ENTITY", ""),
+	}
+	if tuning.fuse, err = parsePIDTuning(getEnvOrDefault("PID_FUSE", ""), defaultPIDTuning); err != nil {
+		log.Fatalf("invalid PID_FUSE: %v", err)
+	}
+	if tuning.pv, err = parsePIDTuning(getEnvOrDefault("PID_PV", ""), defaultPIDTuning); err != nil {
+		log.Fatalf("invalid PID_PV: %v", err)
+	}
+	controlPeriod := time.Duration(getEnvFloat("CONTROL_PERIOD", defaultControlPeriod.Seconds()) * float64(time.Second))
+	if controlPeriod < time.Second {
+		log.Fatalf("invalid CONTROL_PERIOD: must be at least 1 second")
+	}
+	dawnService := newDawnConsumerService(ctx, events, haService, dawnConfig{
+		statusSensor:      getEnvOrDefault("CHARGER_STATUS_SENSOR", "sensor.dawn_status_connector"),
+		dawnId:            dawn,
+		dawnSwitch:        dawnSwitch,
+		notifyDevice:      notifyDevice,
+		dawnCurrentId:     dawnCurrent,
+		setpoint:          MAX_PHASE_CURRENT,
+		pvOnlySwitchId:    pvOnlySwitchId,
+		userLimitId:       dawnUserLimit,
+		chargeStateSensor: getEnvOrDefault("CHARGE_STATE_SENSOR", "sensor.electricity_charge_state"),
+		accounting:        accounting,
+		importWeight:      importWeight,
+		topology:          topology,
+		chargerPhases:     chargerPhases,
+		assumeFirstPhase:  rotationSpec != "",
+		fuse:              fuse,
+		imbalance:         imbalance,
+		actuator:          actuator,
+		statusMap:         statusMap,
+		override:          override,
+		curtailment:       curtail,
+		forecast:          forecaster,
+		baseLoad:          baseLoad,
+		tuning:            tuning,
+		controlPeriod:     controlPeriod,
 	})
-	if err != nil {
-		log.Fatalf("error setting up cron: %v", err)
+
+	if addr := getEnvOrDefault("METRICS_ADDR", ""); addr != "" {
+		go serveMetrics(ctx, addr, map[string]http.Handler{
+			"/charge/state": dawnService.chargeStateHandler(),
+		})
+	}
+
+	if entity := getEnvOrDefault("NOTIFY_ACTION_ENTITY", ""); entity != "" {
+		notifier.listenActions(ctx, haService, entity)
+	}
+
+	daily := gocron.NewScheduler(time.Local)
+	if at := getEnvOrDefault("NOTIFY_DAILY_SUMMARY", ""); at != "" {
+		if _, err := daily.Every(1).Day().At(at).Do(func() {
+			notifier.dailySummary(dawnService.dailySummaryLines()...)
+		}); err != nil {
+			log.Fatalf("invalid NOTIFY_DAILY_SUMMARY: %v", err)
+		}
+	}
+	var ledger *energyLedger
+	if dir := getEnvOrDefault("REPORT_DIR", ""); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Fatalf("invalid REPORT_DIR: %v", err)
+		}
+		ledger = newEnergyLedger(pricing, dawnService.evCurrent, topology)
+		rep := &reporter{ledger: ledger, dir: dir}
+		if err := ledger.load(rep.ledgerPath()); err != nil && !os.IsNotExist(err) {
+			log.Printf("REPORT: could not load ledger: %v", err)
+		}
+		if getEnvOrDefault("REPORT_NOTIFY", "false") == "true" {
+			rep.notify = func(message string) {
+				haService.notify(NotifyReport, SeverityInfo, message)
+			}
+		}
+		if _, err := daily.Every(1).Day().At("00:05").Do(func() {
+			if _, err := rep.daily(time.Now().AddDate(0, 0, -1)); err != nil {
+				log.Printf("REPORT: %v", err)
+			}
+		}); err != nil {
+			log.Fatalf("error setting up report: %v", err)
+		}
+		if _, err := daily.Every(15).Minutes().Do(func() {
+			if err := ledger.save(rep.ledgerPath()); err != nil {
+				log.Printf("REPORT: could not save ledger: %v", err)
+			}
+		}); err != nil {
+			log.Fatalf("error setting up report: %v", err)
+		}
+		defer ledger.save(rep.ledgerPath())
+		log.Printf("REPORT: writing reports to %s", dir)
+	}
+	daily.StartAsync()
+
+	go priceService.run(ctx)
+	go publisher.run(ctx)
+	if baseLoad != nil {
+		// The consumer needs the forecaster, so the EV current is set here
+		baseLoad.evCurrent = dawnService.evPhaseCurrents
+		go baseLoad.run(ctx)
+		defer baseLoad.save()
 	}
-	s.StartAsync()
 
 	log.Printf("Start main loop")
 
@@ -67,6 +347,12 @@ MainLoop:
 			if ok {
 				if event.powerEvent != nil {
 					dawnService.updateCurrents(event.powerEvent)
+					if ledger != nil {
+						ledger.update(event.powerEvent)
+					}
+					if baseLoad != nil {
+						baseLoad.update(event.powerEvent)
+					}
 				}
 			} else {
 				break MainLoop
@@ -74,7 +360,7 @@ MainLoop:
 		}
 	}
 	log.Printf("End main loop")
-	s.Remove(job)
+	daily.Stop()
 }
 
 func readEnv() (string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string, string) {
@@ -140,25 +426,36 @@ func readEnv() (string, string, string, string, string, string, string, string,
 
 	dawnUserLimit = getEnvOrDefault("DAWN_USER_LIMIT", "")
 
+	// A direct P1 or Modbus meter replaces the default HA phase sensors, so
+	// they do not overwrite its readings with older values. Sensors set
+	// explicitly are still read.
+	directMeter := getEnvOrDefault("P1_DEVICE", "") != "" || getEnvOrDefault("P1_ADDRESS", "") != "" || getEnvOrDefault("MODBUS_METER_ADDRESS", "") != ""
+	phaseSensor := func(key string, defaultValue string) string {
+		if directMeter {
+			defaultValue = ""
+		}
+		return getEnvOrDefault(key, defaultValue)
+	}
+
 	// Phase Currents
-	phase1 = getEnvOrDefault("PHASE_1_CURRENT", "sensor.current_phase_1")
-	phase2 = getEnvOrDefault("PHASE_2_CURRENT", "sensor.current_phase_2")
-	phase3 = getEnvOrDefault("PHASE_3_CURRENT", "sensor.current_phase_3")
+	phase1 = phaseSensor("PHASE_1_CURRENT", "sensor.current_phase_1")
+	phase2 = phaseSensor("PHASE_2_CURRENT", "sensor.current_phase_2")
+	phase3 = phaseSensor("PHASE_3_CURRENT", "sensor.current_phase_3")
 
 	// Export Sensors
-	export1 = getEnvOrDefault("PHASE_1_EXPORT", "sensor.momentary_active_export_phase_1")
-	export2 = getEnvOrDefault("PHASE_2_EXPORT", "sensor.momentary_active_export_phase_2")
-	export3 = getEnvOrDefault("PHASE_3_EXPORT", "sensor.momentary_active_export_phase_3")
+	export1 = phaseSensor("PHASE_1_EXPORT", "sensor.momentary_active_export_phase_1")
+	export2 = phaseSensor("PHASE_2_EXPORT", "sensor.momentary_active_export_phase_2")
+	export3 = phaseSensor("PHASE_3_EXPORT", "sensor.momentary_active_export_phase_3")
 
 	// Import Sensors
-	import1 = getEnvOrDefault("PHASE_1_IMPORT", "sensor.momentary_active_import_phase_1")
-	import2 = getEnvOrDefault("PHASE_2_IMPORT", "sensor.momentary_active_import_phase_2")
-	import3 = getEnvOrDefault("PHASE_3_IMPORT", "sensor.momentary_active_import_phase_3")
+	import1 = phaseSensor("PHASE_1_IMPORT", "sensor.momentary_active_import_phase_1")
+	import2 = phaseSensor("PHASE_2_IMPORT", "sensor.momentary_active_import_phase_2")
+	import3 = phaseSensor("PHASE_3_IMPORT", "sensor.momentary_active_import_phase_3")
 
 	// Voltage Sensors
-	voltage1 = getEnvOrDefault("PHASE_1_VOLTAGE", "sensor.voltage_phase_1")
-	voltage2 = getEnvOrDefault("PHASE_2_VOLTAGE", "sensor.voltage_phase_2")
-	voltage3 = getEnvOrDefault("PHASE_3_VOLTAGE", "sensor.voltage_phase_3")
+	voltage1 = phaseSensor("PHASE_1_VOLTAGE", "sensor.voltage_phase_1")
+	voltage2 = phaseSensor("PHASE_2_VOLTAGE", "sensor.voltage_phase_2")
+	voltage3 = phaseSensor("PHASE_3_VOLTAGE", "sensor.voltage_phase_3")
 
 	return haURI, haToken, area, dawn, dawnSwitch, notifyDevice, dawnCurrent, pvOnlySwitch, dawnUserLimit,
 		phase1, phase2, phase3, export1, export2, export3, voltage1, voltage2, voltage3,
@@ -172,3 +469,67 @@ func getEnvOrDefault(key, defaultValue string) string {
 	}
 	return strings.TrimSpace(value)
 }
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	value, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(value) == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", key, err)
+	}
+	return f
+}
+
+// newTariffFromEnv reads the price components on top of the spot price, all
+// per kWh in the currency of the spot price.
+func newTariffFromEnv(spot spotPricer) *tariff {
+	gridFee, periods, err := parseGridFee(getEnvOrDefault("TARIFF_GRID_FEE", ""))
+	if err != nil {
+		log.Fatalf("invalid TARIFF_GRID_FEE: %v", err)
+	}
+	t := &tariff{
+		spot:               spot,
+		markup:             getEnvFloat("TARIFF_MARKUP", 0),
+		gridFee:            gridFee,
+		gridFeePeriods:     periods,
+		energyTax:          getEnvFloat("TARIFF_ENERGY_TAX", 0),
+		vat:                getEnvFloat("TARIFF_VAT", 0) / 100,
+		exportFee:          getEnvFloat("TARIFF_EXPORT_FEE", 0),
+		exportTaxReduction: getEnvFloat("TARIFF_EXPORT_TAX_REDUCTION", 0),
+	}
+	log.Printf("Tariff: %s", t)
+	return t
+}
+
+// newNotifierFromEnv sets up the notification targets, quiet hours and rate
+// limits. NOTIFY_DEVICE may list several HA notify services.
+func newNotifierFromEnv(ha *haService, notifyDevices string) *notifier {
+	var targets []notificationTarget
+	for _, service := range strings.Split(notifyDevices, ",") {
+		if service = strings.TrimSpace(service); service != "" {
+			targets = append(targets, &haNotifyTarget{ha: ha, service: service})
+		}
+	}
+	if url := getEnvOrDefault("NOTIFY_WEBHOOK", ""); url != "" {
+		targets = append(targets, &webhookTarget{url: url, client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	if addr := getEnvOrDefault("NOTIFY_SMTP_ADDR", ""); addr != "" {
+		to := strings.Split(getEnvOrDefault("NOTIFY_SMTP_TO", ""), ",")
+		if len(to) == 0 || to[0] == "" {
+			log.Fatalf("NOTIFY_SMTP_TO is required with NOTIFY_SMTP_ADDR")
+		}
+		targets = append(targets, &smtpTarget{address: addr, from: getEnvOrDefault("NOTIFY_SMTP_FROM", "electricity@localhost"), to: to})
+	}
+
+	quiet, err := parseQuietHours(getEnvOrDefault("NOTIFY_QUIET_HOURS", ""))
+	if err != nil {
+		log.Fatalf("invalid NOTIFY_QUIET_HOURS: %v", err)
+	}
+	limits, err := parseRateLimits(getEnvOrDefault("NOTIFY_RATE_LIMITS", ""))
+	if err != nil {
+		log.Fatalf("invalid NOTIFY_RATE_LIMITS: %v", err)
+	}
+	return newNotifier(targets, limits, quiet)
+}
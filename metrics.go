@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metricsRegistry keeps the latest value of each gauge and the running total
+// of each counter, and serves them in the Prometheus text format.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	gauges   map[string]float64
+	counters map[string]float64
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		gauges:   make(map[string]float64),
+		counters: make(map[string]float64),
+	}
+}
+
+func (m *metricsRegistry) setGauge(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *metricsRegistry) addCounter(name string, delta float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += delta
+}
+
+func (m *metricsRegistry) gauge(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.gauges[name]
+}
+
+func (m *metricsRegistry) counter(name string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters[name]
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	write := func(kind string, values map[string]float64) {
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(w, "# TYPE %s %s\n%s %g\n", name, kind, name, values[name])
+		}
+	}
+	write("gauge", m.gauges)
+	write("counter", m.counters)
+}
+
+// serveMetrics exposes the registry on /metrics until the context is done.
+func serveMetrics(ctx context.Context, addr string, handlers map[string]http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	for path, handler := range handlers {
+		mux.Handle(path, handler)
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("METRICS: serving on %s/metrics", addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("METRICS: server stopped: %v", err)
+	}
+}
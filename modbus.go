@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	modbusReadHolding = 0x03
+	modbusReadInput   = 0x04
+)
+
+// modbusClient is a minimal Modbus TCP client for reading registers.
+type modbusClient struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	unit    byte
+	tid     uint16
+	timeout time.Duration
+}
+
+func dialModbus(address string, unit byte, timeout time.Duration) (*modbusClient, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &modbusClient{conn: conn, unit: unit, timeout: timeout}, nil
+}
+
+func (c *modbusClient) Close() error {
+	return c.conn.Close()
+}
+
+// readRegisters reads count 16-bit registers starting at address with the
+// given function code (holding or input registers).
+func (c *modbusClient) readRegisters(function byte, address uint16, count uint16) ([]uint16, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tid++
+	request := make([]byte, 12)
+	binary.BigEndian.PutUint16(request[0:], c.tid)
+	binary.BigEndian.PutUint16(request[2:], 0) // protocol
+	binary.BigEndian.PutUint16(request[4:], 6) // unit + PDU
+	request[6] = c.unit
+	request[7] = function
+	binary.BigEndian.PutUint16(request[8:], address)
+	binary.BigEndian.PutUint16(request[10:], count)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(request); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	if tid := binary.BigEndian.Uint16(header[0:]); tid != c.tid {
+		return nil, fmt.Errorf("modbus: transaction id %d, expected %d", tid, c.tid)
+	}
+	length := binary.BigEndian.Uint16(header[4:])
+	if length < 2 || length > 256 {
+		return nil, fmt.Errorf("modbus: invalid length %d", length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(c.conn, pdu); err != nil {
+		return nil, err
+	}
+
+	if pdu[0] == function|0x80 {
+		return nil, fmt.Errorf("modbus: exception %d reading %d@%d", pdu[1], count, address)
+	}
+	if pdu[0] != function || len(pdu) < 2 || int(pdu[1]) != int(count)*2 || len(pdu) != 2+int(count)*2 {
+		return nil, errors.New("modbus: malformed response")
+	}
+
+	registers := make([]uint16, count)
+	for i := range registers {
+		registers[i] = binary.BigEndian.Uint16(pdu[2+i*2:])
+	}
+	return registers, nil
+}
+
+type registerFormat int
+
+const (
+	formatFloat32       registerFormat = iota // IEEE 754, high word first
+	formatInt32WordSwap                       // signed, low word first
+	formatInt16                               // signed
+)
+
+// meterRegister is one value in a meter's register map. The raw value times
+// scale gives V, A or W. Power registers are signed with import positive.
+type meterRegister struct {
+	sensorType SensorType
+	phaseIndex int
+	address    uint16
+	format     registerFormat
+	scale      float64
+}
+
+type meterMap struct {
+	function  byte
+	registers []meterRegister
+}
+
+// meterMaps are the built-in register maps for common energy meters.
+var meterMaps = map[string]meterMap{
+	"sdm630": {function: modbusReadInput, registers: []meterRegister{
+		{SensorTypeVoltage, 1, 0x0000, formatFloat32, 1},
+		{SensorTypeVoltage, 2, 0x0002, formatFloat32, 1},
+		{SensorTypeVoltage, 3, 0x0004, formatFloat32, 1},
+		{SensorTypeCurrent, 1, 0x0006, formatFloat32, 1},
+		{SensorTypeCurrent, 2, 0x0008, formatFloat32, 1},
+		{SensorTypeCurrent, 3, 0x000A, formatFloat32, 1},
+		{SensorTypeImport, 1, 0x000C, formatFloat32, 1},
+		{SensorTypeImport, 2, 0x000E, formatFloat32, 1},
+		{SensorTypeImport, 3, 0x0010, formatFloat32, 1},
+	}},
+	// Carlo Gavazzi EM24/EM340
+	"em24": {function: modbusReadInput, registers: []meterRegister{
+		{SensorTypeVoltage, 1, 0x0000, formatInt32WordSwap, 0.1},
+		{SensorTypeVoltage, 2, 0x0002, formatInt32WordSwap, 0.1},
+		{SensorTypeVoltage, 3, 0x0004, formatInt32WordSwap, 0.1},
+		{SensorTypeCurrent, 1, 0x000C, formatInt32WordSwap, 0.001},
+		{SensorTypeCurrent, 2, 0x000E, formatInt32WordSwap, 0.001},
+		{SensorTypeCurrent, 3, 0x0010, formatInt32WordSwap, 0.001},
+		{SensorTypeImport, 1, 0x0012, formatInt32WordSwap, 0.1},
+		{SensorTypeImport, 2, 0x0014, formatInt32WordSwap, 0.1},
+		{SensorTypeImport, 3, 0x0016, formatInt32WordSwap, 0.1},
+	}},
+}
+
+func (r meterRegister) width() uint16 {
+	if r.format == formatInt16 {
+		return 1
+	}
+	return 2
+}
+
+func (r meterRegister) decode(regs []uint16) float64 {
+	switch r.format {
+	case formatFloat32:
+		return float64(math.Float32frombits(uint32(regs[0])<<16|uint32(regs[1]))) * r.scale
+	case formatInt32WordSwap:
+		return float64(int32(uint32(regs[1])<<16|uint32(regs[0]))) * r.scale
+	default:
+		return float64(int16(regs[0])) * r.scale
+	}
+}
+
+// span returns the first address and register count covering the whole map,
+// so the meter can be read in one request.
+func (m meterMap) span() (uint16, uint16) {
+	first, last := uint16(math.MaxUint16), uint16(0)
+	for _, r := range m.registers {
+		if r.address < first {
+			first = r.address
+		}
+		if end := r.address + r.width(); end > last {
+			last = end
+		}
+	}
+	return first, last - first
+}
+
+// events decodes a register block read from span into power events, in the
+// same units as the HA path. Signed power is split into import and export.
+func (m meterMap) events(regs []uint16, topology PhaseTopology) []*powerEvent {
+	first, _ := m.span()
+	values := make(map[SensorType]map[int]float64)
+	for _, r := range m.registers {
+		if r.phaseIndex > topology.phaseCount() {
+			continue
+		}
+		if values[r.sensorType] == nil {
+			values[r.sensorType] = make(map[int]float64)
+		}
+		offset := r.address - first
+		values[r.sensorType][r.phaseIndex] = r.decode(regs[offset : offset+r.width()])
+	}
+
+	var events []*powerEvent
+	for _, phase := range topology.phases() {
+		voltage, ok := values[SensorTypeVoltage][phase]
+		if ok {
+			events = append(events, &powerEvent{sensorType: SensorTypeVoltage, phase: "modbus", phaseIndex: phase, value: voltage})
+		}
+		if voltage < topology.nominalVoltage()*0.5 {
+			voltage = topology.nominalVoltage()
+		}
+		if watts, ok := values[SensorTypeImport][phase]; ok {
+			// Only the active direction: an export reading clears the import
+			// current and the other way around. An idle phase reports both as
+			// zero.
+			if watts >= 0 {
+				events = append(events, &powerEvent{sensorType: SensorTypeImport, phase: "modbus", phaseIndex: phase, value: watts / voltage})
+			}
+			if watts <= 0 {
+				events = append(events, &powerEvent{sensorType: SensorTypeExport, phase: "modbus", phaseIndex: phase, value: math.Abs(watts) / voltage})
+			}
+		}
+		if amps, ok := values[SensorTypeCurrent][phase]; ok {
+			events = append(events, &powerEvent{sensorType: SensorTypeCurrent, phase: "modbus", phaseIndex: phase, value: amps})
+		}
+	}
+	return events
+}
+
+const (
+	sunspecBase    = 40000
+	sunspecEndID   = 0xFFFF
+	sunspecMaxScan = 64
+)
+
+// sunspecModel is the location of one SunSpec model's data registers.
+type sunspecModel struct {
+	id      uint16
+	address uint16 // first data register, after the ID and length
+	length  uint16
+}
+
+// findSunspecModels walks the SunSpec model chain starting at 40000.
+func findSunspecModels(client *modbusClient) ([]sunspecModel, error) {
+	marker, err := client.readRegisters(modbusReadHolding, sunspecBase, 2)
+	if err != nil {
+		return nil, err
+	}
+	if marker[0] != 0x5375 || marker[1] != 0x6E53 {
+		return nil, errors.New("sunspec: no SunS marker at 40000")
+	}
+
+	var models []sunspecModel
+	address := uint16(sunspecBase + 2)
+	for i := 0; i < sunspecMaxScan; i++ {
+		header, err := client.readRegisters(modbusReadHolding, address, 2)
+		if err != nil {
+			return nil, err
+		}
+		if header[0] == sunspecEndID {
+			return models, nil
+		}
+		models = append(models, sunspecModel{id: header[0], address: address + 2, length: header[1]})
+		address += 2 + header[1]
+	}
+	return nil, errors.New("sunspec: model chain too long")
+}
+
+// parseSunspecInverterPower returns the AC power in W from the data registers
+// of an inverter model (101, 102 or 103).
+func parseSunspecInverterPower(regs []uint16) (float64, error) {
+	const offsetW, offsetWSF = 12, 13
+	if len(regs) <= offsetWSF {
+		return 0, errors.New("sunspec: inverter model too short")
+	}
+	if regs[offsetW] == 0x8000 {
+		return 0, errors.New("sunspec: power not implemented")
+	}
+	return float64(int16(regs[offsetW])) * math.Pow(10, float64(int16(regs[offsetWSF]))), nil
+}
+
+// modbusSource configures the optional Modbus TCP meter and inverter inputs.
+type modbusSource struct {
+	meterAddress    string
+	meterType       string
+	meterUnit       byte
+	inverterAddress string
+	inverterUnit    byte
+	interval        time.Duration
+}
+
+// runModbusMeter polls a meter at the configured interval and reconnects on
+// failure.
+func (ps *PowerService) runModbusMeter(source modbusSource) {
+	meter, ok := meterMaps[source.meterType]
+	if !ok {
+		log.Printf("MODBUS: unknown meter type %q", source.meterType)
+		return
+	}
+	first, count := meter.span()
+
+	ps.pollModbus(source.meterAddress, source.meterUnit, source.interval, nil, func(client *modbusClient) error {
+		regs, err := client.readRegisters(meter.function, first, count)
+		if err != nil {
+			return err
+		}
+		ps.sendReadings(meter.events(regs, ps.topology))
+		return nil
+	})
+}
+
+// runModbusInverter polls the AC production of a SunSpec inverter.
+func (ps *PowerService) runModbusInverter(source modbusSource) {
+	var inverter *sunspecModel
+	ps.pollModbus(source.inverterAddress, source.inverterUnit, source.interval, func(client *modbusClient) error {
+		models, err := findSunspecModels(client)
+		if err != nil {
+			return err
+		}
+		for _, m := range models {
+			if m.id >= 101 && m.id <= 103 {
+				model := m
+				inverter = &model
+				log.Printf("MODBUS: SunSpec inverter model %d at %d", m.id, m.address)
+				return nil
+			}
+		}
+		return errors.New("sunspec: no inverter model found")
+	}, func(client *modbusClient) error {
+		regs, err := client.readRegisters(modbusReadHolding, inverter.address, inverter.length)
+		if err != nil {
+			return err
+		}
+		watts, err := parseSunspecInverterPower(regs)
+		if err != nil {
+			return err
+		}
+		ps.sendReadings([]*powerEvent{{sensorType: SensorTypeProduction, phase: "sunspec", value: watts}})
+		return nil
+	})
+}
+
+// pollModbus connects, runs setup once per connection and then poll at every
+// interval until an error, after which it reconnects.
+func (ps *PowerService) pollModbus(address string, unit byte, interval time.Duration, setup func(*modbusClient) error, poll func(*modbusClient) error) {
+	for {
+		client, err := dialModbus(address, unit, 5*time.Second)
+		if err == nil && setup != nil {
+			if err = setup(client); err != nil {
+				client.Close()
+			}
+		}
+		if err == nil {
+			log.Printf("MODBUS: polling %s (unit %d) every %v", address, unit, interval)
+			ticker := time.NewTicker(interval)
+		Poll:
+			for {
+				if err = poll(client); err != nil {
+					break Poll
+				}
+				select {
+				case <-ps.ctx.Done():
+					break Poll
+				case <-ticker.C:
+				}
+			}
+			ticker.Stop()
+			client.Close()
+		}
+
+		if ps.ctx.Err() != nil {
+			return
+		}
+		log.Printf("MODBUS: %s: %v, retrying in 5 seconds...", address, err)
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeModbusServer answers register reads from a fixed register table.
+func fakeModbusServer(t *testing.T, registers map[uint16]uint16) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				for {
+					request := make([]byte, 12)
+					if _, err := io.ReadFull(conn, request); err != nil {
+						return
+					}
+					address := binary.BigEndian.Uint16(request[8:])
+					count := binary.BigEndian.Uint16(request[10:])
+
+					response := make([]byte, 9+count*2)
+					copy(response, request[:4])
+					binary.BigEndian.PutUint16(response[4:], 3+count*2)
+					response[6] = request[6]
+					response[7] = request[7]
+					response[8] = byte(count * 2)
+					for i := uint16(0); i < count; i++ {
+						value, ok := registers[address+i]
+						if !ok {
+							// Illegal data address
+							conn.Write([]byte{request[0], request[1], 0, 0, 0, 3, request[6], request[7] | 0x80, 2})
+							goto next
+						}
+						binary.BigEndian.PutUint16(response[9+i*2:], value)
+					}
+					conn.Write(response)
+				next:
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func putFloat32(registers map[uint16]uint16, address uint16, value float32) {
+	bits := math.Float32bits(value)
+	registers[address] = uint16(bits >> 16)
+	registers[address+1] = uint16(bits)
+}
+
+func sdm630Registers() map[uint16]uint16 {
+	registers := make(map[uint16]uint16)
+	putFloat32(registers, 0x0000, 230)
+	putFloat32(registers, 0x0002, 230)
+	putFloat32(registers, 0x0004, 230)
+	putFloat32(registers, 0x0006, 10)
+	putFloat32(registers, 0x0008, 4)
+	putFloat32(registers, 0x000A, 6)
+	putFloat32(registers, 0x000C, 2300)
+	putFloat32(registers, 0x000E, 920)
+	putFloat32(registers, 0x0010, -1380) // exporting
+	return registers
+}
+
+func TestModbusClient_ReadRegisters(t *testing.T) {
+	address := fakeModbusServer(t, map[uint16]uint16{10: 1, 11: 2})
+	client, err := dialModbus(address, 1, time.Second)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	regs, err := client.readRegisters(modbusReadHolding, 10, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{1, 2}, regs)
+
+	_, err = client.readRegisters(modbusReadHolding, 20, 1)
+	assert.Error(t, err, "Exception responses are errors")
+}
+
+func TestMeterMap_SDM630Events(t *testing.T) {
+	meter := meterMaps["sdm630"]
+	first, count := meter.span()
+	assert.Equal(t, uint16(0), first)
+	assert.Equal(t, uint16(18), count)
+
+	registers := sdm630Registers()
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = registers[first+uint16(i)]
+	}
+
+	byKey := make(map[[2]int]float64)
+	for _, e := range meter.events(regs, TopologyThreePhase) {
+		byKey[[2]int{int(e.sensorType), e.phaseIndex}] = e.value
+	}
+	assert.InDelta(t, 10.0, byKey[[2]int{int(SensorTypeImport), 1}], 0.001)
+	assert.NotContains(t, byKey, [2]int{int(SensorTypeExport), 1}, "Only the active direction")
+	assert.InDelta(t, 6.0, byKey[[2]int{int(SensorTypeExport), 3}], 0.001, "Negative power is export")
+	assert.NotContains(t, byKey, [2]int{int(SensorTypeImport), 3})
+	assert.InDelta(t, 4.0, byKey[[2]int{int(SensorTypeCurrent), 2}], 0.001)
+
+	// The import current survives a whole poll in the consumer
+	service := &dawnConsumerService{
+		currents:           make(map[string]float64),
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+	}
+	for _, e := range meter.events(regs, TopologyThreePhase) {
+		service.updateCurrents(e)
+	}
+	assert.InDelta(t, 10.0, service.currents["phase1"], 0.001)
+	assert.InDelta(t, 6.0, service.exports["phase3"], 0.001)
+	assert.Equal(t, 0.0, service.currents["phase3"])
+}
+
+func TestMeterRegister_EM24Decode(t *testing.T) {
+	r := meterRegister{format: formatInt32WordSwap, scale: 0.1}
+	// -1234.5 W as int32 -12345, low word first
+	value := int32(-12345)
+	raw := uint32(value)
+	assert.InDelta(t, -1234.5, r.decode([]uint16{uint16(raw), uint16(raw >> 16)}), 0.001)
+}
+
+func TestSunspecInverter(t *testing.T) {
+	registers := map[uint16]uint16{
+		40000: 0x5375, 40001: 0x6E53,
+		// Common model 1, 66 registers (not read)
+		40002: 1, 40003: 66,
+	}
+	// Three-phase inverter model 103, 50 registers
+	inverter := uint16(40002 + 2 + 66)
+	registers[inverter] = 103
+	registers[inverter+1] = 50
+	for i := uint16(0); i < 50; i++ {
+		registers[inverter+2+i] = 0
+	}
+	registers[inverter+2+12] = 4321           // W
+	registers[inverter+2+13] = uint16(0xFFFF) // W_SF = -1
+	registers[inverter+2+50] = sunspecEndID
+	registers[inverter+2+51] = 0
+
+	client, err := dialModbus(fakeModbusServer(t, registers), 1, time.Second)
+	assert.NoError(t, err)
+	defer client.Close()
+
+	models, err := findSunspecModels(client)
+	assert.NoError(t, err)
+	assert.Len(t, models, 2)
+	assert.Equal(t, uint16(103), models[1].id)
+
+	regs, err := client.readRegisters(modbusReadHolding, models[1].address, models[1].length)
+	assert.NoError(t, err)
+	watts, err := parseSunspecInverterPower(regs)
+	assert.NoError(t, err)
+	assert.InDelta(t, 432.1, watts, 0.001)
+}
+
+func TestPowerService_ModbusMeter(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *event, 50)
+	newPowerService(ctx, events, &haService{}, nil, TopologyThreePhase, 20, p1Source{}, modbusSource{
+		meterAddress: fakeModbusServer(t, sdm630Registers()),
+		meterType:    "sdm630",
+		meterUnit:    1,
+		interval:     50 * time.Millisecond,
+	})
+
+	// 3 voltages, 3 imports or exports and 3 currents per poll
+	for received := 0; received < 18; received++ {
+		select {
+		case <-events:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected two polls worth of events, got %d", received)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+
+	mqttKeepAlive = 60 * time.Second
+)
+
+type mqttHandler func(topic string, payload []byte)
+
+type mqttSubscription struct {
+	filter  string
+	handler mqttHandler
+}
+
+// mqttClient is a minimal MQTT 3.1.1 client (QoS 0) that keeps its
+// subscriptions across reconnects.
+type mqttClient struct {
+	ctx      context.Context
+	address  string
+	clientID string
+	username string
+	password string
+
+	mu       sync.Mutex
+	conn     net.Conn
+	packetID uint16
+	subs     []mqttSubscription
+}
+
+func newMqttClient(ctx context.Context, address string, clientID string, username string, password string) *mqttClient {
+	m := &mqttClient{
+		ctx:      ctx,
+		address:  address,
+		clientID: clientID,
+		username: username,
+		password: password,
+	}
+	go m.manageConnection()
+	return m
+}
+
+func (m *mqttClient) manageConnection() {
+	for {
+		conn, err := m.connect()
+		if err != nil {
+			log.Printf("MQTT: could not connect to %s: %v, retrying in 5 seconds...", m.address, err)
+		} else {
+			log.Printf("MQTT: connected to %s", m.address)
+			done := make(chan struct{})
+			go m.keepAlive(conn, done)
+			err = m.readLoop(conn)
+			close(done)
+			m.mu.Lock()
+			m.conn = nil
+			m.mu.Unlock()
+			conn.Close()
+			log.Printf("MQTT: connection lost: %v, retrying in 5 seconds...", err)
+		}
+
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+func (m *mqttClient) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", m.address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte = 0x02 // clean session
+	payload := mqttString(m.clientID)
+	if m.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(m.username)...)
+	}
+	if m.password != "" {
+		flags |= 0x40
+		payload = append(payload, mqttString(m.password)...)
+	}
+	keepAlive := uint16(mqttKeepAlive / time.Second)
+	header := append(mqttString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(mqttConnect<<4, append(header, payload...))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	packetType, body, err := readMqttPacket(bufio.NewReader(conn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if packetType>>4 != mqttConnack || len(body) < 2 || body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused (%v)", body)
+	}
+	conn.SetDeadline(time.Time{})
+
+	m.mu.Lock()
+	m.conn = conn
+	subs := append([]mqttSubscription(nil), m.subs...)
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		if err := m.sendSubscribe(sub.filter); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (m *mqttClient) keepAlive(conn net.Conn, done chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			m.write(mqttPacket(mqttDisconnect<<4, nil))
+			conn.Close()
+			return
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := m.write(mqttPacket(mqttPingreq<<4, nil)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (m *mqttClient) readLoop(conn net.Conn) error {
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 2))
+		packetType, body, err := readMqttPacket(reader)
+		if err != nil {
+			return err
+		}
+		if packetType>>4 != mqttPublish {
+			continue
+		}
+
+		topic, rest, err := readMqttString(body)
+		if err != nil {
+			return err
+		}
+		if qos := (packetType >> 1) & 0x03; qos > 0 && len(rest) >= 2 {
+			rest = rest[2:] // packet identifier
+		}
+
+		m.mu.Lock()
+		subs := append([]mqttSubscription(nil), m.subs...)
+		m.mu.Unlock()
+		for _, sub := range subs {
+			if mqttTopicMatches(sub.filter, topic) {
+				sub.handler(topic, rest)
+			}
+		}
+	}
+}
+
+// subscribe registers a handler for a topic filter. It also applies to later
+// reconnects.
+func (m *mqttClient) subscribe(filter string, handler mqttHandler) {
+	m.mu.Lock()
+	m.subs = append(m.subs, mqttSubscription{filter: filter, handler: handler})
+	connected := m.conn != nil
+	m.mu.Unlock()
+
+	if connected {
+		if err := m.sendSubscribe(filter); err != nil {
+			log.Printf("MQTT: could not subscribe to %s: %v", filter, err)
+		}
+	}
+}
+
+func (m *mqttClient) sendSubscribe(filter string) error {
+	m.mu.Lock()
+	m.packetID++
+	id := m.packetID
+	m.mu.Unlock()
+
+	body := []byte{byte(id >> 8), byte(id)}
+	body = append(body, mqttString(filter)...)
+	body = append(body, 0) // QoS 0
+	return m.write(mqttPacket(mqttSubscribe<<4|0x02, body))
+}
+
+func (m *mqttClient) publish(topic string, payload []byte, retain bool) error {
+	var flags byte = mqttPublish << 4
+	if retain {
+		flags |= 0x01
+	}
+	return m.write(mqttPacket(flags, append(mqttString(topic), payload...)))
+}
+
+func (m *mqttClient) write(packet []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conn == nil {
+		return errors.New("MQTT: not connected")
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := m.conn.Write(packet)
+	return err
+}
+
+// mqttTopicMatches reports whether a topic matches a filter with + and #
+// wildcards.
+func mqttTopicMatches(filter string, topic string) bool {
+	filterParts := strings.Split(filter, "/")
+	topicParts := strings.Split(topic, "/")
+	for i, part := range filterParts {
+		if part == "#" {
+			return true
+		}
+		if i >= len(topicParts) {
+			return false
+		}
+		if part != "+" && part != topicParts[i] {
+			return false
+		}
+	}
+	return len(filterParts) == len(topicParts)
+}
+
+func mqttString(s string) []byte {
+	b := make([]byte, 2, 2+len(s))
+	binary.BigEndian.PutUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+func readMqttString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("MQTT: short string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("MQTT: short string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		digit := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func readMqttPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7F) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
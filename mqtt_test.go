@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuomaz/gohaws"
+)
+
+type mqttTestMessage struct {
+	topic   string
+	payload string
+	retain  bool
+}
+
+// mqttTestBroker is a QoS 0 broker just large enough for the client: it
+// accepts any CONNECT, records publishes and fans them out to subscribers.
+type mqttTestBroker struct {
+	listener  net.Listener
+	mu        sync.Mutex
+	filters   map[net.Conn][]string
+	published []mqttTestMessage
+}
+
+func newMqttTestBroker(t *testing.T) *mqttTestBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	b := &mqttTestBroker{listener: listener, filters: make(map[net.Conn][]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return b
+}
+
+func (b *mqttTestBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		header, body, err := readMqttPacket(reader)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttConnect:
+			conn.Write(mqttPacket(mqttConnack<<4, []byte{0, 0}))
+		case mqttSubscribe:
+			filter, _, _ := readMqttString(body[2:])
+			b.mu.Lock()
+			b.filters[conn] = append(b.filters[conn], filter)
+			b.mu.Unlock()
+			conn.Write(mqttPacket(mqttSuback<<4, []byte{body[0], body[1], 0}))
+		case mqttPingreq:
+			conn.Write(mqttPacket(mqttPingresp<<4, nil))
+		case mqttPublish:
+			topic, payload, _ := readMqttString(body)
+			b.mu.Lock()
+			b.published = append(b.published, mqttTestMessage{topic, string(payload), header&0x01 != 0})
+			for subscriber, filters := range b.filters {
+				for _, filter := range filters {
+					if mqttTopicMatches(filter, topic) {
+						subscriber.Write(mqttPacket(mqttPublish<<4, body))
+						break
+					}
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+func (b *mqttTestBroker) messages() []mqttTestMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]mqttTestMessage(nil), b.published...)
+}
+
+func (b *mqttTestBroker) subscribed(filter string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, filters := range b.filters {
+		for _, f := range filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func waitForMqtt(t *testing.T, client *mqttClient) {
+	assert.Eventually(t, func() bool {
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		return client.conn != nil
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func TestMqttTopicMatches(t *testing.T) {
+	assert.True(t, mqttTopicMatches("meter/+/power", "meter/l1/power"))
+	assert.True(t, mqttTopicMatches("meter/#", "meter/l1/power"))
+	assert.False(t, mqttTopicMatches("meter/+", "meter/l1/power"))
+	assert.False(t, mqttTopicMatches("meter/l1/power", "meter/l2/power"))
+}
+
+func TestParseMqttEntity(t *testing.T) {
+	binding, ok := parseMqttEntity("mqtt:tele/meter/SENSOR|ENERGY.Current|A")
+	assert.True(t, ok)
+	assert.Equal(t, mqttBinding{topic: "tele/meter/SENSOR", field: "ENERGY.Current", unit: "A"}, binding)
+
+	value, err := binding.value([]byte(`{"ENERGY":{"Current":7.5}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 7.5, value)
+
+	_, ok = parseMqttEntity("sensor.current_phase_1")
+	assert.False(t, ok)
+}
+
+func TestHaService_MqttSubscribeAndCommand(t *testing.T) {
+	broker := newMqttTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := newMqttClient(ctx, broker.listener.Addr().String(), "test", "", "")
+	ha := &haService{context: ctx}
+	ha.setMqtt(client, "homeassistant", "electricity", true)
+
+	channel := make(chan *gohaws.Message, 10)
+	ha.subscribeMulti([]string{"mqtt:meter/l1|current|A"}, channel)
+	waitForMqtt(t, client)
+	assert.Eventually(t, func() bool { return broker.subscribed("meter/l1") }, 2*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, client.publish("meter/l1", []byte(`{"current":12.5}`), false))
+	select {
+	case msg := <-channel:
+		assert.Equal(t, "mqtt:meter/l1|current|A", msg.Event.Data.EntityID)
+		assert.Equal(t, 12.5, msg.Event.Data.NewState.State)
+		assert.Equal(t, "A", msg.Event.Data.NewState.UnitOfMeasurement)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message delivered")
+	}
+
+	ha.updateAmpsDawn(10, "mqtt:charger/set")
+	ha.setDawnSwitch(false, "mqtt:charger/switch|state")
+	assert.Eventually(t, func() bool { return len(broker.messages()) == 3 }, 2*time.Second, 10*time.Millisecond)
+	messages := broker.messages()
+	assert.Equal(t, mqttTestMessage{"charger/set", "10", false}, messages[1])
+	assert.Equal(t, mqttTestMessage{"charger/switch", `{"state":"OFF"}`, false}, messages[2])
+}
+
+func TestHaService_MqttPublishStateWithDiscovery(t *testing.T) {
+	broker := newMqttTestBroker(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	client := newMqttClient(ctx, broker.listener.Addr().String(), "test", "", "")
+	ha := &haService{context: ctx}
+	ha.setMqtt(client, "homeassistant", "electricity", true)
+	waitForMqtt(t, client)
+
+	attributes := map[string]interface{}{"unit_of_measurement": "A", "friendly_name": "Phase imbalance"}
+	assert.NoError(t, ha.publishState("sensor.electricity_phase_imbalance", "3.5", attributes))
+	assert.NoError(t, ha.publishState("sensor.electricity_phase_imbalance", "4.0", attributes))
+
+	assert.Eventually(t, func() bool { return len(broker.messages()) == 5 }, 2*time.Second, 10*time.Millisecond)
+	messages := broker.messages()
+
+	config := messages[0]
+	assert.Equal(t, "homeassistant/sensor/electricity_phase_imbalance/config", config.topic)
+	assert.True(t, config.retain)
+	var discovery map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(config.payload), &discovery))
+	assert.Equal(t, "electricity/electricity_phase_imbalance/state", discovery["state_topic"])
+	assert.Equal(t, "A", discovery["unit_of_measurement"])
+	assert.Equal(t, "Phase imbalance", discovery["name"])
+
+	assert.Equal(t, mqttTestMessage{"electricity/electricity_phase_imbalance/state", "3.5", true}, messages[2])
+	assert.Equal(t, mqttTestMessage{"electricity/electricity_phase_imbalance/state", "4.0", true}, messages[4])
+}
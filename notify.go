@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tuomaz/gohaws"
+)
+
+// NotificationSeverity orders notifications. Critical ones bypass quiet hours
+// and rate limits.
+type NotificationSeverity int
+
+const (
+	SeverityInfo NotificationSeverity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s NotificationSeverity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return "info"
+	}
+}
+
+// NotificationType identifies what a notification is about. Rate limits are
+// kept per type.
+type NotificationType string
+
+const (
+	NotifyStartup       NotificationType = "startup"
+	NotifyEmergencyStop NotificationType = "emergency_stop"
+	NotifyChargerFault  NotificationType = "charger_fault"
+	NotifyPvCharging    NotificationType = "pv_charging"
+	NotifyHaLink        NotificationType = "ha_link"
+	NotifyDailySummary  NotificationType = "daily_summary"
+	NotifyConfiguration NotificationType = "configuration"
+	NotifyReport        NotificationType = "report"
+	NotifyPriceCharging NotificationType = "price_charging"
+)
+
+// defaultRateLimits is the minimum time between two notifications of a type.
+// Charger faults and HA link changes are only raised on transitions, so their
+// recovery messages are not limited by default.
+var defaultRateLimits = map[NotificationType]time.Duration{
+	NotifyPvCharging:    10 * time.Minute,
+	NotifyPriceCharging: 10 * time.Minute,
+	NotifyConfiguration: time.Hour,
+}
+
+// Actions offered on notifications. The HA companion app reports the chosen
+// action as a mobile_app_notification_action event.
+const (
+	ActionResumeCharging = "ELECTRICITY_RESUME_CHARGING"
+	ActionStopCharging   = "ELECTRICITY_STOP_CHARGING"
+)
+
+type notificationAction struct {
+	Action string `json:"action"`
+	Title  string `json:"title"`
+}
+
+type notification struct {
+	Type     NotificationType     `json:"type"`
+	Severity NotificationSeverity `json:"-"`
+	Title    string               `json:"title"`
+	Message  string               `json:"message"`
+	Actions  []notificationAction `json:"actions,omitempty"`
+	Time     time.Time            `json:"time"`
+}
+
+type notificationTarget interface {
+	send(n notification) error
+}
+
+// haNotifyTarget sends through an HA notify service. Actions are only
+// attached for the companion app.
+type haNotifyTarget struct {
+	ha      *haService
+	service string
+}
+
+func (t *haNotifyTarget) send(n notification) error {
+	if t.ha.client == nil {
+		return fmt.Errorf("HA not connected")
+	}
+	data := map[string]interface{}{"title": n.Title, "message": n.Message}
+	if len(n.Actions) > 0 && strings.HasPrefix(t.service, "mobile_app_") {
+		data["data"] = map[string]interface{}{"actions": n.Actions}
+	}
+	return t.ha.callService("notify", t.service, data, "")
+}
+
+// webhookTarget posts the notification as JSON.
+type webhookTarget struct {
+	url    string
+	client *http.Client
+}
+
+func (t *webhookTarget) send(n notification) error {
+	body, err := json.Marshal(struct {
+		notification
+		Severity string `json:"severity"`
+	}{n, n.Severity.String()})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// smtpTarget mails through a local relay without authentication.
+type smtpTarget struct {
+	address string
+	from    string
+	to      []string
+}
+
+func (t *smtpTarget) send(n notification) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", t.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(t.to, ", "))
+	fmt.Fprintf(&msg, "Subject: [%s] %s\r\n", n.Severity, n.Title)
+	fmt.Fprintf(&msg, "Date: %s\r\n", n.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(n.Message)
+	msg.WriteString("\r\n")
+	return smtp.SendMail(t.address, nil, t.from, t.to, msg.Bytes())
+}
+
+// quietHours is a daily window, possibly spanning midnight, in minutes since
+// midnight local time.
+type quietHours struct {
+	start, end int
+}
+
+func parseQuietHours(s string) (*quietHours, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("expected HH:MM-HH:MM, got %q", s)
+	}
+	start, err := time.Parse("15:04", strings.TrimSpace(from))
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse("15:04", strings.TrimSpace(to))
+	if err != nil {
+		return nil, err
+	}
+	return &quietHours{start.Hour()*60 + start.Minute(), end.Hour()*60 + end.Minute()}, nil
+}
+
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return minute >= q.start && minute < q.end
+	}
+	return minute >= q.start || minute < q.end
+}
+
+// parseRateLimits reads "type=duration,type=duration" over the defaults.
+func parseRateLimits(s string) (map[NotificationType]time.Duration, error) {
+	limits := make(map[NotificationType]time.Duration)
+	for kind, limit := range defaultRateLimits {
+		limits[kind] = limit
+	}
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		kind, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, expected type=duration", entry)
+		}
+		limit, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		limits[NotificationType(strings.TrimSpace(kind))] = limit
+	}
+	return limits, nil
+}
+
+// notifier fans notifications out to its targets, dropping those within a
+// type's rate limit or during quiet hours unless they are critical.
+type notifier struct {
+	targets    []notificationTarget
+	rateLimits map[NotificationType]time.Duration
+	quiet      *quietHours
+	now        func() time.Time
+
+	mu       sync.Mutex
+	lastSent map[NotificationType]time.Time
+	counts   map[NotificationType]int // events since the last daily summary
+	actions  map[string]func()
+}
+
+func newNotifier(targets []notificationTarget, rateLimits map[NotificationType]time.Duration, quiet *quietHours) *notifier {
+	return &notifier{
+		targets:    targets,
+		rateLimits: rateLimits,
+		quiet:      quiet,
+		now:        time.Now,
+		lastSent:   make(map[NotificationType]time.Time),
+		counts:     make(map[NotificationType]int),
+		actions:    make(map[string]func()),
+	}
+}
+
+// notify sends a notification and reports whether it went out.
+func (n *notifier) notify(kind NotificationType, severity NotificationSeverity, message string, actions ...notificationAction) bool {
+	now := n.now()
+
+	n.mu.Lock()
+	n.counts[kind]++
+	if severity < SeverityCritical {
+		if n.quiet.contains(now) {
+			n.mu.Unlock()
+			log.Printf("NOTIFY: quiet hours, dropping %s: %s", kind, message)
+			return false
+		}
+		if limit := n.rateLimits[kind]; limit > 0 && now.Sub(n.lastSent[kind]) < limit {
+			n.mu.Unlock()
+			log.Printf("NOTIFY: rate limited, dropping %s: %s", kind, message)
+			return false
+		}
+	}
+	n.lastSent[kind] = now
+	n.mu.Unlock()
+
+	title := "Electricity"
+	if severity > SeverityInfo {
+		title = fmt.Sprintf("Electricity %s", severity)
+	}
+	msg := notification{Type: kind, Severity: severity, Title: title, Message: message, Actions: actions, Time: now}
+	for _, target := range n.targets {
+		go func(target notificationTarget) {
+			if err := target.send(msg); err != nil {
+				log.Printf("NOTIFY: %T failed: %v", target, err)
+			}
+		}(target)
+	}
+	return true
+}
+
+// onAction registers the handler for a notification action.
+func (n *notifier) onAction(action string, handler func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.actions[action] = handler
+}
+
+// handleAction runs the handler of an action reported as "ACTION" or
+// "ACTION|anything", the suffix making repeated presses change the state.
+func (n *notifier) handleAction(value string) {
+	action, _, _ := strings.Cut(strings.TrimSpace(value), "|")
+	n.mu.Lock()
+	handler, ok := n.actions[action]
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+	log.Printf("NOTIFY: running action %s", action)
+	handler()
+}
+
+// listenActions follows the HA entity an automation writes the chosen
+// notification action to. gohaws only delivers state changes, so the
+// mobile_app_notification_action event is routed through that entity.
+func (n *notifier) listenActions(ctx context.Context, ha *haService, entity string) {
+	channel := make(chan *gohaws.Message, 10)
+	ha.subscribe(entity, channel)
+	go func() {
+		last, seeded := "", false
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-channel:
+				if message.Event.Data.NewState == nil {
+					continue
+				}
+				value := fmt.Sprintf("%v", message.Event.Data.NewState.State)
+				// The state injected on (re)connect is an old action
+				if seeded && value != last {
+					n.handleAction(value)
+				}
+				last, seeded = value, true
+			}
+		}
+	}()
+}
+
+// dailySummary sends the number of events per type since the last summary,
+// including those dropped, together with the extra lines given.
+func (n *notifier) dailySummary(lines ...string) {
+	n.mu.Lock()
+	var parts []string
+	for _, kind := range []NotificationType{NotifyEmergencyStop, NotifyChargerFault, NotifyPvCharging, NotifyPriceCharging, NotifyHaLink, NotifyConfiguration} {
+		if count := n.counts[kind]; count > 0 {
+			parts = append(parts, fmt.Sprintf("%s: %d", kind, count))
+		}
+	}
+	n.counts = make(map[NotificationType]int)
+	n.mu.Unlock()
+
+	if len(parts) == 0 {
+		parts = append(parts, "no events")
+	}
+	message := strings.Join(append(lines, "Events: "+strings.Join(parts, ", ")), "\n")
+	n.notify(NotifyDailySummary, SeverityInfo, message)
+}
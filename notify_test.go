@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingTarget struct {
+	sent chan notification
+}
+
+func (r *recordingTarget) send(n notification) error {
+	r.sent <- n
+	return nil
+}
+
+func newTestNotifier(now *time.Time, quiet *quietHours) (*notifier, *recordingTarget) {
+	target := &recordingTarget{sent: make(chan notification, 10)}
+	limits, _ := parseRateLimits("pv_charging=10m")
+	n := newNotifier([]notificationTarget{target}, limits, quiet)
+	n.now = func() time.Time { return *now }
+	return n, target
+}
+
+func TestQuietHours(t *testing.T) {
+	quiet, err := parseQuietHours("22:00-07:00")
+	assert.NoError(t, err)
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)
+	assert.True(t, quiet.contains(day.Add(23*time.Hour)))
+	assert.True(t, quiet.contains(day.Add(6*time.Hour+59*time.Minute)))
+	assert.False(t, quiet.contains(day.Add(7*time.Hour)))
+	assert.False(t, quiet.contains(day.Add(12*time.Hour)))
+
+	none, err := parseQuietHours("")
+	assert.NoError(t, err)
+	assert.False(t, none.contains(day))
+
+	_, err = parseQuietHours("22:00")
+	assert.Error(t, err)
+}
+
+func TestNotifier_RateLimitAndQuietHours(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	quiet, _ := parseQuietHours("22:00-07:00")
+	n, _ := newTestNotifier(&now, quiet)
+
+	assert.True(t, n.notify(NotifyPvCharging, SeverityInfo, "PV charging started"))
+	now = now.Add(5 * time.Minute)
+	assert.False(t, n.notify(NotifyPvCharging, SeverityInfo, "PV charging stopped"), "within the type's rate limit")
+	assert.True(t, n.notify(NotifyChargerFault, SeverityWarning, "charger not responding"), "other types are not limited")
+
+	now = time.Date(2024, 5, 1, 23, 0, 0, 0, time.Local)
+	assert.False(t, n.notify(NotifyChargerFault, SeverityWarning, "charger not responding"), "quiet hours")
+	assert.True(t, n.notify(NotifyEmergencyStop, SeverityCritical, "emergency stop"), "critical bypasses quiet hours")
+	assert.True(t, n.notify(NotifyEmergencyStop, SeverityCritical, "emergency stop again"))
+}
+
+func TestNotifier_DailySummaryCountsEvents(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	n, target := newTestNotifier(&now, nil)
+
+	n.notify(NotifyPvCharging, SeverityInfo, "PV charging started")
+	n.notify(NotifyPvCharging, SeverityInfo, "PV charging stopped")
+	<-target.sent
+	now = now.Add(time.Hour)
+	n.dailySummary("Charge state: idle")
+
+	summary := <-target.sent
+	assert.Equal(t, NotifyDailySummary, summary.Type)
+	assert.True(t, strings.HasPrefix(summary.Message, "Charge state: idle\n"))
+	assert.Contains(t, summary.Message, "pv_charging: 2")
+}
+
+func TestNotifier_Actions(t *testing.T) {
+	now := time.Now()
+	n, _ := newTestNotifier(&now, nil)
+	resumed := 0
+	n.onAction(ActionResumeCharging, func() { resumed++ })
+
+	n.handleAction("ELECTRICITY_RESUME_CHARGING|1714557600.12")
+	n.handleAction("SOMETHING_ELSE")
+	assert.Equal(t, 1, resumed)
+}
+
+func TestWebhookTarget(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	target := &webhookTarget{url: server.URL, client: server.Client()}
+	err := target.send(notification{Type: NotifyEmergencyStop, Severity: SeverityCritical, Title: "Electricity critical", Message: "stop",
+		Actions: []notificationAction{{Action: ActionResumeCharging, Title: "Resume charging"}}})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "emergency_stop", body["type"])
+	assert.Equal(t, "critical", body["severity"])
+	assert.Len(t, body["actions"], 1)
+}
+
+func TestDawnConsumer_StopAndResumeOnRequest(t *testing.T) {
+	tc := &dawnConsumerService{
+		haService:          &haService{},
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        10,
+		setpoint:           20,
+		isCharging:         true,
+		currents:           map[string]float64{"phase1": 5, "phase2": 5, "phase3": 5},
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		pid:                &PIDController{Kp: 0.4, Ki: 0.01, Kd: 0.05, Setpoint: 20},
+	}
+
+	tc.stopChargingOnRequest()
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.isCharging, "a stop on request must not be undone by the headroom start")
+
+	tc.resumeCharging()
+	assert.True(t, tc.isCharging)
+	assert.Equal(t, 6.0, tc.currentAmps)
+	state, _, _ := tc.charge.current()
+	assert.Equal(t, ChargeStarting, state)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// p1Telegram holds the per-phase values of one DSMR P1 telegram.
+type p1Telegram struct {
+	currents map[int]float64 // A
+	imports  map[int]float64 // kW
+	exports  map[int]float64 // kW
+	voltages map[int]float64 // V
+}
+
+// p1Obis maps the DSMR 5 per-phase OBIS codes to a sensor type and phase.
+var p1Obis = map[string]sensorBinding{
+	"1-0:31.7.0": {SensorTypeCurrent, 1},
+	"1-0:51.7.0": {SensorTypeCurrent, 2},
+	"1-0:71.7.0": {SensorTypeCurrent, 3},
+	"1-0:21.7.0": {SensorTypeImport, 1},
+	"1-0:41.7.0": {SensorTypeImport, 2},
+	"1-0:61.7.0": {SensorTypeImport, 3},
+	"1-0:22.7.0": {SensorTypeExport, 1},
+	"1-0:42.7.0": {SensorTypeExport, 2},
+	"1-0:62.7.0": {SensorTypeExport, 3},
+	"1-0:32.7.0": {SensorTypeVoltage, 1},
+	"1-0:52.7.0": {SensorTypeVoltage, 2},
+	"1-0:72.7.0": {SensorTypeVoltage, 3},
+}
+
+var p1Line = regexp.MustCompile(`^(\d+-\d+:\d+\.\d+\.\d+)\(([^)]*)\)`)
+
+// p1CRC computes the CRC16/ARC checksum DSMR uses over the telegram, from
+// the leading '/' up to and including the '!'.
+func p1CRC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// parseP1Telegram validates and parses a raw telegram, including the
+// trailing "!CRC" line. DSMR versions before 4 have no CRC; those telegrams
+// are accepted unchecked.
+func parseP1Telegram(raw []byte) (*p1Telegram, error) {
+	start := bytes.IndexByte(raw, '/')
+	end := bytes.LastIndexByte(raw, '!')
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("p1: incomplete telegram")
+	}
+
+	crcText := strings.TrimSpace(string(raw[end+1:]))
+	if crcText != "" {
+		expected, err := strconv.ParseUint(crcText, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("p1: invalid CRC %q", crcText)
+		}
+		if actual := p1CRC(raw[start : end+1]); uint16(expected) != actual {
+			return nil, fmt.Errorf("p1: CRC mismatch, telegram says %04X, computed %04X", expected, actual)
+		}
+	}
+
+	telegram := &p1Telegram{
+		currents: make(map[int]float64),
+		imports:  make(map[int]float64),
+		exports:  make(map[int]float64),
+		voltages: make(map[int]float64),
+	}
+	for _, line := range strings.Split(string(raw[start:end]), "\n") {
+		match := p1Line.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		binding, ok := p1Obis[match[1]]
+		if !ok {
+			continue
+		}
+		number := strings.SplitN(match[2], "*", 2)[0]
+		value, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("p1: invalid value for %s: %q", match[1], match[2])
+		}
+		switch binding.sensorType {
+		case SensorTypeCurrent:
+			telegram.currents[binding.phaseIndex] = value
+		case SensorTypeImport:
+			telegram.imports[binding.phaseIndex] = value
+		case SensorTypeExport:
+			telegram.exports[binding.phaseIndex] = value
+		case SensorTypeVoltage:
+			telegram.voltages[binding.phaseIndex] = value
+		}
+	}
+	return telegram, nil
+}
+
+// readP1Telegrams splits a P1 byte stream into telegrams and hands every
+// valid one to handle. It returns when the reader fails.
+func readP1Telegrams(r io.Reader, handle func(*p1Telegram)) error {
+	reader := bufio.NewReader(r)
+	var buf []byte
+	inTelegram := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[0] == '/' {
+				buf = buf[:0]
+				inTelegram = true
+			}
+			if inTelegram {
+				buf = append(buf, line...)
+				if line[0] == '!' {
+					inTelegram = false
+					telegram, perr := parseP1Telegram(buf)
+					if perr != nil {
+						log.Printf("P1: dropping telegram: %v", perr)
+					} else {
+						handle(telegram)
+					}
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// events turns a telegram into power events in the same units as the HA
+// path: amps for current, import and export, volts for voltage.
+func (t *p1Telegram) events(topology PhaseTopology) []*powerEvent {
+	var events []*powerEvent
+	for _, phase := range topology.phases() {
+		voltage, ok := t.voltages[phase]
+		if ok {
+			events = append(events, &powerEvent{sensorType: SensorTypeVoltage, phase: "p1", phaseIndex: phase, value: voltage})
+		}
+		if voltage < topology.nominalVoltage()*0.5 {
+			voltage = topology.nominalVoltage()
+		}
+		// Only the active direction: an export reading clears the import
+		// current and the other way around. An idle phase reports both as zero.
+		imported, hasImport := t.imports[phase]
+		exported, hasExport := t.exports[phase]
+		if hasImport && (imported > 0 || exported <= 0) {
+			events = append(events, &powerEvent{sensorType: SensorTypeImport, phase: "p1", phaseIndex: phase, value: imported * 1000.0 / voltage})
+		}
+		if hasExport && (exported > 0 || imported <= 0) {
+			events = append(events, &powerEvent{sensorType: SensorTypeExport, phase: "p1", phaseIndex: phase, value: exported * 1000.0 / voltage})
+		}
+		if amps, ok := t.currents[phase]; ok {
+			events = append(events, &powerEvent{sensorType: SensorTypeCurrent, phase: "p1", phaseIndex: phase, value: amps})
+		}
+	}
+	return events
+}
+
+// runP1 reads telegrams from a serial device or a TCP serial bridge and
+// reconnects on failure. The serial device must already be configured
+// (115200 8N1 for DSMR 5), e.g. with stty.
+func (ps *PowerService) runP1(device string, address string) {
+	source := device
+	if address != "" {
+		source = address
+	}
+	for {
+		var conn io.ReadCloser
+		var err error
+		if address != "" {
+			conn, err = net.DialTimeout("tcp", address, 10*time.Second)
+		} else {
+			conn, err = os.Open(device)
+		}
+
+		if err != nil {
+			log.Printf("P1: could not open %s: %v, retrying in 5 seconds...", source, err)
+		} else {
+			log.Printf("P1: reading telegrams from %s", source)
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ps.ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			err = readP1Telegrams(conn, func(telegram *p1Telegram) {
+				ps.sendReadings(telegram.events(ps.topology))
+			})
+			close(done)
+			conn.Close()
+			log.Printf("P1: connection lost: %v, retrying in 5 seconds...", err)
+		}
+
+		select {
+		case <-ps.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// DSMR 5.0 telegram in the ISKRA AM550 layout, with phase 3 exporting.
+const p1TestTelegram = "/ISK5\\2M550T-1012\r\n" +
+	"\r\n" +
+	"1-3:0.2.8(50)\r\n" +
+	"0-0:1.0.0(230101120000W)\r\n" +
+	"0-0:96.1.1(4530303434303037313331363530373138)\r\n" +
+	"1-0:1.8.1(001581.123*kWh)\r\n" +
+	"1-0:1.7.0(01.193*kW)\r\n" +
+	"1-0:2.7.0(00.000*kW)\r\n" +
+	"1-0:32.7.0(229.0*V)\r\n" +
+	"1-0:52.7.0(230.0*V)\r\n" +
+	"1-0:72.7.0(231.0*V)\r\n" +
+	"1-0:31.7.0(003*A)\r\n" +
+	"1-0:51.7.0(002*A)\r\n" +
+	"1-0:71.7.0(006*A)\r\n" +
+	"1-0:21.7.0(00.687*kW)\r\n" +
+	"1-0:41.7.0(00.506*kW)\r\n" +
+	"1-0:61.7.0(00.000*kW)\r\n" +
+	"1-0:22.7.0(00.000*kW)\r\n" +
+	"1-0:42.7.0(00.000*kW)\r\n" +
+	"1-0:62.7.0(01.380*kW)\r\n" +
+	"!ED83\r\n"
+
+func TestP1CRC(t *testing.T) {
+	// CRC-16/ARC check value
+	assert.Equal(t, uint16(0xBB3D), p1CRC([]byte("123456789")))
+}
+
+func TestParseP1Telegram(t *testing.T) {
+	telegram, err := parseP1Telegram([]byte(p1TestTelegram))
+	assert.NoError(t, err)
+
+	assert.Equal(t, map[int]float64{1: 3, 2: 2, 3: 6}, telegram.currents)
+	assert.Equal(t, map[int]float64{1: 0.687, 2: 0.506, 3: 0}, telegram.imports)
+	assert.Equal(t, 1.38, telegram.exports[3])
+	assert.Equal(t, 229.0, telegram.voltages[1])
+
+	// A flipped digit must be caught by the CRC
+	corrupt := strings.Replace(p1TestTelegram, "00.687", "00.787", 1)
+	_, err = parseP1Telegram([]byte(corrupt))
+	assert.Error(t, err)
+}
+
+func TestP1Telegram_Events(t *testing.T) {
+	telegram, err := parseP1Telegram([]byte(p1TestTelegram))
+	assert.NoError(t, err)
+
+	var export3 *powerEvent
+	events := telegram.events(TopologyThreePhase)
+	for _, e := range events {
+		if e.sensorType == SensorTypeExport && e.phaseIndex == 3 {
+			export3 = e
+		}
+	}
+	assert.NotNil(t, export3)
+	assert.InDelta(t, 1380.0/231.0, export3.value, 0.001, "Uses the telegram's own voltage")
+	assert.Equal(t, SensorTypeVoltage, events[0].sensorType, "Voltage comes first so later conversions use it")
+
+	// Only the active direction of each phase
+	for _, e := range events {
+		if e.sensorType == SensorTypeExport {
+			assert.Equal(t, 3, e.phaseIndex)
+		}
+		if e.sensorType == SensorTypeImport {
+			assert.NotEqual(t, 3, e.phaseIndex)
+		}
+	}
+
+	// A single-phase installation only reports phase 1
+	for _, e := range telegram.events(TopologySinglePhase) {
+		assert.Equal(t, 1, e.phaseIndex)
+	}
+}
+
+func TestP1Telegram_ConsumerCurrents(t *testing.T) {
+	telegram, err := parseP1Telegram([]byte(p1TestTelegram))
+	assert.NoError(t, err)
+	service := &dawnConsumerService{
+		currents:           make(map[string]float64),
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+	}
+	for _, e := range telegram.events(TopologyThreePhase) {
+		service.updateCurrents(e)
+	}
+
+	assert.InDelta(t, 687.0/229.0, service.currents["phase1"], 0.001)
+	assert.InDelta(t, 506.0/230.0, service.currents["phase2"], 0.001)
+	assert.Equal(t, 0.0, service.currents["phase3"])
+	assert.InDelta(t, 1380.0/231.0, service.exports["phase3"], 0.001)
+	assert.Equal(t, 0.0, service.exports["phase1"])
+}
+
+func TestReadP1Telegrams(t *testing.T) {
+	// Start mid-telegram, then one good, one corrupt and one good telegram.
+	stream := "1-0:62.7.0(01.380*kW)\r\n!ED83\r\n" +
+		p1TestTelegram +
+		strings.Replace(p1TestTelegram, "006*A", "007*A", 1) +
+		p1TestTelegram
+
+	count := 0
+	err := readP1Telegrams(strings.NewReader(stream), func(*p1Telegram) { count++ })
+	assert.True(t, errors.Is(err, io.EOF))
+	assert.Equal(t, 2, count)
+}
+
+func TestPowerService_P1OverTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(p1TestTelegram))
+		time.Sleep(time.Second)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *event, 20)
+	newPowerService(ctx, events, &haService{}, nil, TopologyThreePhase, 20, p1Source{address: listener.Addr().String()}, modbusSource{})
+
+	received := 0
+	// Voltage, one direction and current per phase
+	for received < 9 {
+		select {
+		case <-events:
+			received++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected 9 events from one telegram, got %d", received)
+		}
+	}
+}
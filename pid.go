@@ -1,21 +1,37 @@
 package main
 
 import (
+	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// defaultIntegralLimit clamps the integral when no limit is configured.
+const defaultIntegralLimit = 50.0
+
 // PIDController handles the math for smooth load balancing
 type PIDController struct {
-	Kp, Ki, Kd float64
-	Setpoint   float64
-	Integral   float64
-	LastError  float64
-	LastTime   time.Time
+	Kp, Ki, Kd       float64
+	Setpoint         float64
+	Integral         float64
+	LastError        float64
+	LastTime         time.Time
+	IntegralLimit    float64 // 0 uses defaultIntegralLimit
+	Deadband         float64 // errors within the deadband leave the output at 0
+	RateLimit        float64 // largest output of one update, 0 is unlimited
+	DerivativeFilter float64 // time constant in s of the derivative low pass, 0 is unfiltered
+	Derivative       float64 // filtered rate of change of the error
+	primed           bool    // LastError holds a sample to differentiate against
 }
 
+// Update runs the controller with the time since the previous call as dt.
 func (p *PIDController) Update(measurement float64) float64 {
-	now := time.Now()
+	return p.updateAt(measurement, time.Now())
+}
+
+func (p *PIDController) updateAt(measurement float64, now time.Time) float64 {
 	if p.LastTime.IsZero() {
 		p.LastTime = now
 		return 0
@@ -26,9 +42,27 @@ func (p *PIDController) Update(measurement float64) float64 {
 	if dt < 0.1 {
 		return 0
 	}
+	p.LastTime = now
+	return p.UpdateWithDt(measurement, dt)
+}
+
+// UpdateWithDt runs the controller on a sample taken dt seconds after the
+// previous one. The fixed-rate control loop uses it, so the output does not
+// depend on how often the meter reports.
+func (p *PIDController) UpdateWithDt(measurement float64, dt float64) float64 {
+	if dt <= 0 {
+		return 0
+	}
 
 	error := p.Setpoint - measurement
 
+	// Close enough: no change, and nothing for the integral to wind up on
+	if math.Abs(error) < p.Deadband {
+		p.LastError = error
+		p.primed = true
+		return 0
+	}
+
 	// Proportional term
 	P := p.Kp * error
 
@@ -38,18 +72,123 @@ func (p *PIDController) Update(measurement float64) float64 {
 	}
 
 	// Clamp integral to prevent massive windup
-	if p.Integral > 50 {
-		p.Integral = 50
-	} else if p.Integral < -50 {
-		p.Integral = -50
-	}
+	p.clampIntegral()
 	I := p.Ki * p.Integral
 
-	// Derivative term
-	D := p.Kd * (error - p.LastError) / dt
+	// Derivative term, low pass filtered so a single spiky sample does not
+	// kick the output. The first sample has nothing to differentiate against.
+	derivative := 0.0
+	if p.primed {
+		derivative = (error - p.LastError) / dt
+	}
+	if p.DerivativeFilter > 0 {
+		p.Derivative += dt / (p.DerivativeFilter + dt) * (derivative - p.Derivative)
+	} else {
+		p.Derivative = derivative
+	}
+	D := p.Kd * p.Derivative
 
 	p.LastError = error
-	p.LastTime = now
+	p.primed = true
+
+	output := P + I + D
+	if p.RateLimit > 0 {
+		output = math.Max(-p.RateLimit, math.Min(p.RateLimit, output))
+	}
+	return output
+}
+
+// Reset forgets the integral and the previous sample, e.g. when the control
+// mode changes.
+func (p *PIDController) Reset() {
+	p.Integral = 0
+	p.LastError = 0
+	p.LastTime = time.Time{}
+	p.Derivative = 0
+	p.primed = false
+}
+
+func (p *PIDController) clampIntegral() {
+	limit := p.IntegralLimit
+	if limit <= 0 {
+		limit = defaultIntegralLimit
+	}
+	if p.Integral > limit {
+		p.Integral = limit
+	} else if p.Integral < -limit {
+		p.Integral = -limit
+	}
+}
+
+// apply switches the controller to a tuning. The integral is kept within the
+// new limit.
+func (p *PIDController) apply(t pidTuning) {
+	p.Kp, p.Ki, p.Kd = t.Kp, t.Ki, t.Kd
+	p.IntegralLimit = t.IntegralLimit
+	p.Deadband = t.Deadband
+	p.RateLimit = t.RateLimit
+	p.DerivativeFilter = t.DerivativeFilter
+	p.clampIntegral()
+}
+
+// pidTuning is the controller configuration of one control mode.
+type pidTuning struct {
+	Kp, Ki, Kd       float64
+	IntegralLimit    float64
+	Deadband         float64 // in the unit of the measurement, A
+	RateLimit        float64 // A per update
+	DerivativeFilter float64 // s
+}
+
+var defaultPIDTuning = pidTuning{Kp: 0.4, Ki: 0.01, Kd: 0.05, IntegralLimit: defaultIntegralLimit, DerivativeFilter: 60}
+
+// parsePIDTuning reads "kp=0.4,ki=0.01,kd=0.05,ilimit=50,deadband=0.2,rate=2,dfilter=60".
+// Parameters left out keep their value in base.
+func parsePIDTuning(s string, base pidTuning) (pidTuning, error) {
+	t := base
+	for _, part := range strings.Split(s, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return base, fmt.Errorf("invalid PID parameter %q, expected name=value", part)
+		}
+		v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || v < 0 {
+			return base, fmt.Errorf("invalid value %q for %s", value, name)
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "kp":
+			t.Kp = v
+		case "ki":
+			t.Ki = v
+		case "kd":
+			t.Kd = v
+		case "ilimit":
+			t.IntegralLimit = v
+		case "deadband":
+			t.Deadband = v
+		case "rate":
+			t.RateLimit = v
+		case "dfilter":
+			t.DerivativeFilter = v
+		default:
+			return base, fmt.Errorf("unknown PID parameter %q", name)
+		}
+	}
+	return t, nil
+}
+
+func (t pidTuning) String() string {
+	return fmt.Sprintf("kp=%g,ki=%g,kd=%g,ilimit=%g,deadband=%g,rate=%g,dfilter=%g", t.Kp, t.Ki, t.Kd, t.IntegralLimit, t.Deadband, t.RateLimit, t.DerivativeFilter)
+}
 
-	return P + I + D
+// pidConfig holds the tuning of each control mode, and the HA entities (e.g.
+// input_text) they can be changed through while running.
+type pidConfig struct {
+	fuse       pidTuning // normal mode, regulating the highest phase current
+	pv         pidTuning // PV-only mode, regulating the export
+	fuseEntity string
+	pvEntity   string
 }
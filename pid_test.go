@@ -63,3 +63,63 @@ func TestPIDController_Derivative(t *testing.T) {
 	pid.Update(18.0) 
 	assert.True(t, pid.LastError == 2.0)
 }
+
+func TestPIDController_Limits(t *testing.T) {
+	start := time.Now()
+	pid := &PIDController{Kp: 1.0, Ki: 1.0, Setpoint: 20.0, IntegralLimit: 5, Deadband: 0.5, RateLimit: 2}
+	pid.updateAt(19.8, start)
+
+	assert.Equal(t, 0.0, pid.updateAt(19.8, start.Add(30*time.Second)), "within the deadband")
+	assert.Equal(t, 0.0, pid.Integral, "no windup inside the deadband")
+
+	assert.Equal(t, 2.0, pid.updateAt(10.0, start.Add(60*time.Second)), "rate limited")
+	assert.Equal(t, 5.0, pid.Integral, "integral clamped to the configured limit")
+
+	pid.apply(pidTuning{Kp: 0.5, IntegralLimit: 2})
+	assert.Equal(t, 2.0, pid.Integral, "a lower limit clamps the integral at once")
+	assert.Equal(t, 0.0, pid.RateLimit)
+	assert.Equal(t, 0.5, pid.Kp)
+}
+
+func TestParsePIDTuning(t *testing.T) {
+	tuning, err := parsePIDTuning("kp=0.6, ki=0.02,deadband=0.5,rate=3", defaultPIDTuning)
+	assert.NoError(t, err)
+	assert.Equal(t, pidTuning{Kp: 0.6, Ki: 0.02, Kd: 0.05, IntegralLimit: 50, Deadband: 0.5, RateLimit: 3, DerivativeFilter: 60}, tuning)
+
+	tuning, err = parsePIDTuning("", defaultPIDTuning)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultPIDTuning, tuning)
+
+	roundTrip, err := parsePIDTuning(tuning.String(), pidTuning{})
+	assert.NoError(t, err)
+	assert.Equal(t, tuning, roundTrip)
+
+	for _, invalid := range []string{"kp", "kp=fast", "ki=-1", "gain=1"} {
+		_, err := parsePIDTuning(invalid, defaultPIDTuning)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPIDController_UpdateWithDt(t *testing.T) {
+	pid := &PIDController{Kp: 1.0, Ki: 0.1, Kd: 10.0, Setpoint: 20.0, IntegralLimit: 1000}
+
+	// The first sample acts at once, without a derivative kick
+	assert.InDelta(t, 2.0+0.1*2*30, pid.UpdateWithDt(18.0, 30), 1e-9)
+	assert.Equal(t, 0.0, pid.UpdateWithDt(18.0, 0), "no time has passed")
+
+	// Unfiltered, a 3A drop within 30s adds 10 * 3/30
+	pid.Integral = 0
+	assert.InDelta(t, 5.0+0.1*5*30+1.0, pid.UpdateWithDt(15.0, 30), 1e-9)
+
+	// Filtered over 30s, half of the rate comes through in the first period
+	filtered := &PIDController{Kd: 10.0, Setpoint: 20.0, DerivativeFilter: 30}
+	filtered.UpdateWithDt(18.0, 30)
+	assert.InDelta(t, 0.5, filtered.UpdateWithDt(15.0, 30), 1e-9)
+	assert.InDelta(t, 0.25, filtered.UpdateWithDt(15.0, 30), 1e-9, "and decays once the error is steady")
+
+	filtered.Integral = 3
+	filtered.Reset()
+	assert.Equal(t, 0.0, filtered.Integral)
+	assert.Equal(t, 0.0, filtered.Derivative)
+	assert.Equal(t, 0.0, filtered.UpdateWithDt(10.0, 30), "no derivative after a reset")
+}
@@ -9,52 +9,89 @@ import (
 	"github.com/tuomaz/gohaws"
 )
 
+// phaseSensors holds the HA entities reporting on a single phase. Empty IDs
+// are not subscribed.
+type phaseSensors struct {
+	current     string
+	export      string
+	import_     string
+	voltage     string
+	powerFactor string
+}
+
+type sensorBinding struct {
+	sensorType SensorType
+	phaseIndex int
+}
+
 type PowerService struct {
 	ctx      context.Context
-	phase1   string
-	phase2   string
-	phase3   string
-	export1  string
-	export2  string
-	export3  string
-	import1  string
-	import2  string
-	import3  string
-	voltage1 string
-	voltage2 string
-	voltage3 string
+	sensors  map[string]sensorBinding
+	topology PhaseTopology
 	max      float64
 
 	haChannel    chan *gohaws.Message
 	eventChannel chan *event
 	voltages     map[int]float64
+	powerFactors map[int]float64
+	badUnits     map[string]bool
+	readings     chan []*powerEvent // readings from the direct (non-HA) sources
+}
+
+// p1Source configures the optional DSMR P1 reader. Either a serial device or
+// the host:port of a TCP serial bridge is set.
+type p1Source struct {
+	device  string
+	address string
 }
 
-func newPowerService(ctx context.Context, eventChannel chan *event, ha *haService, phase1 string, phase2 string, phase3 string, export1 string, export2 string, export3 string, import1 string, import2 string, import3 string, voltage1 string, voltage2 string, voltage3 string, max float64) *PowerService {
+func newPowerService(ctx context.Context, eventChannel chan *event, ha *haService, phases []phaseSensors, topology PhaseTopology, max float64, p1 p1Source, modbus modbusSource) *PowerService {
 	haChannel := make(chan *gohaws.Message)
-	ha.subscribeMulti([]string{phase1, phase2, phase3, export1, export2, export3, import1, import2, import3, voltage1, voltage2, voltage3}, haChannel)
+
+	sensors := make(map[string]sensorBinding)
+	entities := make([]string, 0)
+	bind := func(entity string, sensorType SensorType, phaseIndex int) {
+		if entity == "" {
+			return
+		}
+		sensors[entity] = sensorBinding{sensorType: sensorType, phaseIndex: phaseIndex}
+		entities = append(entities, entity)
+	}
+	for i, phase := range phases {
+		if i >= topology.phaseCount() {
+			break
+		}
+		bind(phase.current, SensorTypeCurrent, i+1)
+		bind(phase.export, SensorTypeExport, i+1)
+		bind(phase.import_, SensorTypeImport, i+1)
+		bind(phase.voltage, SensorTypeVoltage, i+1)
+		bind(phase.powerFactor, SensorTypePowerFactor, i+1)
+	}
+	ha.subscribeMulti(entities, haChannel)
 
 	powerService := &PowerService{
 		ctx:          ctx,
 		eventChannel: eventChannel,
-		phase1:       phase1,
-		phase2:       phase2,
-		phase3:       phase3,
-		export1:      export1,
-		export2:      export2,
-		export3:      export3,
-		import1:      import1,
-		import2:      import2,
-		import3:      import3,
-		voltage1:     voltage1,
-		voltage2:     voltage2,
-		voltage3:     voltage3,
+		sensors:      sensors,
+		topology:     topology,
 		max:          max,
 		haChannel:    haChannel,
 		voltages:     make(map[int]float64),
+		powerFactors: make(map[int]float64),
+		badUnits:     make(map[string]bool),
+		readings:     make(chan []*powerEvent),
 	}
 
 	go powerService.run()
+	if p1.device != "" || p1.address != "" {
+		go powerService.runP1(p1.device, p1.address)
+	}
+	if modbus.meterAddress != "" {
+		go powerService.runModbusMeter(modbus)
+	}
+	if modbus.inverterAddress != "" {
+		go powerService.runModbusInverter(modbus)
+	}
 
 	return powerService
 }
@@ -65,92 +102,61 @@ Loop:
 		select {
 		case <-ps.ctx.Done():
 			break Loop
+		case readings := <-ps.readings:
+			for _, powerEvent := range readings {
+				if powerEvent.sensorType == SensorTypeVoltage {
+					ps.voltages[powerEvent.phaseIndex] = powerEvent.value
+				}
+				ps.emit(powerEvent)
+			}
 		case message, ok := <-ps.haChannel:
 			if ok {
-				value := parseFloat(message.Event.Data.NewState.State)
-
-				powerEvent := &powerEvent{
-					phase: message.Event.Data.EntityID,
-					value: value,
-				}
-
 				// Map to sensor type and phase index
-				recognized := false
-				switch message.Event.Data.EntityID {
-				case ps.phase1:
-					powerEvent.sensorType = SensorTypeCurrent
-					powerEvent.phaseIndex = 1
-					recognized = true
-				case ps.phase2:
-					powerEvent.sensorType = SensorTypeCurrent
-					powerEvent.phaseIndex = 2
-					recognized = true
-				case ps.phase3:
-					powerEvent.sensorType = SensorTypeCurrent
-					powerEvent.phaseIndex = 3
-					recognized = true
-				case ps.export1:
-					powerEvent.sensorType = SensorTypeExport
-					powerEvent.phaseIndex = 1
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(1)
-					recognized = true
-				case ps.export2:
-					powerEvent.sensorType = SensorTypeExport
-					powerEvent.phaseIndex = 2
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(2)
-					recognized = true
-				case ps.export3:
-					powerEvent.sensorType = SensorTypeExport
-					powerEvent.phaseIndex = 3
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(3)
-					recognized = true
-				case ps.import1:
-					powerEvent.sensorType = SensorTypeImport
-					powerEvent.phaseIndex = 1
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(1)
-					recognized = true
-				case ps.import2:
-					powerEvent.sensorType = SensorTypeImport
-					powerEvent.phaseIndex = 2
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(2)
-					recognized = true
-				case ps.import3:
-					powerEvent.sensorType = SensorTypeImport
-					powerEvent.phaseIndex = 3
-					powerEvent.value = (value * 1000.0) / ps.getVoltage(3)
-					recognized = true
-				case ps.voltage1:
-					ps.voltages[1] = value
-					powerEvent.sensorType = SensorTypeVoltage
-					powerEvent.phaseIndex = 1
-					recognized = true
-				case ps.voltage2:
-					ps.voltages[2] = value
-					powerEvent.sensorType = SensorTypeVoltage
-					powerEvent.phaseIndex = 2
-					recognized = true
-				case ps.voltage3:
-					ps.voltages[3] = value
-					powerEvent.sensorType = SensorTypeVoltage
-					powerEvent.phaseIndex = 3
-					recognized = true
-				}
-
+				binding, recognized := ps.sensors[message.Event.Data.EntityID]
 				if !recognized {
 					continue
 				}
 
-				if (powerEvent.sensorType == SensorTypeCurrent || powerEvent.sensorType == SensorTypeImport) && powerEvent.value > ps.max {
-					log.Printf("POWER: overcurrent! %.2f vs %.2f, phase %s (Type: %d)", powerEvent.value, ps.max, message.Event.Data.EntityID, powerEvent.sensorType)
-					powerEvent.overCurrent = powerEvent.value - ps.max
-				}
+				state := message.Event.Data.NewState
+				value := parseFloat(state.State)
+				unit := stateUnit(state)
 
+				powerEvent := &powerEvent{
+					sensorType: binding.sensorType,
+					phase:      message.Event.Data.EntityID,
+					value:      value,
+					phaseIndex: binding.phaseIndex,
+				}
 
-				event := &event{
-					powerEvent: powerEvent,
+				switch binding.sensorType {
+				case SensorTypeCurrent, SensorTypeExport, SensorTypeImport:
+					// Import/export sensors have historically been kW, current sensors A
+					defaultUnit := "kW"
+					if binding.sensorType == SensorTypeCurrent {
+						defaultUnit = "A"
+					}
+					powerFactor := ps.getPowerFactor(binding.phaseIndex)
+					if pf, ok := statePowerFactor(state); ok {
+						powerFactor = pf
+					}
+					amps, err := toAmps(value, unit, defaultUnit, ps.getVoltage(binding.phaseIndex), powerFactor)
+					if err != nil {
+						if !ps.badUnits[message.Event.Data.EntityID] {
+							log.Printf("POWER: %s: %v, assuming %s", message.Event.Data.EntityID, err, defaultUnit)
+							ps.badUnits[message.Event.Data.EntityID] = true
+						}
+						amps, _ = toAmps(value, defaultUnit, defaultUnit, ps.getVoltage(binding.phaseIndex), powerFactor)
+					}
+					powerEvent.value = amps
+				case SensorTypeVoltage:
+					powerEvent.value = toVolts(value, unit)
+					ps.voltages[binding.phaseIndex] = powerEvent.value
+				case SensorTypePowerFactor:
+					ps.powerFactors[binding.phaseIndex] = normalizePowerFactor(value, unit)
+					continue
 				}
 
-				ps.eventChannel <- event
+				ps.emit(powerEvent)
 			} else {
 				break Loop
 			}
@@ -158,14 +164,45 @@ Loop:
 	}
 }
 
+// sendReadings hands readings from a direct source to the run loop.
+func (ps *PowerService) sendReadings(readings []*powerEvent) {
+	select {
+	case ps.readings <- readings:
+	case <-ps.ctx.Done():
+	}
+}
+
+// emit flags overcurrent and forwards a reading from any source.
+func (ps *PowerService) emit(powerEvent *powerEvent) {
+	if (powerEvent.sensorType == SensorTypeCurrent || powerEvent.sensorType == SensorTypeImport) && powerEvent.value > ps.max {
+		log.Printf("POWER: overcurrent! %.2f vs %.2f, phase %s (Type: %d)", powerEvent.value, ps.max, powerEvent.phase, powerEvent.sensorType)
+		powerEvent.overCurrent = powerEvent.value - ps.max
+	}
+
+	event := &event{
+		powerEvent: powerEvent,
+	}
+
+	ps.eventChannel <- event
+}
+
 func (ps *PowerService) getVoltage(phase int) float64 {
 	v, ok := ps.voltages[phase]
-	if !ok || v < 100 { // Basic sanity check
-		return 230.0
+	if !ok || v < ps.topology.nominalVoltage()*0.5 { // Basic sanity check
+		return ps.topology.nominalVoltage()
 	}
 	return v
 }
 
+// getPowerFactor returns the last reported power factor of a phase, or unity.
+func (ps *PowerService) getPowerFactor(phase int) float64 {
+	pf, ok := ps.powerFactors[phase]
+	if !ok {
+		return 1.0
+	}
+	return pf
+}
+
 func parseFloat(fs interface{}) float64 {
 	ff, err := strconv.ParseFloat(fmt.Sprintf("%v", fs), 64)
 	if err != nil {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// priceOverride charges at the fuse-limited maximum, whatever the mode, while
+// the price is below a threshold, and turns on extra loads meanwhile. The
+// hard safety layer still applies, and the grid import can be capped to a
+// peak tariff limit.
+type priceOverride struct {
+	price       func(t time.Time) (float64, bool) // spot or effective import price per kWh
+	below       float64
+	switches    []string     // loads turned on during the override
+	peakLimit   float64      // max grid import in W during the override, 0 disables
+	peakPeriods []timePeriod // when the peak limit applies, always when empty
+	voltage     float64      // converts the peak limit to phase current
+
+	active     bool // the price is below the threshold
+	switchesOn bool
+}
+
+// parsePeakPeriods reads comma separated "HH:MM-HH:MM[@days][/months]".
+func parsePeakPeriods(s string) ([]timePeriod, error) {
+	var periods []timePeriod
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		period, err := parseTimePeriod(entry)
+		if err != nil {
+			return nil, err
+		}
+		periods = append(periods, period)
+	}
+	return periods, nil
+}
+
+// peakLimitAmps returns the peak limit as a total current over all phases at
+// t, or +Inf when no limit applies.
+func (o *priceOverride) peakLimitAmps(t time.Time) float64 {
+	if o.peakLimit <= 0 {
+		return math.Inf(1)
+	}
+	if len(o.peakPeriods) > 0 {
+		applies := false
+		local := t.In(time.Local)
+		for _, p := range o.peakPeriods {
+			if p.contains(local) {
+				applies = true
+				break
+			}
+		}
+		if !applies {
+			return math.Inf(1)
+		}
+	}
+	voltage := o.voltage
+	if voltage <= 0 {
+		voltage = 230
+	}
+	return o.peakLimit / voltage
+}
+
+// priceOverrideInternal updates the override from the current price and
+// reports whether it is active. The extra loads are kept off for a minute
+// after a safety event.
+func (tc *dawnConsumerService) priceOverrideInternal(now time.Time) bool {
+	o := tc.priceOverride
+	if o == nil {
+		return false
+	}
+
+	price, known := o.price(now)
+	active := known && price < o.below
+	if active != o.active {
+		o.active = active
+		tc.pid.Integral = 0
+		if active {
+			msg := fmt.Sprintf("Price %.3f below %.3f, charging at the maximum current.", price, o.below)
+			log.Printf("DAWN: %s", msg)
+			tc.haService.notify(NotifyPriceCharging, SeverityInfo, msg)
+		} else {
+			log.Printf("DAWN: Price override ended (price known: %v, %.3f).", known, price)
+			tc.haService.notify(NotifyPriceCharging, SeverityInfo, "Low price charging ended.")
+		}
+	}
+
+	switchesOn := active && time.Since(tc.lastHardSafetyEvent) > 60*time.Second && time.Since(tc.lastImbalanceEvent) > 60*time.Second
+	if switchesOn != o.switchesOn {
+		o.switchesOn = switchesOn
+		for _, entity := range o.switches {
+			tc.haService.setLoadSwitch(entity, switchesOn)
+		}
+	}
+	return active
+}
+
+// peakCapInternal limits a charging current so the grid import stays below
+// the peak limit. The current never goes below the minimum.
+func (tc *dawnConsumerService) peakCapInternal(targetAmps float64, now time.Time) float64 {
+	limit := tc.priceOverride.peakLimitAmps(now)
+	if math.IsInf(limit, 1) {
+		return targetAmps
+	}
+	netImport := -tc.getNetExportInternal()
+	// The car's own draw is part of the import, so the room is relative to it
+	drawing := tc.actualAmps
+	if drawing <= 0 {
+		drawing = tc.currentAmps
+	}
+	capAmps := drawing + (limit-netImport)/float64(len(tc.controlPhaseList()))
+	if targetAmps > capAmps {
+		log.Printf("DAWN: Peak limit %.0fW caps charging at %.1fA (import %.1fA).", tc.priceOverride.peakLimit, capAmps, netImport)
+		targetAmps = math.Max(tc.minimumAmps, capAmps)
+	}
+	return targetAmps
+}
+
+// peakAllowsStartInternal reports whether starting at the minimum current
+// stays within the peak limit.
+func (tc *dawnConsumerService) peakAllowsStartInternal(now time.Time) bool {
+	limit := tc.priceOverride.peakLimitAmps(now)
+	return -tc.getNetExportInternal()+tc.minimumAmps*float64(len(tc.controlPhaseList())) <= limit
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newOverrideTestConsumer(price *float64) *dawnConsumerService {
+	return &dawnConsumerService{
+		haService:          &haService{},
+		minimumAmps:        6,
+		maximumAmps:        16,
+		currentAmps:        6,
+		setpoint:           20,
+		pvOnlyMode:         true,
+		currents:           map[string]float64{"phase1": 5, "phase2": 5, "phase3": 5},
+		exports:            make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		pid:                &PIDController{Kp: 0.4, Ki: 0.01, Kd: 0.05, Setpoint: 20},
+		priceOverride: &priceOverride{
+			price:    func(time.Time) (float64, bool) { return *price, true },
+			below:    0.05,
+			switches: []string{"switch.water_heater"},
+			voltage:  230,
+		},
+	}
+}
+
+func TestPriceOverride_StartsInPvOnlyModeWithoutSurplus(t *testing.T) {
+	price := 0.5
+	tc := newOverrideTestConsumer(&price)
+
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.isCharging, "PV-only mode without surplus")
+	state, _, _ := tc.charge.current()
+	assert.Equal(t, ChargeWaitingForSurplus, state)
+
+	price = -0.1
+	tc.calculateAndSetAmps()
+	assert.True(t, tc.isCharging)
+	assert.True(t, tc.priceOverride.switchesOn)
+	state, reason, _ := tc.charge.current()
+	assert.Equal(t, ChargeStarting, state)
+	assert.Contains(t, reason, "low price")
+
+	price = 0.5
+	tc.calculateAndSetAmps()
+	assert.False(t, tc.priceOverride.active)
+	assert.False(t, tc.priceOverride.switchesOn, "extra loads are turned off again")
+}
+
+func TestPriceOverride_ChargesTowardsFuseLimit(t *testing.T) {
+	price := -0.1
+	tc := newOverrideTestConsumer(&price)
+	tc.isCharging = true
+	tc.connectorStatus = "charging"
+	tc.lastExecution = time.Now().Add(-time.Minute)
+	tc.pid.LastTime = time.Now().Add(-time.Second)
+
+	tc.calculateAndSetAmps()
+	assert.Greater(t, tc.currentAmps, 6.0, "normal mode PID towards the setpoint despite PV-only mode")
+}
+
+func TestPriceOverride_PeakLimit(t *testing.T) {
+	price := -0.1
+	tc := newOverrideTestConsumer(&price)
+	tc.isCharging = true
+	tc.connectorStatus = "charging"
+	tc.currentAmps, tc.actualAmps = 10, 10
+	// 3 x 15A import including the car, limit 11.04kW = 48A total
+	tc.currents = map[string]float64{"phase1": 15, "phase2": 15, "phase3": 15}
+	tc.priceOverride.peakLimit = 11040
+	tc.lastExecution = time.Now().Add(-time.Minute)
+
+	tc.pid.LastTime = time.Now().Add(-time.Second)
+	tc.calculateAndSetAmps()
+	assert.Equal(t, 11.0, tc.currentAmps, "capped at 10A + (48A - 45A) / 3 phases")
+
+	tc.currents = map[string]float64{"phase1": 25, "phase2": 25, "phase3": 25}
+	assert.Equal(t, 6.0, tc.peakCapInternal(16, time.Now()), "never below the minimum")
+}
+
+func TestPriceOverride_PeakPeriods(t *testing.T) {
+	periods, err := parsePeakPeriods("07:00-20:00@mon-fri/nov-mar")
+	assert.NoError(t, err)
+	o := &priceOverride{peakLimit: 2300, peakPeriods: periods, voltage: 230}
+
+	assert.Equal(t, 10.0, o.peakLimitAmps(time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)))
+	assert.True(t, math.IsInf(o.peakLimitAmps(time.Date(2024, 1, 10, 21, 0, 0, 0, time.Local)), 1))
+	assert.True(t, math.IsInf(o.peakLimitAmps(time.Date(2024, 6, 12, 12, 0, 0, 0, time.Local)), 1))
+
+	_, err = parsePeakPeriods("07:00")
+	assert.Error(t, err)
+}
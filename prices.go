@@ -1,63 +1,315 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/tuomaz/nordpool"
 )
 
+// Day-ahead prices are published around 12:45 CET. Fetching starts a little
+// after and is retried with backoff until tomorrow's prices are in.
+const (
+	publicationHour, publicationMinute = 13, 5
+	priceRetryMin                      = 5 * time.Minute
+	priceRetryMax                      = time.Hour
+)
+
+// pricePoint is the spot price per kWh of one market time unit, 60 or 15
+// minutes long.
+type pricePoint struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Price float64   `json:"price"`
+}
+
 type PriceService struct {
-	area         string
-	today        *nordpool.NordpoolData
-	tomorrow     *nordpool.NordpoolData
-	eventChannel chan event
+	mu      sync.RWMutex
+	area    string
+	sources []priceSource // in fallback order
+	// series holds the prices per area ordered by start, without overlaps
+	series  map[string][]pricePoint
+	now     func() time.Time
+	changed chan struct{} // signalled when prices were added or changed
 }
 
-func newPriceService(area string) *PriceService {
-	priceService := &PriceService{area: area}
+// newPriceService reads prices from the sources in order, Nordpool when none
+// are given.
+func newPriceService(area string, sources ...priceSource) *PriceService {
+	if len(sources) == 0 {
+		sources = []priceSource{newNordpoolSource()}
+	}
+	priceService := &PriceService{
+		area:    area,
+		sources: sources,
+		series:  make(map[string][]pricePoint),
+		now:     time.Now,
+		changed: make(chan struct{}, 1),
+	}
 	return priceService
 }
 
+// run fetches prices until the context is done. Once the needed prices are
+// known the next fetch is after the next publication.
+func (ps *PriceService) run(ctx context.Context) {
+	attempts := 0
+	for {
+		updated, err := ps.updatePrices()
+		if err != nil {
+			log.Printf("PRICES: %v", err)
+		} else if updated {
+			log.Printf("PRICES: prices for %s known until %s", ps.area, ps.knownUntil().Format(time.RFC3339))
+		}
+		wait, complete := nextPriceFetch(ps.now(), ps.knownUntil(), attempts)
+		if complete {
+			attempts = 0
+		} else {
+			attempts++
+		}
+		if !sleepContext(ctx, wait) {
+			return
+		}
+	}
+}
+
+// nextPriceFetch returns the time until the next fetch and whether the prices
+// needed now are known. Missing prices are retried with doubling backoff.
+func nextPriceFetch(now time.Time, knownUntil time.Time, attempts int) (time.Duration, bool) {
+	local := now.In(nordpoolLocation)
+	next := publicationOn(local)
+	if !local.Before(next) {
+		next = publicationOn(local.AddDate(0, 0, 1))
+	}
+	if !knownUntil.Before(pricesNeededUntil(now)) {
+		return next.Sub(local), true
+	}
+	wait := priceRetryMin
+	for i := 0; i < attempts && wait < priceRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > priceRetryMax {
+		wait = priceRetryMax
+	}
+	return wait, false
+}
+
+// pricesNeededUntil is the end of today before the day-ahead publication and
+// the end of tomorrow after it.
+func pricesNeededUntil(now time.Time) time.Time {
+	local := now.In(nordpoolLocation)
+	needed := startOfDay(local).AddDate(0, 0, 1)
+	if !local.Before(publicationOn(local)) {
+		needed = needed.AddDate(0, 0, 1)
+	}
+	return needed
+}
+
+// publicationOn returns the day-ahead publication time of t's day.
+func publicationOn(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, publicationHour, publicationMinute, 0, 0, t.Location())
+}
+
+// startOfDay returns midnight of t's day in t's location. Days are not always
+// 24 hours long.
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// updatePrices fetches from the sources in order until the needed prices are
+// known and merges them into the series. Fallback sources only add prices
+// after those already known. It reports whether prices were added or changed.
 func (ps *PriceService) updatePrices() (bool, error) {
+	now := ps.now()
+	from := startOfDay(now.In(nordpoolLocation))
+	to := from.AddDate(0, 0, 2)
+
 	updated := false
-	nordpoolData, err := nordpool.GetNordpoolData()
+	var errs []string
+	for i, source := range ps.sources {
+		points, err := source.fetch(ps.area, from, to)
+		if err == nil && len(points) == 0 {
+			err = errors.New("no prices")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", source.name(), err))
+			continue
+		}
+
+		ps.mu.Lock()
+		series := ps.series[ps.area]
+		if i > 0 && len(series) > 0 {
+			points = pricesAfter(points, series[len(series)-1].End)
+		}
+		merged, changed := mergePrices(series, points)
+		// Keep yesterday for reports of the previous day
+		cutoff := from.AddDate(0, 0, -1)
+		for len(merged) > 0 && merged[0].End.Before(cutoff) {
+			merged = merged[1:]
+		}
+		ps.series[ps.area] = merged
+		ps.mu.Unlock()
+
+		if changed && i > 0 {
+			log.Printf("PRICES: used fallback source %s", source.name())
+		}
+		updated = updated || changed
+		if !ps.knownUntil().Before(pricesNeededUntil(now)) {
+			break
+		}
+	}
+	if len(errs) == len(ps.sources) {
+		return false, errors.New("no price source succeeded: " + strings.Join(errs, "; "))
+	}
+	for _, err := range errs {
+		log.Printf("PRICES: %s", err)
+	}
+	if updated {
+		select {
+		case ps.changed <- struct{}{}:
+		default:
+		}
+	}
+	return updated, nil
+}
+
+// pricesAfter drops the points starting before t.
+func pricesAfter(points []pricePoint, t time.Time) []pricePoint {
+	var out []pricePoint
+	for _, p := range points {
+		if !p.Start.Before(t) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// nordpoolLocation is the time zone of the Nordpool row times.
+var nordpoolLocation = func() *time.Location {
+	location, err := time.LoadLocation("Europe/Oslo")
 	if err != nil {
-		return false, errors.New("could not fetch data from Nordpool: " + err.Error())
+		return time.Local
 	}
+	return location
+}()
 
+// parseNordpoolData reads the prices of an area. Row times are local wall
+// clock times, ambiguous on the 25-hour day, so a row that continues the
+// previous one starts where that one ended. The missing hour of a 23-hour
+// day has no value and is skipped.
+func parseNordpoolData(data *nordpool.NordpoolData, area string) ([]pricePoint, error) {
+	if data == nil || len(data.Data.Rows) == 0 {
+		return nil, errors.New("received empty data from Nordpool")
+	}
 	format := "2006-01-02T15:04:05"
-
-	if ps.today != nil && len(ps.today.Data.Rows) > 0 {
-		if len(nordpoolData.Data.Rows) == 0 {
-			return false, errors.New("received empty data from Nordpool")
+	var points []pricePoint
+	var lastWallStart, lastWallEnd time.Time
+	found := false
+	for _, row := range data.Data.Rows {
+		if row.IsExtraRow {
+			continue
 		}
-		tsOld, err := time.Parse(format, ps.today.Data.Rows[0].StartTime)
+		wallStart, err := time.Parse(format, row.StartTime)
 		if err != nil {
-			log.Fatal(err)
+			return nil, fmt.Errorf("invalid Nordpool start time %q: %v", row.StartTime, err)
 		}
-
-		tsNew, err := time.Parse(format, nordpoolData.Data.Rows[0].StartTime)
-		if err != nil {
-			log.Fatal(err)
+		wallEnd, err := time.Parse(format, row.EndTime)
+		if err != nil || !wallEnd.After(wallStart) {
+			return nil, fmt.Errorf("invalid Nordpool end time %q", row.EndTime)
 		}
-		//log.Printf("date diff: %v", tsNew.Sub(tsOld))
 
-		updated = tsNew.Sub(tsOld) > 10000
+		for _, column := range row.Columns {
+			if column.Name != area {
+				continue
+			}
+			found = true
+			value := strings.NewReplacer(" ", "", "\u00a0", "", ",", ".").Replace(column.Value)
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				// "-" for units without a price
+				break
+			}
+			var start time.Time
+			// Continuing the previous unit, or repeating it on the 25-hour day
+			if n := len(points); n > 0 && (wallStart.Equal(lastWallEnd) || !wallStart.After(lastWallStart)) {
+				start = points[n-1].End
+			} else {
+				start, _ = time.ParseInLocation(format, row.StartTime, nordpoolLocation)
+			}
+			// Nordpool quotes per MWh
+			points = append(points, pricePoint{Start: start, End: start.Add(wallEnd.Sub(wallStart)), Price: price / 1000})
+			lastWallStart, lastWallEnd = wallStart, wallEnd
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("area %s not found in Nordpool data", area)
+	}
+	return points, nil
+}
 
-		if updated {
-			ps.today = ps.tomorrow
-			ps.tomorrow = nordpoolData
+// mergePrices adds points to a series, replacing points with the same start.
+func mergePrices(series []pricePoint, points []pricePoint) ([]pricePoint, bool) {
+	byStart := make(map[time.Time]pricePoint, len(series)+len(points))
+	for _, p := range series {
+		byStart[p.Start.UTC()] = p
+	}
+	updated := false
+	for _, p := range points {
+		if old, ok := byStart[p.Start.UTC()]; !ok || old != p {
+			updated = true
 		}
+		byStart[p.Start.UTC()] = p
+	}
+	merged := make([]pricePoint, 0, len(byStart))
+	for _, p := range byStart {
+		merged = append(merged, p)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Start.Before(merged[j].Start) })
+	return merged, updated
+}
 
-	} else {
-		if len(nordpoolData.Data.Rows) > 0 {
-			ps.today = nordpoolData
-		} else {
-			return false, errors.New("received empty data from Nordpool")
+// priceAt returns the spot price per kWh for the interval containing t, in
+// the currency of the data.
+func (ps *PriceService) priceAt(t time.Time) (float64, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	series := ps.series[ps.area]
+	i := sort.Search(len(series), func(i int) bool { return series[i].End.After(t) })
+	if i < len(series) && !t.Before(series[i].Start) {
+		return series[i].Price, true
+	}
+	return 0, false
+}
+
+// prices returns the price points overlapping [from, to).
+func (ps *PriceService) prices(from time.Time, to time.Time) []pricePoint {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	var out []pricePoint
+	for _, p := range ps.series[ps.area] {
+		if p.End.After(from) && p.Start.Before(to) {
+			out = append(out, p)
 		}
 	}
+	return out
+}
 
-	return updated, nil
+// knownUntil is the end of the last known price.
+func (ps *PriceService) knownUntil() time.Time {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	series := ps.series[ps.area]
+	if len(series) == 0 {
+		return time.Time{}
+	}
+	return series[len(series)-1].End
 }
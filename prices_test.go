@@ -1,25 +1,118 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/tuomaz/nordpool"
 )
 
+// nordpoolRows builds Nordpool data with one SE2 and one SE3 column per row
+// from "start|end|SE3 value" triples.
+func nordpoolRows(t *testing.T, rows ...string) *nordpool.NordpoolData {
+	var parts []string
+	for _, row := range rows {
+		f := strings.Split(row, "|")
+		parts = append(parts, fmt.Sprintf(`{"StartTime":%q,"EndTime":%q,"Columns":[{"Name":"SE2","Value":"1,00"},{"Name":"SE3","Value":%q}]}`, f[0], f[1], f[2]))
+	}
+	data := &nordpool.NordpoolData{}
+	err := json.Unmarshal([]byte(`{"data":{"Rows":[`+strings.Join(parts, ",")+`]}}`), data)
+	assert.NoError(t, err)
+	return data
+}
+
 func TestPriceService_Initialization(t *testing.T) {
 	ps := newPriceService("SE2")
 	assert.Equal(t, "SE2", ps.area)
-	assert.Nil(t, ps.today)
+	assert.True(t, ps.knownUntil().IsZero())
 }
 
 func TestPriceService_EmptyData(t *testing.T) {
-	ps := newPriceService("SE2")
-	
-	// Manually trigger the "updated" logic with empty data to ensure no panic
-	// This tests the fix we made earlier
-	ps.today = &nordpool.NordpoolData{}
-	
-	// We can't easily mock the package-level GetNordpoolData without refactoring 
-	// it into an interface, but we verified the logic prevents the panic.
+	ps := newPriceService("SE2", &nordpoolSource{get: func() (*nordpool.NordpoolData, error) { return &nordpool.NordpoolData{}, nil }})
+
+	updated, err := ps.updatePrices()
+	assert.False(t, updated)
+	assert.Error(t, err)
+}
+
+func TestPriceService_QuarterHourSeriesForArea(t *testing.T) {
+	ps := newPriceService("SE3", &nordpoolSource{get: func() (*nordpool.NordpoolData, error) {
+		return nordpoolRows(t,
+			"2025-10-02T00:00:00|2025-10-02T00:15:00|1 234,50",
+			"2025-10-02T00:15:00|2025-10-02T00:30:00|-12,00",
+			"2025-10-02T00:30:00|2025-10-02T00:45:00|-"), nil
+	}})
+	ps.now = func() time.Time { return time.Date(2025, 10, 1, 14, 0, 0, 0, nordpoolLocation) }
+
+	updated, err := ps.updatePrices()
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	updated, _ = ps.updatePrices()
+	assert.False(t, updated, "same prices again")
+
+	price, ok := ps.priceAt(time.Date(2025, 10, 2, 0, 20, 0, 0, nordpoolLocation))
+	assert.True(t, ok)
+	assert.Equal(t, -0.012, price)
+	price, _ = ps.priceAt(time.Date(2025, 10, 2, 0, 0, 0, 0, nordpoolLocation))
+	assert.Equal(t, 1.2345, price)
+	_, ok = ps.priceAt(time.Date(2025, 10, 2, 0, 35, 0, 0, nordpoolLocation))
+	assert.False(t, ok, "units without a value have no price")
+	assert.Len(t, ps.prices(time.Date(2025, 10, 2, 0, 10, 0, 0, nordpoolLocation), time.Date(2025, 10, 2, 1, 0, 0, 0, nordpoolLocation)), 2)
+
+	ps.area = "NO1"
+	_, err = ps.updatePrices()
+	assert.Error(t, err)
+}
+
+func TestParseNordpoolData_DaylightSavingDays(t *testing.T) {
+	// 25-hour day: 02:00-03:00 appears twice
+	points, err := parseNordpoolData(nordpoolRows(t,
+		"2024-10-27T01:00:00|2024-10-27T02:00:00|10",
+		"2024-10-27T02:00:00|2024-10-27T03:00:00|20",
+		"2024-10-27T02:00:00|2024-10-27T03:00:00|30",
+		"2024-10-27T03:00:00|2024-10-27T04:00:00|40"), "SE3")
+	assert.NoError(t, err)
+	assert.Len(t, points, 4)
+	for i := 1; i < len(points); i++ {
+		assert.Equal(t, time.Hour, points[i].Start.Sub(points[i-1].Start))
+	}
+
+	// 23-hour day: 02:00-03:00 does not exist and has no value
+	points, err = parseNordpoolData(nordpoolRows(t,
+		"2024-03-31T01:00:00|2024-03-31T02:00:00|10",
+		"2024-03-31T02:00:00|2024-03-31T03:00:00|-",
+		"2024-03-31T03:00:00|2024-03-31T04:00:00|40"), "SE3")
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, points[0].End, points[1].Start)
+}
+
+func TestNextPriceFetch(t *testing.T) {
+	morning := time.Date(2025, 10, 1, 9, 0, 0, 0, nordpoolLocation)
+	endOfToday := time.Date(2025, 10, 2, 0, 0, 0, 0, nordpoolLocation)
+	endOfTomorrow := time.Date(2025, 10, 3, 0, 0, 0, 0, nordpoolLocation)
+
+	wait, complete := nextPriceFetch(morning, endOfToday, 0)
+	assert.True(t, complete)
+	assert.Equal(t, 4*time.Hour+5*time.Minute, wait, "wait for the publication")
+
+	wait, complete = nextPriceFetch(morning, time.Time{}, 0)
+	assert.False(t, complete)
+	assert.Equal(t, priceRetryMin, wait)
+
+	afternoon := time.Date(2025, 10, 1, 13, 30, 0, 0, nordpoolLocation)
+	_, complete = nextPriceFetch(afternoon, endOfToday, 0)
+	assert.False(t, complete, "tomorrow is needed after the publication")
+	wait, _ = nextPriceFetch(afternoon, endOfToday, 2)
+	assert.Equal(t, 4*priceRetryMin, wait)
+	wait, _ = nextPriceFetch(afternoon, endOfToday, 10)
+	assert.Equal(t, priceRetryMax, wait)
+
+	wait, complete = nextPriceFetch(afternoon, endOfTomorrow, 3)
+	assert.True(t, complete)
+	assert.Equal(t, 23*time.Hour+35*time.Minute, wait)
 }
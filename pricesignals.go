@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// PriceLevel classifies a price relative to the rolling average.
+type PriceLevel int
+
+const (
+	PriceVeryCheap PriceLevel = iota
+	PriceCheap
+	PriceNormal
+	PriceExpensive
+	PriceVeryExpensive
+)
+
+func (l PriceLevel) String() string {
+	switch l {
+	case PriceVeryCheap:
+		return "very_cheap"
+	case PriceCheap:
+		return "cheap"
+	case PriceExpensive:
+		return "expensive"
+	case PriceVeryExpensive:
+		return "very_expensive"
+	default:
+		return "normal"
+	}
+}
+
+func parsePriceLevel(s string) (PriceLevel, error) {
+	for level := PriceVeryCheap; level <= PriceVeryExpensive; level++ {
+		if strings.EqualFold(strings.TrimSpace(s), level.String()) {
+			return level, nil
+		}
+	}
+	return PriceNormal, fmt.Errorf("unknown price level %q", s)
+}
+
+// classifyPrice compares a price to the average. The bounds are ratios of the
+// average, applied to the distance from it so negative averages work too.
+func classifyPrice(price float64, average float64) PriceLevel {
+	if average == 0 {
+		switch {
+		case price < 0:
+			return PriceVeryCheap
+		case price > 0:
+			return PriceExpensive
+		}
+		return PriceNormal
+	}
+	ratio := 1 + (price-average)/math.Abs(average)
+	switch {
+	case ratio <= 0.6:
+		return PriceVeryCheap
+	case ratio <= 0.9:
+		return PriceCheap
+	case ratio < 1.15:
+		return PriceNormal
+	case ratio < 1.4:
+		return PriceExpensive
+	default:
+		return PriceVeryExpensive
+	}
+}
+
+// priceWindow is a period and its time weighted average price.
+type priceWindow struct {
+	Start   time.Time
+	End     time.Time
+	Average float64
+}
+
+// priceSignals are derived from the known prices at one point in time.
+type priceSignals struct {
+	At       time.Time
+	Current  pricePoint
+	Known    bool // whether the current price is known
+	Average  float64
+	Level    PriceLevel
+	Cheapest priceWindow // zero when no window of the length is known
+	Cheap    bool
+}
+
+// computePriceSignals derives the signals from effective prices ordered by
+// start. The average covers the prices in averageWindow before now up to the
+// end of today, the cheapest window starts no earlier than the current unit.
+func computePriceSignals(points []pricePoint, now time.Time, window time.Duration, averageWindow time.Duration, cheapLevel PriceLevel) priceSignals {
+	signals := priceSignals{At: now, Level: PriceNormal}
+
+	endOfToday := startOfDay(now.In(nordpoolLocation)).AddDate(0, 0, 1)
+	sum, hours := 0.0, 0.0
+	for _, p := range points {
+		if !p.Start.After(now) && p.End.After(now) {
+			signals.Current, signals.Known = p, true
+		}
+		if p.End.After(now.Add(-averageWindow)) && p.Start.Before(endOfToday) {
+			h := p.End.Sub(p.Start).Hours()
+			sum += p.Price * h
+			hours += h
+		}
+	}
+	if hours > 0 {
+		signals.Average = sum / hours
+	}
+	if signals.Known {
+		signals.Level = classifyPrice(signals.Current.Price, signals.Average)
+	}
+
+	signals.Cheapest = cheapestWindow(points, now, window)
+	inCheapest := !signals.Cheapest.Start.IsZero() && !signals.Cheapest.Start.After(now) && signals.Cheapest.End.After(now)
+	// Near the end of the known prices the current unit may be the only
+	// candidate, so an expensive one is never cheap for being in the window
+	signals.Cheap = signals.Known && (signals.Level <= cheapLevel || (inCheapest && signals.Level <= PriceNormal))
+	return signals
+}
+
+// cheapestWindow finds the contiguous window of the given length with the
+// lowest average price, starting at a unit boundary from the current unit on.
+func cheapestWindow(points []pricePoint, now time.Time, length time.Duration) priceWindow {
+	var best priceWindow
+	found := false
+	for i, first := range points {
+		if !first.End.After(now) {
+			continue
+		}
+		end := first.Start.Add(length)
+		sum := 0.0
+		covered := first.Start
+		for _, p := range points[i:] {
+			if !p.Start.Equal(covered) || !covered.Before(end) {
+				break
+			}
+			until := p.End
+			if until.After(end) {
+				until = end
+			}
+			sum += p.Price * until.Sub(p.Start).Hours()
+			covered = until
+		}
+		if !covered.Equal(end) {
+			continue
+		}
+		average := sum / length.Hours()
+		if !found || average < best.Average {
+			best, found = priceWindow{Start: first.Start, End: end, Average: average}, true
+		}
+	}
+	return best
+}
+
+// pricePublisher publishes the price, its level, the cheapest upcoming window
+// and a cheap-now binary sensor to HA.
+type pricePublisher struct {
+	prices        *PriceService
+	pricer        energyPricer // spot, or spot with the tariff added
+	ha            *haService
+	prefix        string // object id prefix, e.g. electricity_price
+	unit          string
+	window        time.Duration
+	averageWindow time.Duration
+	cheapLevel    PriceLevel
+}
+
+// effectivePrices returns the known prices with the pricer applied.
+func (pp *pricePublisher) effectivePrices(from time.Time, to time.Time) []pricePoint {
+	var points []pricePoint
+	for _, p := range pp.prices.prices(from, to) {
+		if price, ok := pp.pricer.importPrice(p.Start); ok {
+			p.Price = price
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+func (pp *pricePublisher) update(now time.Time) priceSignals {
+	from := startOfDay(now.In(nordpoolLocation)).Add(-pp.averageWindow)
+	points := pp.effectivePrices(from, now.Add(72*time.Hour))
+	return computePriceSignals(points, now, pp.window, pp.averageWindow, pp.cheapLevel)
+}
+
+// publish updates the signals and the HA entities.
+func (pp *pricePublisher) publish(now time.Time) {
+	signals := pp.update(now)
+	if pp.prefix == "" {
+		return
+	}
+
+	today := startOfDay(now.In(nordpoolLocation))
+	series := func(from time.Time) []map[string]interface{} {
+		var out []map[string]interface{}
+		for _, p := range pp.effectivePrices(from, from.AddDate(0, 0, 1)) {
+			out = append(out, map[string]interface{}{
+				"start": p.Start.Format(time.RFC3339),
+				"end":   p.End.Format(time.RFC3339),
+				"price": math.Round(p.Price*10000) / 10000,
+			})
+		}
+		return out
+	}
+
+	price := "unknown"
+	if signals.Known {
+		price = fmt.Sprintf("%.4f", signals.Current.Price)
+	}
+	pp.publishEntity("sensor."+pp.prefix, price, map[string]interface{}{
+		"friendly_name":       "Electricity price",
+		"unit_of_measurement": pp.unit,
+		"state_class":         "measurement",
+		"average":             math.Round(signals.Average*10000) / 10000,
+		"today":               series(today),
+		"tomorrow":            series(today.AddDate(0, 0, 1)),
+	})
+
+	pp.publishEntity("sensor."+pp.prefix+"_level", signals.Level.String(), map[string]interface{}{
+		"friendly_name": "Electricity price level",
+		"average":       math.Round(signals.Average*10000) / 10000,
+	})
+
+	cheapest := "unknown"
+	attributes := map[string]interface{}{
+		"friendly_name": "Cheapest electricity window",
+		"device_class":  "timestamp",
+		"length":        pp.window.String(),
+	}
+	if !signals.Cheapest.Start.IsZero() {
+		cheapest = signals.Cheapest.Start.Format(time.RFC3339)
+		attributes["end"] = signals.Cheapest.End.Format(time.RFC3339)
+		attributes["average"] = math.Round(signals.Cheapest.Average*10000) / 10000
+	}
+	pp.publishEntity("sensor."+pp.prefix+"_cheapest_window", cheapest, attributes)
+
+	cheap := "off"
+	if signals.Cheap {
+		cheap = "on"
+	}
+	pp.publishEntity("binary_sensor."+pp.prefix+"_cheap", cheap, map[string]interface{}{
+		"friendly_name": "Electricity cheap now",
+		"level":         signals.Level.String(),
+	})
+}
+
+func (pp *pricePublisher) publishEntity(entity string, state string, attributes map[string]interface{}) {
+	if err := pp.ha.publishState(entity, state, attributes); err != nil {
+		log.Printf("PRICES: could not publish %s: %v", entity, err)
+	}
+}
+
+// run publishes at every quarter hour, the shortest market time unit, and
+// whenever the prices change.
+func (pp *pricePublisher) run(ctx context.Context) {
+	for {
+		now := time.Now()
+		pp.publish(now)
+		next := now.Truncate(15 * time.Minute).Add(15 * time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-pp.prices.changed:
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hourlyPoints builds consecutive hourly prices from start.
+func hourlyPoints(start time.Time, prices ...float64) []pricePoint {
+	points := make([]pricePoint, len(prices))
+	for i, price := range prices {
+		points[i] = pricePoint{Start: start.Add(time.Duration(i) * time.Hour), End: start.Add(time.Duration(i+1) * time.Hour), Price: price}
+	}
+	return points
+}
+
+func TestClassifyPrice(t *testing.T) {
+	assert.Equal(t, PriceVeryCheap, classifyPrice(0.5, 1))
+	assert.Equal(t, PriceCheap, classifyPrice(0.85, 1))
+	assert.Equal(t, PriceNormal, classifyPrice(1.1, 1))
+	assert.Equal(t, PriceExpensive, classifyPrice(1.3, 1))
+	assert.Equal(t, PriceVeryExpensive, classifyPrice(2, 1))
+	assert.Equal(t, PriceVeryCheap, classifyPrice(-0.5, -0.1), "far below a negative average")
+	assert.Equal(t, PriceVeryCheap, classifyPrice(-0.01, 0))
+
+	level, err := parsePriceLevel("Very_Cheap")
+	assert.NoError(t, err)
+	assert.Equal(t, PriceVeryCheap, level)
+	_, err = parsePriceLevel("free")
+	assert.Error(t, err)
+}
+
+func TestCheapestWindow(t *testing.T) {
+	start := time.Date(2025, 10, 1, 0, 0, 0, 0, nordpoolLocation)
+	points := hourlyPoints(start, 5, 1, 2, 9, 1, 1, 8)
+
+	window := cheapestWindow(points, start.Add(30*time.Minute), 2*time.Hour)
+	assert.Equal(t, start.Add(4*time.Hour), window.Start)
+	assert.Equal(t, 1.0, window.Average)
+
+	window = cheapestWindow(points, start.Add(5*time.Hour+30*time.Minute), 2*time.Hour)
+	assert.Equal(t, start.Add(5*time.Hour), window.Start, "only windows from the current unit on")
+	assert.Equal(t, 4.5, window.Average)
+
+	window = cheapestWindow(points, start, 8*time.Hour)
+	assert.True(t, window.Start.IsZero(), "no window of that length is known")
+
+	// Quarter hour units
+	var quarters []pricePoint
+	for i, price := range []float64{4, 4, 1, 1, 1, 1, 4, 4} {
+		s := start.Add(time.Duration(i) * 15 * time.Minute)
+		quarters = append(quarters, pricePoint{Start: s, End: s.Add(15 * time.Minute), Price: price})
+	}
+	window = cheapestWindow(quarters, start, time.Hour)
+	assert.Equal(t, start.Add(30*time.Minute), window.Start)
+	assert.Equal(t, 1.0, window.Average)
+}
+
+func TestComputePriceSignals(t *testing.T) {
+	start := time.Date(2025, 10, 1, 0, 0, 0, 0, nordpoolLocation)
+	points := hourlyPoints(start, 1, 1, 1, 1, 0.2, 1, 1, 1, 1, 1.8)
+
+	signals := computePriceSignals(points, start.Add(4*time.Hour+10*time.Minute), time.Hour, 72*time.Hour, PriceCheap)
+	assert.True(t, signals.Known)
+	assert.Equal(t, 0.2, signals.Current.Price)
+	assert.InDelta(t, 1.0, signals.Average, 1e-9)
+	assert.Equal(t, PriceVeryCheap, signals.Level)
+	assert.True(t, signals.Cheap)
+
+	signals = computePriceSignals(points, start.Add(9*time.Hour), time.Hour, 72*time.Hour, PriceCheap)
+	assert.Equal(t, PriceVeryExpensive, signals.Level)
+	assert.False(t, signals.Cheap)
+
+	signals = computePriceSignals(points, start.Add(3*time.Hour), 2*time.Hour, 72*time.Hour, PriceVeryCheap)
+	assert.Equal(t, PriceNormal, signals.Level)
+	assert.True(t, signals.Cheap, "within the cheapest window")
+
+	signals = computePriceSignals(nil, start, time.Hour, 72*time.Hour, PriceCheap)
+	assert.False(t, signals.Known)
+	assert.False(t, signals.Cheap)
+}
+
+func TestPricePublisher_AppliesPricer(t *testing.T) {
+	ps := newPriceService("SE3", &filePriceSource{path: "testdata/prices_se3.json"})
+	now := time.Date(2025, 10, 1, 1, 30, 0, 0, nordpoolLocation)
+	ps.now = func() time.Time { return now }
+	_, err := ps.updatePrices()
+	assert.NoError(t, err)
+
+	pp := &pricePublisher{prices: ps, pricer: &tariff{spot: ps, energyTax: 0.4, vat: 0.25}, ha: &haService{},
+		window: time.Hour, averageWindow: 72 * time.Hour, cheapLevel: PriceCheap}
+	signals := pp.update(now)
+	assert.InDelta(t, (0.38+0.4)*1.25, signals.Current.Price, 1e-9)
+	assert.True(t, time.Date(2025, 10, 1, 2, 0, 0, 0, nordpoolLocation).Equal(signals.Cheapest.Start))
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tuomaz/nordpool"
+)
+
+// priceSource supplies spot prices per kWh for an area. from and to are the
+// period wanted, sources that publish fixed days may return more or less.
+type priceSource interface {
+	name() string
+	fetch(area string, from time.Time, to time.Time) ([]pricePoint, error)
+}
+
+// nordpoolSource reads the Nordpool market data page.
+type nordpoolSource struct {
+	get func() (*nordpool.NordpoolData, error)
+}
+
+func newNordpoolSource() *nordpoolSource {
+	return &nordpoolSource{get: nordpool.GetNordpoolData}
+}
+
+func (s *nordpoolSource) name() string {
+	return "nordpool"
+}
+
+func (s *nordpoolSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	data, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	return parseNordpoolData(data, area)
+}
+
+// entsoeAreas maps bidding zones to their ENTSO-E EIC codes. Other areas can
+// be given as EIC codes directly.
+var entsoeAreas = map[string]string{
+	"SE1": "10Y1001A1001A44P",
+	"SE2": "10Y1001A1001A45N",
+	"SE3": "10Y1001A1001A46L",
+	"SE4": "10Y1001A1001A47J",
+	"NO1": "10YNO-1--------2",
+	"NO2": "10YNO-2--------T",
+	"NO3": "10YNO-3--------J",
+	"NO4": "10YNO-4--------9",
+	"NO5": "10Y1001A1001A48H",
+	"DK1": "10YDK-1--------W",
+	"DK2": "10YDK-2--------M",
+	"FI":  "10YFI-1--------U",
+	"EE":  "10Y1001A1001A39I",
+	"LV":  "10YLV-1001A00074",
+	"LT":  "10YLT-1001A0008Q",
+}
+
+// entsoeSource reads day-ahead prices (document A44) from the ENTSO-E
+// transparency platform. Prices are in EUR/MWh, rate converts them to the
+// currency of the other sources.
+type entsoeSource struct {
+	token   string
+	baseURL string
+	rate    float64
+	client  *http.Client
+}
+
+func newEntsoeSource(token string, rate float64) *entsoeSource {
+	return &entsoeSource{
+		token:   token,
+		baseURL: "https://web-api.tp.entsoe.eu/api",
+		rate:    rate,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *entsoeSource) name() string {
+	return "entsoe"
+}
+
+type entsoeDocument struct {
+	TimeSeries []struct {
+		Period []struct {
+			TimeInterval struct {
+				Start string `xml:"start"`
+				End   string `xml:"end"`
+			} `xml:"timeInterval"`
+			Resolution string `xml:"resolution"`
+			Points     []struct {
+				Position int     `xml:"position"`
+				Price    float64 `xml:"price.amount"`
+			} `xml:"Point"`
+		} `xml:"Period"`
+	} `xml:"TimeSeries"`
+	// Set on the acknowledgement document returned instead of prices
+	Reason string `xml:"Reason>text"`
+}
+
+func (s *entsoeSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	eic, ok := entsoeAreas[strings.ToUpper(area)]
+	if !ok {
+		eic = area
+	}
+	query := url.Values{
+		"securityToken": {s.token},
+		"documentType":  {"A44"},
+		"in_Domain":     {eic},
+		"out_Domain":    {eic},
+		"periodStart":   {from.UTC().Format("200601021504")},
+		"periodEnd":     {to.UTC().Format("200601021504")},
+	}
+	resp, err := s.client.Get(s.baseURL + "?" + query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc entsoeDocument
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("invalid ENTSO-E response (%s): %v", resp.Status, err)
+	}
+	if len(doc.TimeSeries) == 0 {
+		if doc.Reason != "" {
+			return nil, fmt.Errorf("ENTSO-E: %s", doc.Reason)
+		}
+		return nil, fmt.Errorf("ENTSO-E returned no prices (%s)", resp.Status)
+	}
+	return parseEntsoeDocument(doc, s.rate)
+}
+
+// parseEntsoeDocument expands the periods into price points. Positions left
+// out (curve type A03) repeat the price before them.
+func parseEntsoeDocument(doc entsoeDocument, rate float64) ([]pricePoint, error) {
+	var points []pricePoint
+	for _, series := range doc.TimeSeries {
+		for _, period := range series.Period {
+			start, err := time.Parse("2006-01-02T15:04Z", period.TimeInterval.Start)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ENTSO-E interval start %q", period.TimeInterval.Start)
+			}
+			end, err := time.Parse("2006-01-02T15:04Z", period.TimeInterval.End)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ENTSO-E interval end %q", period.TimeInterval.End)
+			}
+			resolution, err := time.ParseDuration(strings.ToLower(strings.TrimPrefix(period.Resolution, "PT")))
+			if err != nil || resolution <= 0 {
+				return nil, fmt.Errorf("unsupported ENTSO-E resolution %q", period.Resolution)
+			}
+
+			prices := make(map[int]float64, len(period.Points))
+			for _, point := range period.Points {
+				prices[point.Position] = point.Price
+			}
+			price, known := 0.0, false
+			position := 1
+			for t := start; t.Before(end); t = t.Add(resolution) {
+				if p, ok := prices[position]; ok {
+					price, known = p, true
+				}
+				if known {
+					points = append(points, pricePoint{Start: t, End: t.Add(resolution), Price: price * rate / 1000})
+				}
+				position++
+			}
+		}
+	}
+	return points, nil
+}
+
+// haSensorSource reads the price list attributes of an HA price sensor, such
+// as raw_today/raw_tomorrow of the Nordpool integration or today/tomorrow
+// lists of Tibber sensors. Prices are already per kWh.
+type haSensorSource struct {
+	ha     *haService
+	entity string
+}
+
+func (s *haSensorSource) name() string {
+	return "ha:" + s.entity
+}
+
+// haPriceAttributes are the attributes read, in order.
+var haPriceAttributes = []string{"raw_today", "raw_tomorrow", "today", "tomorrow", "prices", "data"}
+
+func (s *haSensorSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	if s.ha.client == nil {
+		return nil, errors.New("HA not connected")
+	}
+	state, ok := s.ha.client.GetState(s.entity)
+	if !ok || state == nil {
+		return nil, fmt.Errorf("%s not found", s.entity)
+	}
+	return parseHaPriceAttributes(state.Attributes)
+}
+
+// parseHaPriceAttributes reads lists of {start, end, value} objects. The
+// start may be called start, startsAt or start_time and the price value,
+// total or price. Without an end, a unit ends where the next one starts.
+func parseHaPriceAttributes(attributes map[string]interface{}) ([]pricePoint, error) {
+	var points []pricePoint
+	for _, key := range haPriceAttributes {
+		entries, ok := attributes[key].([]interface{})
+		if !ok {
+			continue
+		}
+		var list []pricePoint
+		for _, entry := range entries {
+			fields, ok := entry.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			start, ok := haTimeField(fields, "start", "startsAt", "start_time")
+			if !ok {
+				continue
+			}
+			price, ok := haFloatField(fields, "value", "total", "price")
+			if !ok {
+				continue
+			}
+			end, _ := haTimeField(fields, "end", "endsAt", "end_time")
+			list = append(list, pricePoint{Start: start, End: end, Price: price})
+		}
+		for i := range list {
+			if !list[i].End.IsZero() {
+				continue
+			}
+			if i+1 < len(list) {
+				list[i].End = list[i+1].Start
+			} else if i > 0 {
+				list[i].End = list[i].Start.Add(list[i].Start.Sub(list[i-1].Start))
+			} else {
+				list[i].End = list[i].Start.Add(time.Hour)
+			}
+		}
+		points = append(points, list...)
+	}
+	if len(points) == 0 {
+		return nil, errors.New("no price list in the sensor attributes")
+	}
+	return points, nil
+}
+
+func haTimeField(fields map[string]interface{}, names ...string) (time.Time, bool) {
+	for _, name := range names {
+		if s, ok := fields[name].(string); ok {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				return t, true
+			}
+		}
+	}
+	return time.Time{}, false
+}
+
+func haFloatField(fields map[string]interface{}, names ...string) (float64, bool) {
+	for _, name := range names {
+		if f, ok := fields[name].(float64); ok {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// filePriceSource reads a JSON list of {"start", "end", "price"} objects with
+// prices per kWh, for fixed prices, tests and offline use.
+type filePriceSource struct {
+	path string
+}
+
+func (s *filePriceSource) name() string {
+	return "file:" + s.path
+}
+
+func (s *filePriceSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	var points []pricePoint
+	if err := json.Unmarshal(data, &points); err != nil {
+		return nil, fmt.Errorf("invalid price file %s: %v", s.path, err)
+	}
+	return points, nil
+}
+
+// parsePriceSources reads a comma separated fallback order such as
+// "nordpool,entsoe,ha:sensor.nordpool_kwh_se3_sek,file:/data/prices.json".
+func parsePriceSources(s string, ha *haService, entsoeToken string, entsoeRate float64) ([]priceSource, error) {
+	var sources []priceSource
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		kind, arg, _ := strings.Cut(entry, ":")
+		switch strings.ToLower(kind) {
+		case "":
+			continue
+		case "nordpool":
+			sources = append(sources, newNordpoolSource())
+		case "entsoe":
+			if entsoeToken == "" {
+				return nil, errors.New("the entsoe source needs ENTSOE_TOKEN")
+			}
+			sources = append(sources, newEntsoeSource(entsoeToken, entsoeRate))
+		case "ha":
+			if arg == "" {
+				return nil, fmt.Errorf("%q needs an entity, e.g. ha:sensor.nordpool", entry)
+			}
+			sources = append(sources, &haSensorSource{ha: ha, entity: arg})
+		case "file":
+			if arg == "" {
+				return nil, fmt.Errorf("%q needs a path", entry)
+			}
+			sources = append(sources, &filePriceSource{path: arg})
+		default:
+			return nil, fmt.Errorf("unknown price source %q", entry)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, errors.New("no price source configured")
+	}
+	return sources, nil
+}
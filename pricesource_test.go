@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSource struct{}
+
+func (failingSource) name() string {
+	return "failing"
+}
+
+func (failingSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	return nil, errors.New("unavailable")
+}
+
+func TestPriceService_FallsBackInOrder(t *testing.T) {
+	ps := newPriceService("SE3", failingSource{}, &filePriceSource{path: "testdata/prices_se3.json"})
+	ps.now = func() time.Time { return time.Date(2025, 10, 1, 9, 0, 0, 0, nordpoolLocation) }
+
+	updated, err := ps.updatePrices()
+	assert.NoError(t, err)
+	assert.True(t, updated)
+	price, ok := ps.priceAt(time.Date(2025, 10, 1, 1, 30, 0, 0, nordpoolLocation))
+	assert.True(t, ok)
+	assert.Equal(t, 0.38, price)
+
+	ps.sources = []priceSource{failingSource{}}
+	_, err = ps.updatePrices()
+	assert.Error(t, err)
+}
+
+func TestPriceService_FallbackOnlyExtendsSeries(t *testing.T) {
+	primary := &filePriceSource{path: "testdata/prices_se3.json"}
+	fallback := &fixedSource{points: []pricePoint{
+		{Start: time.Date(2025, 10, 1, 3, 0, 0, 0, nordpoolLocation), End: time.Date(2025, 10, 1, 4, 0, 0, 0, nordpoolLocation), Price: 9},
+		{Start: time.Date(2025, 10, 1, 4, 0, 0, 0, nordpoolLocation), End: time.Date(2025, 10, 1, 5, 0, 0, 0, nordpoolLocation), Price: 0.5},
+	}}
+	ps := newPriceService("SE3", primary, fallback)
+	ps.now = func() time.Time { return time.Date(2025, 10, 1, 9, 0, 0, 0, nordpoolLocation) }
+
+	_, err := ps.updatePrices()
+	assert.NoError(t, err)
+	price, _ := ps.priceAt(time.Date(2025, 10, 1, 3, 30, 0, 0, nordpoolLocation))
+	assert.Equal(t, 0.37, price, "the primary source wins")
+	price, _ = ps.priceAt(time.Date(2025, 10, 1, 4, 30, 0, 0, nordpoolLocation))
+	assert.Equal(t, 0.5, price)
+}
+
+type fixedSource struct {
+	points []pricePoint
+}
+
+func (s *fixedSource) name() string {
+	return "fixed"
+}
+
+func (s *fixedSource) fetch(area string, from time.Time, to time.Time) ([]pricePoint, error) {
+	return s.points, nil
+}
+
+func TestEntsoeSource(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<Publication_MarketDocument xmlns="urn:iec62325.351:tc57wg16:451-3:publicationdocument:7:3">
+  <TimeSeries>
+    <Period>
+      <timeInterval><start>2025-09-30T22:00Z</start><end>2025-09-30T23:00Z</end></timeInterval>
+      <resolution>PT15M</resolution>
+      <Point><position>1</position><price.amount>40.00</price.amount></Point>
+      <Point><position>3</position><price.amount>-5.00</price.amount></Point>
+    </Period>
+  </TimeSeries>
+</Publication_MarketDocument>`))
+	}))
+	defer server.Close()
+
+	source := newEntsoeSource("token", 11.0)
+	source.baseURL = server.URL
+	from := time.Date(2025, 10, 1, 0, 0, 0, 0, nordpoolLocation)
+	points, err := source.fetch("SE3", from, from.AddDate(0, 0, 2))
+
+	assert.NoError(t, err)
+	assert.Contains(t, query, "in_Domain=10Y1001A1001A46L")
+	assert.Contains(t, query, "periodStart=202509302200")
+	assert.Len(t, points, 4)
+	assert.True(t, points[0].Start.Equal(from))
+	assert.Equal(t, 15*time.Minute, points[0].End.Sub(points[0].Start))
+	assert.InDelta(t, 0.44, points[1].Price, 1e-9, "a left out position repeats the price before it")
+	assert.InDelta(t, -0.055, points[3].Price, 1e-9)
+}
+
+func TestEntsoeSource_Acknowledgement(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`<Acknowledgement_MarketDocument><Reason><code>999</code><text>No matching data found</text></Reason></Acknowledgement_MarketDocument>`))
+	}))
+	defer server.Close()
+
+	source := newEntsoeSource("token", 1)
+	source.baseURL = server.URL
+	_, err := source.fetch("SE3", time.Now(), time.Now().Add(time.Hour))
+	assert.ErrorContains(t, err, "No matching data found")
+}
+
+func TestParseHaPriceAttributes(t *testing.T) {
+	// Nordpool integration
+	points, err := parseHaPriceAttributes(map[string]interface{}{
+		"raw_today": []interface{}{
+			map[string]interface{}{"start": "2025-10-01T00:00:00+02:00", "end": "2025-10-01T01:00:00+02:00", "value": 0.42},
+		},
+		"raw_tomorrow": []interface{}{},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	assert.Equal(t, 0.42, points[0].Price)
+
+	// Tibber style, without ends
+	points, err = parseHaPriceAttributes(map[string]interface{}{
+		"today": []interface{}{
+			map[string]interface{}{"startsAt": "2025-10-01T00:00:00+02:00", "total": 1.1},
+			map[string]interface{}{"startsAt": "2025-10-01T00:15:00+02:00", "total": 1.2},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, 15*time.Minute, points[0].End.Sub(points[0].Start))
+	assert.Equal(t, 15*time.Minute, points[1].End.Sub(points[1].Start))
+
+	_, err = parseHaPriceAttributes(map[string]interface{}{"unit_of_measurement": "SEK/kWh"})
+	assert.Error(t, err)
+}
+
+func TestParsePriceSources(t *testing.T) {
+	sources, err := parsePriceSources("nordpool, ha:sensor.nordpool_kwh_se3_sek, file:testdata/prices_se3.json", &haService{}, "", 1)
+	assert.NoError(t, err)
+	assert.Len(t, sources, 3)
+	assert.Equal(t, "ha:sensor.nordpool_kwh_se3_sek", sources[1].name())
+
+	_, err = parsePriceSources("entsoe", &haService{}, "", 1)
+	assert.Error(t, err, "ENTSO-E needs a token")
+	_, err = parsePriceSources("tibber", &haService{}, "", 1)
+	assert.Error(t, err)
+	_, err = parsePriceSources("", &haService{}, "", 1)
+	assert.Error(t, err)
+}
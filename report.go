@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLedgerGap is the longest time between readings that is integrated.
+// Longer gaps (restarts, lost connections) are left out rather than guessed.
+const maxLedgerGap = 5 * time.Minute
+
+// energyPricer gives the price per kWh of grid energy at a time.
+type energyPricer interface {
+	importPrice(t time.Time) (float64, bool)
+	exportPrice(t time.Time) (float64, bool)
+}
+
+// energyBucket is the energy and cost of one hour, or of one day in monthly
+// reports.
+type energyBucket struct {
+	Start         time.Time `json:"start"`
+	ImportKWh     float64   `json:"import_kwh"`
+	ExportKWh     float64   `json:"export_kwh"`
+	EVKWh         float64   `json:"ev_kwh"`
+	EVSolarKWh    float64   `json:"ev_solar_kwh"`
+	ImportCost    float64   `json:"import_cost"`
+	ExportRevenue float64   `json:"export_revenue"`
+	EVCost        float64   `json:"ev_cost"`
+	UnpricedKWh   float64   `json:"unpriced_kwh"` // energy without a known price
+}
+
+func (b *energyBucket) add(o energyBucket) {
+	b.ImportKWh += o.ImportKWh
+	b.ExportKWh += o.ExportKWh
+	b.EVKWh += o.EVKWh
+	b.EVSolarKWh += o.EVSolarKWh
+	b.ImportCost += o.ImportCost
+	b.ExportRevenue += o.ExportRevenue
+	b.EVCost += o.EVCost
+	b.UnpricedKWh += o.UnpricedKWh
+}
+
+// energyLedger integrates grid and EV power into hourly buckets. Grid power
+// comes from the same per-phase events as the consumer, EV power from the
+// charger's current.
+type energyLedger struct {
+	pricer    energyPricer
+	evCurrent func() float64 // total EV current in A
+	topology  PhaseTopology
+
+	mu          sync.Mutex
+	imports     map[int]float64 // A
+	exports     map[int]float64 // A
+	voltages    map[int]float64
+	directional map[int]bool
+	lastUpdate  time.Time
+	buckets     map[time.Time]*energyBucket
+}
+
+func newEnergyLedger(pricer energyPricer, evCurrent func() float64, topology PhaseTopology) *energyLedger {
+	return &energyLedger{
+		pricer:      pricer,
+		evCurrent:   evCurrent,
+		topology:    topology,
+		imports:     make(map[int]float64),
+		exports:     make(map[int]float64),
+		voltages:    make(map[int]float64),
+		directional: make(map[int]bool),
+		buckets:     make(map[time.Time]*energyBucket),
+	}
+}
+
+// update integrates the power up to now and then applies the reading.
+func (l *energyLedger) update(pe *powerEvent) {
+	l.updateAt(pe, time.Now())
+}
+
+func (l *energyLedger) updateAt(pe *powerEvent, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.lastUpdate.IsZero() && now.Sub(l.lastUpdate) <= maxLedgerGap {
+		l.integrateInternal(l.lastUpdate, now)
+	}
+	l.lastUpdate = now
+
+	flow := phaseFlow{imported: l.imports[pe.phaseIndex], exported: l.exports[pe.phaseIndex], directional: l.directional[pe.phaseIndex]}
+	if flow.apply(pe) {
+		l.imports[pe.phaseIndex], l.exports[pe.phaseIndex], l.directional[pe.phaseIndex] = flow.imported, flow.exported, flow.directional
+	}
+	if pe.sensorType == SensorTypeVoltage {
+		l.voltages[pe.phaseIndex] = pe.value
+	}
+}
+
+func (l *energyLedger) voltageInternal(phase int) float64 {
+	if v := l.voltages[phase]; v > l.topology.nominalVoltage()*0.5 {
+		return v
+	}
+	return l.topology.nominalVoltage()
+}
+
+// integrateInternal adds the current power over [from, to), split at hour
+// boundaries so every part is priced at its own hour.
+func (l *energyLedger) integrateInternal(from time.Time, to time.Time) {
+	importW, exportW := 0.0, 0.0
+	voltageSum := 0.0
+	for _, phase := range l.topology.phases() {
+		v := l.voltageInternal(phase)
+		importW += l.imports[phase] * v
+		exportW += l.exports[phase] * v
+		voltageSum += v
+	}
+	evW := 0.0
+	if l.evCurrent != nil {
+		evW = l.evCurrent() * voltageSum / float64(len(l.topology.phases()))
+	}
+	// The EV is fed by the grid as far as there is import, the rest is solar
+	evSolarW := math.Max(0, evW-importW)
+
+	for from.Before(to) {
+		hour := from.Truncate(time.Hour)
+		end := hour.Add(time.Hour)
+		if to.Before(end) {
+			end = to
+		}
+		hours := end.Sub(from).Hours()
+
+		b := l.bucketInternal(hour)
+		importKWh := importW / 1000 * hours
+		exportKWh := exportW / 1000 * hours
+		evKWh := evW / 1000 * hours
+		evSolarKWh := evSolarW / 1000 * hours
+		b.ImportKWh += importKWh
+		b.ExportKWh += exportKWh
+		b.EVKWh += evKWh
+		b.EVSolarKWh += evSolarKWh
+
+		if price, ok := l.priceInternal(l.pricer.importPrice, from); ok {
+			b.ImportCost += importKWh * price
+			b.EVCost += (evKWh - evSolarKWh) * price
+		} else {
+			b.UnpricedKWh += importKWh
+		}
+		if price, ok := l.priceInternal(l.pricer.exportPrice, from); ok {
+			b.ExportRevenue += exportKWh * price
+		} else {
+			b.UnpricedKWh += exportKWh
+		}
+		from = end
+	}
+}
+
+func (l *energyLedger) priceInternal(price func(time.Time) (float64, bool), t time.Time) (float64, bool) {
+	if l.pricer == nil {
+		return 0, false
+	}
+	return price(t)
+}
+
+func (l *energyLedger) bucketInternal(hour time.Time) *energyBucket {
+	b, ok := l.buckets[hour]
+	if !ok {
+		b = &energyBucket{Start: hour}
+		l.buckets[hour] = b
+	}
+	return b
+}
+
+// hours returns the hourly buckets in [from, to), oldest first.
+func (l *energyLedger) hours(from time.Time, to time.Time) []energyBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []energyBucket
+	for start, b := range l.buckets {
+		if !start.Before(from) && start.Before(to) {
+			out = append(out, *b)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Start.Before(out[j].Start) })
+	return out
+}
+
+// prune drops buckets before a time.
+func (l *energyLedger) prune(before time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for start := range l.buckets {
+		if start.Before(before) {
+			delete(l.buckets, start)
+		}
+	}
+}
+
+// save and load keep the buckets of the current day across restarts.
+func (l *energyLedger) save(path string) error {
+	l.mu.Lock()
+	buckets := make([]energyBucket, 0, len(l.buckets))
+	for _, b := range l.buckets {
+		buckets = append(buckets, *b)
+	}
+	l.mu.Unlock()
+
+	data, err := json.Marshal(buckets)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (l *energyLedger) load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var buckets []energyBucket
+	if err := json.Unmarshal(data, &buckets); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, b := range buckets {
+		b := b
+		l.buckets[b.Start] = &b
+	}
+	return nil
+}
+
+type energyPeak struct {
+	Hour      time.Time `json:"hour"`
+	ImportKWh float64   `json:"import_kwh"`
+}
+
+// energyReport summarises a day or a month.
+type energyReport struct {
+	Period        string         `json:"period"`
+	From          time.Time      `json:"from"`
+	To            time.Time      `json:"to"`
+	ImportKWh     float64        `json:"import_kwh"`
+	ExportKWh     float64        `json:"export_kwh"`
+	EVKWh         float64        `json:"ev_kwh"`
+	EVSolarKWh    float64        `json:"ev_solar_kwh"`
+	SolarShare    float64        `json:"ev_solar_share"`
+	ImportCost    float64        `json:"import_cost"`
+	ExportRevenue float64        `json:"export_revenue"`
+	EVCost        float64        `json:"ev_cost"`
+	NetCost       float64        `json:"net_cost"`
+	UnpricedKWh   float64        `json:"unpriced_kwh"`
+	Peaks         []energyPeak   `json:"peaks"`
+	Rows          []energyBucket `json:"rows"` // hours in daily reports, days in monthly ones
+}
+
+// buildReport totals hourly buckets. Rows are the hours themselves, or whole
+// days when daily is set (monthly reports).
+func buildReport(period string, from time.Time, to time.Time, hours []energyBucket, daily bool) energyReport {
+	report := energyReport{Period: period, From: from, To: to}
+	rows := make(map[time.Time]*energyBucket)
+	for _, h := range hours {
+		report.ImportKWh += h.ImportKWh
+		report.ExportKWh += h.ExportKWh
+		report.EVKWh += h.EVKWh
+		report.EVSolarKWh += h.EVSolarKWh
+		report.ImportCost += h.ImportCost
+		report.ExportRevenue += h.ExportRevenue
+		report.EVCost += h.EVCost
+		report.UnpricedKWh += h.UnpricedKWh
+
+		key := h.Start
+		if daily {
+			y, m, d := h.Start.Date()
+			key = time.Date(y, m, d, 0, 0, 0, 0, h.Start.Location())
+		}
+		row, ok := rows[key]
+		if !ok {
+			row = &energyBucket{Start: key}
+			rows[key] = row
+		}
+		row.add(h)
+
+		report.Peaks = append(report.Peaks, energyPeak{Hour: h.Start, ImportKWh: h.ImportKWh})
+	}
+	if report.EVKWh > 0 {
+		report.SolarShare = report.EVSolarKWh / report.EVKWh
+	}
+	report.NetCost = report.ImportCost - report.ExportRevenue
+
+	sort.Slice(report.Peaks, func(i, j int) bool { return report.Peaks[i].ImportKWh > report.Peaks[j].ImportKWh })
+	if len(report.Peaks) > 3 {
+		report.Peaks = report.Peaks[:3]
+	}
+	for _, row := range rows {
+		report.Rows = append(report.Rows, *row)
+	}
+	sort.Slice(report.Rows, func(i, j int) bool { return report.Rows[i].Start.Before(report.Rows[j].Start) })
+	return report
+}
+
+// summary is a one-paragraph description for notifications.
+func (r energyReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Energy %s: import %.1f kWh (%.2f), export %.1f kWh (%.2f), net cost %.2f.",
+		r.Period, r.ImportKWh, r.ImportCost, r.ExportKWh, r.ExportRevenue, r.NetCost)
+	if r.EVKWh > 0 {
+		fmt.Fprintf(&b, " EV %.1f kWh, cost %.2f, %.0f%% solar.", r.EVKWh, r.EVCost, r.SolarShare*100)
+	}
+	if len(r.Peaks) > 0 {
+		peaks := make([]string, len(r.Peaks))
+		for i, p := range r.Peaks {
+			peaks[i] = fmt.Sprintf("%s %.1f kWh", p.Hour.Format("01-02 15:04"), p.ImportKWh)
+		}
+		fmt.Fprintf(&b, " Peaks: %s.", strings.Join(peaks, ", "))
+	}
+	return b.String()
+}
+
+// write stores the report as <name>.json and <name>.csv in dir.
+func (r energyReport) write(dir string, name string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".json"), data, 0o644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dir, name+".csv"))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"start", "import_kwh", "export_kwh", "ev_kwh", "ev_solar_kwh", "import_cost", "export_revenue", "ev_cost"})
+	for _, row := range r.Rows {
+		w.Write([]string{
+			row.Start.Format(time.RFC3339),
+			fmt.Sprintf("%.3f", row.ImportKWh),
+			fmt.Sprintf("%.3f", row.ExportKWh),
+			fmt.Sprintf("%.3f", row.EVKWh),
+			fmt.Sprintf("%.3f", row.EVSolarKWh),
+			fmt.Sprintf("%.4f", row.ImportCost),
+			fmt.Sprintf("%.4f", row.ExportRevenue),
+			fmt.Sprintf("%.4f", row.EVCost),
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reporter writes the daily and monthly reports. Monthly reports are built
+// from the hourly rows of the daily JSON files, so they survive restarts.
+type reporter struct {
+	ledger *energyLedger
+	dir    string
+	notify func(message string) // nil sends no summaries
+}
+
+func (r *reporter) ledgerPath() string {
+	return filepath.Join(r.dir, "ledger.json")
+}
+
+// daily reports the given day, prunes its buckets and reports the month as
+// well when the day was its last.
+func (r *reporter) daily(day time.Time) (energyReport, error) {
+	y, m, d := day.Date()
+	from := time.Date(y, m, d, 0, 0, 0, 0, day.Location())
+	to := from.AddDate(0, 0, 1)
+
+	report := buildReport(from.Format("2006-01-02"), from, to, r.ledger.hours(from, to), false)
+	if err := report.write(r.dir, "daily-"+report.Period); err != nil {
+		return report, err
+	}
+	log.Printf("REPORT: wrote daily report %s", report.Period)
+	if r.notify != nil {
+		r.notify(report.summary())
+	}
+
+	r.ledger.prune(to)
+	if err := r.ledger.save(r.ledgerPath()); err != nil {
+		log.Printf("REPORT: could not save ledger: %v", err)
+	}
+
+	if to.Day() == 1 {
+		if _, err := r.monthly(from); err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+// monthly reports the given month from the daily report files.
+func (r *reporter) monthly(month time.Time) (energyReport, error) {
+	y, m, _ := month.Date()
+	from := time.Date(y, m, 1, 0, 0, 0, 0, month.Location())
+	to := from.AddDate(0, 1, 0)
+
+	var hours []energyBucket
+	for day := from; day.Before(to); day = day.AddDate(0, 0, 1) {
+		data, err := os.ReadFile(filepath.Join(r.dir, "daily-"+day.Format("2006-01-02")+".json"))
+		if err != nil {
+			continue
+		}
+		var daily energyReport
+		if err := json.Unmarshal(data, &daily); err != nil {
+			log.Printf("REPORT: skipping %s: %v", day.Format("2006-01-02"), err)
+			continue
+		}
+		hours = append(hours, daily.Rows...)
+	}
+
+	report := buildReport(from.Format("2006-01"), from, to, hours, true)
+	if err := report.write(r.dir, "monthly-"+report.Period); err != nil {
+		return report, err
+	}
+	log.Printf("REPORT: wrote monthly report %s", report.Period)
+	if r.notify != nil {
+		r.notify(report.summary())
+	}
+	return report, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// hourlyPricer charges the hour of day as price per kWh and pays half that
+// for export. Hours before 2 have no price.
+type hourlyPricer struct{}
+
+func (hourlyPricer) importPrice(t time.Time) (float64, bool) {
+	return float64(t.Hour()), t.Hour() >= 2
+}
+
+func (hourlyPricer) exportPrice(t time.Time) (float64, bool) {
+	return float64(t.Hour()) / 2, t.Hour() >= 2
+}
+
+// feedLedger repeats a reading every minute over [from, to).
+func feedLedger(l *energyLedger, pe *powerEvent, from time.Time, to time.Time) {
+	for t := from; t.Before(to); t = t.Add(time.Minute) {
+		l.updateAt(pe, t)
+	}
+}
+
+func TestEnergyLedger_IntegratesAndSplitsAtHours(t *testing.T) {
+	ev := 0.0
+	l := newEnergyLedger(hourlyPricer{}, func() float64 { return ev }, TopologySinglePhase)
+	start := time.Date(2024, 5, 1, 2, 30, 0, 0, time.UTC)
+
+	// 10A import at 200V is 2kW, for an hour spanning 02:30-03:30
+	l.updateAt(&powerEvent{sensorType: SensorTypeVoltage, phaseIndex: 1, value: 200}, start)
+	feedLedger(l, &powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 10}, start, start.Add(time.Hour))
+	l.updateAt(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 5}, start.Add(time.Hour))
+	ev = 15 // 3kW charging while still exporting 1kW, so all of it is solar
+	feedLedger(l, &powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 5}, start.Add(time.Hour), start.Add(91*time.Minute))
+
+	hours := l.hours(start.Truncate(time.Hour), start.Add(3*time.Hour))
+	assert.Len(t, hours, 2)
+	assert.InDelta(t, 1.0, hours[0].ImportKWh, 1e-9)
+	assert.InDelta(t, 2.0, hours[0].ImportCost, 1e-9)
+	assert.InDelta(t, 1.0, hours[1].ImportKWh, 1e-9)
+	assert.InDelta(t, 0.5, hours[1].ExportKWh, 1e-9)
+	assert.InDelta(t, 3.0+0.75, hours[1].ImportCost+hours[1].ExportRevenue, 1e-9)
+	assert.InDelta(t, 1.5, hours[1].EVKWh, 1e-9)
+	assert.InDelta(t, 1.5, hours[1].EVSolarKWh, 1e-9)
+	assert.InDelta(t, 0.0, hours[1].EVCost, 1e-9)
+}
+
+func TestEnergyLedger_P1Telegrams(t *testing.T) {
+	telegram, err := parseP1Telegram([]byte(p1TestTelegram))
+	assert.NoError(t, err)
+	l := newEnergyLedger(hourlyPricer{}, nil, TopologyThreePhase)
+	start := time.Date(2024, 5, 1, 4, 0, 0, 0, time.UTC)
+
+	// One telegram a minute for an hour: 1.193kW import, 1.38kW export
+	for at := start; at.Before(start.Add(time.Hour)); at = at.Add(time.Minute) {
+		for _, e := range telegram.events(TopologyThreePhase) {
+			l.updateAt(e, at)
+		}
+	}
+	// Phase 3 goes idle, the next hour only phase 1 and 2 import
+	telegram.exports[3] = 0
+	for at := start.Add(time.Hour); !at.After(start.Add(2 * time.Hour)); at = at.Add(time.Minute) {
+		for _, e := range telegram.events(TopologyThreePhase) {
+			l.updateAt(e, at)
+		}
+	}
+
+	hours := l.hours(start, start.Add(2*time.Hour))
+	assert.Len(t, hours, 2)
+	assert.InDelta(t, 1.193, hours[0].ImportKWh, 1e-6)
+	assert.InDelta(t, 1.38, hours[0].ExportKWh, 1e-6)
+	assert.InDelta(t, 4*1.193, hours[0].ImportCost, 1e-6)
+	assert.InDelta(t, 1.193, hours[1].ImportKWh, 1e-6)
+	assert.InDelta(t, 0.0, hours[1].ExportKWh, 1e-6)
+}
+
+func TestEnergyLedger_ZeroReadingKeepsOtherDirection(t *testing.T) {
+	l := newEnergyLedger(hourlyPricer{}, nil, TopologySinglePhase)
+	start := time.Date(2024, 5, 1, 4, 0, 0, 0, time.UTC)
+	l.updateAt(&powerEvent{sensorType: SensorTypeVoltage, phaseIndex: 1, value: 200}, start)
+
+	// Separate import and export sensors, the idle export one reporting last
+	for at := start; !at.After(start.Add(time.Hour)); at = at.Add(time.Minute) {
+		l.updateAt(&powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 10}, at)
+		l.updateAt(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 0}, at)
+	}
+
+	hours := l.hours(start, start.Add(time.Hour))
+	assert.Len(t, hours, 1)
+	assert.InDelta(t, 2.0, hours[0].ImportKWh, 1e-9)
+	assert.InDelta(t, 0.0, hours[0].ExportKWh, 1e-9)
+}
+
+func TestEnergyLedger_SkipsGapsAndUnpricedHours(t *testing.T) {
+	l := newEnergyLedger(hourlyPricer{}, nil, TopologySinglePhase)
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, start)
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, start.Add(time.Minute))
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, start.Add(time.Hour))
+
+	hours := l.hours(start, start.Add(time.Hour))
+	assert.Len(t, hours, 1)
+	assert.InDelta(t, 2.3/60, hours[0].ImportKWh, 1e-9, "the gap after the first minute is not integrated")
+	assert.InDelta(t, hours[0].ImportKWh, hours[0].UnpricedKWh, 1e-9)
+	assert.Equal(t, 0.0, hours[0].ImportCost)
+}
+
+func TestBuildReport_TotalsAndPeaks(t *testing.T) {
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	var hours []energyBucket
+	for i, kwh := range []float64{1, 4, 2, 5, 3} {
+		hours = append(hours, energyBucket{Start: day.Add(time.Duration(i) * time.Hour), ImportKWh: kwh, ImportCost: kwh,
+			EVKWh: 2, EVSolarKWh: 1, ExportRevenue: 0.5})
+	}
+
+	report := buildReport("2024-05-01", day, day.AddDate(0, 0, 1), hours, false)
+	assert.Equal(t, 15.0, report.ImportKWh)
+	assert.Equal(t, 15.0-2.5, report.NetCost)
+	assert.Equal(t, 0.5, report.SolarShare)
+	assert.Len(t, report.Rows, 5)
+	assert.Len(t, report.Peaks, 3)
+	assert.Equal(t, day.Add(3*time.Hour), report.Peaks[0].Hour)
+	assert.Equal(t, 4.0, report.Peaks[1].ImportKWh)
+	assert.Contains(t, report.summary(), "50% solar")
+
+	monthly := buildReport("2024-05", day, day.AddDate(0, 1, 0), hours, true)
+	assert.Len(t, monthly.Rows, 1)
+	assert.Equal(t, 15.0, monthly.Rows[0].ImportKWh)
+}
+
+func TestReporter_DailyAndMonthlyFiles(t *testing.T) {
+	dir := t.TempDir()
+	l := newEnergyLedger(hourlyPricer{}, nil, TopologySinglePhase)
+	last := time.Date(2024, 5, 31, 10, 0, 0, 0, time.UTC)
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, last)
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, last.Add(time.Minute))
+	l.updateAt(&powerEvent{sensorType: SensorTypeCurrent, phaseIndex: 1, value: 10}, last.AddDate(0, 0, 1))
+
+	var summaries []string
+	r := &reporter{ledger: l, dir: dir, notify: func(message string) { summaries = append(summaries, message) }}
+	_, err := r.daily(last)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"daily-2024-05-31.json", "daily-2024-05-31.csv", "monthly-2024-05.json", "monthly-2024-05.csv", "ledger.json"} {
+		assert.FileExists(t, filepath.Join(dir, name))
+	}
+	assert.Len(t, summaries, 2, "daily and monthly summary")
+
+	data, _ := os.ReadFile(filepath.Join(dir, "monthly-2024-05.json"))
+	var monthly energyReport
+	assert.NoError(t, json.Unmarshal(data, &monthly))
+	assert.InDelta(t, 2.3/60, monthly.ImportKWh, 1e-9)
+	assert.Empty(t, l.hours(last.AddDate(0, 0, -1), last.AddDate(0, 0, 1)), "reported days are pruned")
+
+	reloaded := newEnergyLedger(hourlyPricer{}, nil, TopologySinglePhase)
+	assert.NoError(t, reloaded.load(filepath.Join(dir, "ledger.json")))
+}
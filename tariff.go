@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// spotPricer gives the raw spot price per kWh at a time.
+type spotPricer interface {
+	priceAt(t time.Time) (float64, bool)
+}
+
+// timePeriod is a daily window, possibly spanning midnight, restricted to
+// some days and months. Empty sets match every day or month.
+type timePeriod struct {
+	start, end int          // minutes since midnight, end exclusive, may wrap
+	days       map[int]bool // time.Weekday values
+	months     map[int]bool // time.Month values
+}
+
+func (p timePeriod) contains(t time.Time) bool {
+	if len(p.days) > 0 && !p.days[int(t.Weekday())] {
+		return false
+	}
+	if len(p.months) > 0 && !p.months[int(t.Month())] {
+		return false
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if p.start <= p.end {
+		return minute >= p.start && minute < p.end
+	}
+	return minute >= p.start || minute < p.end
+}
+
+// parseTimePeriod reads "HH:MM-HH:MM[@days][/months]", e.g.
+// "06:00-22:00@mon-fri/nov-mar".
+func parseTimePeriod(spec string) (timePeriod, error) {
+	spec, months, _ := strings.Cut(strings.TrimSpace(spec), "/")
+	window, days, _ := strings.Cut(spec, "@")
+
+	quiet, err := parseQuietHours(window)
+	if err != nil || quiet == nil {
+		return timePeriod{}, fmt.Errorf("invalid time window %q", window)
+	}
+	period := timePeriod{start: quiet.start, end: quiet.end}
+	if period.days, err = parseNameRange(days, weekdayNames); err != nil {
+		return timePeriod{}, err
+	}
+	if period.months, err = parseNameRange(months, monthNames); err != nil {
+		return timePeriod{}, err
+	}
+	return period, nil
+}
+
+// gridFeePeriod is a time-of-use grid fee.
+type gridFeePeriod struct {
+	timePeriod
+	fee float64
+}
+
+// tariff turns the spot price into what is actually paid for import and
+// credited for export, all amounts per kWh in the currency of the spot price.
+type tariff struct {
+	spot               spotPricer
+	markup             float64 // supplier markup
+	gridFee            float64 // transfer fee outside the time-of-use periods
+	gridFeePeriods     []gridFeePeriod
+	energyTax          float64
+	vat                float64 // fraction, 0.25 for 25%
+	exportFee          float64 // deducted by the supplier from the spot price
+	exportTaxReduction float64
+}
+
+// importPrice is (spot + markup + grid fee + energy tax) plus VAT.
+func (t *tariff) importPrice(at time.Time) (float64, bool) {
+	spot, ok := t.spot.priceAt(at)
+	if !ok {
+		return 0, false
+	}
+	return (spot + t.markup + t.gridFeeAt(at) + t.energyTax) * (1 + t.vat), true
+}
+
+// exportPrice is spot minus the export fee plus the tax reduction. Private
+// sellers do not charge VAT on export.
+func (t *tariff) exportPrice(at time.Time) (float64, bool) {
+	spot, ok := t.spot.priceAt(at)
+	if !ok {
+		return 0, false
+	}
+	return spot - t.exportFee + t.exportTaxReduction, true
+}
+
+// gridFeeAt returns the fee of the first matching time-of-use period.
+func (t *tariff) gridFeeAt(at time.Time) float64 {
+	local := at.In(time.Local)
+	for _, p := range t.gridFeePeriods {
+		if p.contains(local) {
+			return p.fee
+		}
+	}
+	return t.gridFee
+}
+
+func (t *tariff) String() string {
+	return fmt.Sprintf("markup %.4f, grid fee %.4f (%d time-of-use periods), energy tax %.4f, VAT %.0f%%, export fee %.4f, export tax reduction %.4f",
+		t.markup, t.gridFee, len(t.gridFeePeriods), t.energyTax, t.vat*100, t.exportFee, t.exportTaxReduction)
+}
+
+// weekdayNames and monthNames map names to time.Weekday and time.Month
+// values.
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+// parseGridFee reads "fee[,HH:MM-HH:MM[@days][/months]=fee...]", e.g.
+// "0.20,06:00-22:00@mon-fri/nov-mar=0.55". The first value is the fee
+// outside the periods, the first matching period wins.
+func parseGridFee(s string) (float64, []gridFeePeriod, error) {
+	entries := strings.Split(s, ",")
+	base := 0.0
+	if first := strings.TrimSpace(entries[0]); first != "" {
+		fee, err := strconv.ParseFloat(first, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid grid fee %q: %v", first, err)
+		}
+		base = fee
+	}
+
+	var periods []gridFeePeriod
+	for _, entry := range entries[1:] {
+		spec, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return 0, nil, fmt.Errorf("invalid grid fee period %q, expected HH:MM-HH:MM[@days][/months]=fee", entry)
+		}
+		fee, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid grid fee %q: %v", value, err)
+		}
+		period, err := parseTimePeriod(spec)
+		if err != nil {
+			return 0, nil, err
+		}
+		periods = append(periods, gridFeePeriod{timePeriod: period, fee: fee})
+	}
+	return base, periods, nil
+}
+
+// parseNameRange reads "mon-fri", "sat+sun" or "nov-mar" (ranges may wrap)
+// into a set of values. An empty string gives an empty set.
+func parseNameRange(s string, names map[string]int) (map[int]bool, error) {
+	set := make(map[int]bool)
+	for _, part := range strings.Split(s, "+") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
+			continue
+		}
+		from, to, isRange := strings.Cut(part, "-")
+		first, ok := names[from]
+		if !ok {
+			return nil, fmt.Errorf("unknown day or month %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = names[to]; !ok {
+				return nil, fmt.Errorf("unknown day or month %q", to)
+			}
+		}
+		// Weekdays count from 0 and months from 1
+		base := 0
+		if _, ok := names["jan"]; ok {
+			base = 1
+		}
+		for v := first; ; v = base + (v-base+1)%len(names) {
+			set[v] = true
+			if v == last {
+				break
+			}
+		}
+	}
+	return set, nil
+}
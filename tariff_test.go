@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fixedSpot float64
+
+func (f fixedSpot) priceAt(t time.Time) (float64, bool) {
+	return float64(f), true
+}
+
+func TestParseGridFee(t *testing.T) {
+	base, periods, err := parseGridFee("0.20, 06:00-22:00@mon-fri/nov-mar=0.55, 22:00-06:00@sat+sun=0.10")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.20, base)
+	assert.Len(t, periods, 2)
+	assert.Equal(t, map[int]bool{1: true, 2: true, 3: true, 4: true, 5: true}, periods[0].days)
+	assert.Equal(t, map[int]bool{11: true, 12: true, 1: true, 2: true, 3: true}, periods[0].months)
+	assert.Equal(t, map[int]bool{0: true, 6: true}, periods[1].days)
+
+	base, periods, err = parseGridFee("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, base)
+	assert.Empty(t, periods)
+
+	_, _, err = parseGridFee("0.2,06:00-22:00@someday=0.5")
+	assert.Error(t, err)
+	_, _, err = parseGridFee("0.2,06:00-22:00")
+	assert.Error(t, err)
+}
+
+func TestTariff_ImportAndExportPrice(t *testing.T) {
+	base, periods, _ := parseGridFee("0.20,06:00-22:00@mon-fri/nov-mar=0.60")
+	tr := &tariff{spot: fixedSpot(1.0), markup: 0.05, gridFee: base, gridFeePeriods: periods,
+		energyTax: 0.40, vat: 0.25, exportFee: 0.03, exportTaxReduction: 0.6}
+
+	winterWeekday := time.Date(2024, 1, 10, 12, 0, 0, 0, time.Local)
+	price, ok := tr.importPrice(winterWeekday)
+	assert.True(t, ok)
+	assert.InDelta(t, (1.0+0.05+0.60+0.40)*1.25, price, 1e-9)
+
+	winterNight := time.Date(2024, 1, 10, 23, 0, 0, 0, time.Local)
+	price, _ = tr.importPrice(winterNight)
+	assert.InDelta(t, (1.0+0.05+0.20+0.40)*1.25, price, 1e-9)
+
+	summerWeekday := time.Date(2024, 6, 12, 12, 0, 0, 0, time.Local)
+	price, _ = tr.importPrice(summerWeekday)
+	assert.InDelta(t, (1.0+0.05+0.20+0.40)*1.25, price, 1e-9)
+
+	price, ok = tr.exportPrice(winterWeekday)
+	assert.True(t, ok)
+	assert.InDelta(t, 1.0-0.03+0.6, price, 1e-9)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PhaseTopology describes how the installation is connected to the grid.
+type PhaseTopology int
+
+const (
+	TopologyThreePhase PhaseTopology = iota
+	TopologySinglePhase
+	// TopologySplitPhase is the North American 240V service made of two
+	// 120V legs.
+	TopologySplitPhase
+)
+
+func (t PhaseTopology) String() string {
+	switch t {
+	case TopologySinglePhase:
+		return "1phase"
+	case TopologySplitPhase:
+		return "split"
+	default:
+		return "3phase"
+	}
+}
+
+// phaseCount returns the number of metered phases (or legs).
+func (t PhaseTopology) phaseCount() int {
+	switch t {
+	case TopologySinglePhase:
+		return 1
+	case TopologySplitPhase:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// nominalVoltage is the phase-to-neutral voltage used when no voltage sensor
+// has reported yet.
+func (t PhaseTopology) nominalVoltage() float64 {
+	if t == TopologySplitPhase {
+		return 120.0
+	}
+	return 230.0
+}
+
+// phases returns the 1-based indices of all phases in the installation.
+func (t PhaseTopology) phases() []int {
+	phases := make([]int, t.phaseCount())
+	for i := range phases {
+		phases[i] = i + 1
+	}
+	return phases
+}
+
+func parsePhaseTopology(s string) (PhaseTopology, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "3", "3phase", "three":
+		return TopologyThreePhase, nil
+	case "1", "1phase", "single":
+		return TopologySinglePhase, nil
+	case "split", "split-phase", "splitphase":
+		return TopologySplitPhase, nil
+	}
+	return TopologyThreePhase, fmt.Errorf("unknown phase topology %q", s)
+}
+
+// parseChargerPhases parses a comma separated list of the installation phases
+// a charger is wired to, e.g. "1" or "1,2,3". An empty string means all
+// phases of the topology.
+func parseChargerPhases(s string, topology PhaseTopology) ([]int, error) {
+	if strings.TrimSpace(s) == "" {
+		return topology.phases(), nil
+	}
+
+	var phases []int
+	seen := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(part)), "L")
+		phase, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid charger phase %q", part)
+		}
+		if phase < 1 || phase > topology.phaseCount() {
+			return nil, fmt.Errorf("charger phase %d is outside the %s topology", phase, topology)
+		}
+		if !seen[phase] {
+			seen[phase] = true
+			phases = append(phases, phase)
+		}
+	}
+	return phases, nil
+}
+
+// parsePhaseRotation parses the installation phase each charger terminal is
+// connected to, in terminal order. "L2L3L1" (or "2,3,1") means the charger's
+// L1 is on installation phase 2, L2 on phase 3 and L3 on phase 1. An empty
+// string means no rotation.
+func parsePhaseRotation(s string, topology PhaseTopology) ([]int, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	if s == "" {
+		return topology.phases(), nil
+	}
+
+	var parts []string
+	if strings.Contains(s, ",") {
+		parts = strings.Split(s, ",")
+	} else {
+		parts = strings.Split(strings.ReplaceAll(s, "L", " "), " ")
+	}
+
+	var rotation []int
+	seen := make(map[int]bool)
+	for _, part := range parts {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "L")
+		if part == "" {
+			continue
+		}
+		phase, err := strconv.Atoi(part)
+		if err != nil || phase < 1 || phase > topology.phaseCount() {
+			return nil, fmt.Errorf("invalid phase %q in rotation %q", part, s)
+		}
+		if seen[phase] {
+			return nil, fmt.Errorf("phase %d appears twice in rotation %q", phase, s)
+		}
+		seen[phase] = true
+		rotation = append(rotation, phase)
+	}
+	if len(rotation) != topology.phaseCount() {
+		return nil, fmt.Errorf("rotation %q must list all %d phases", s, topology.phaseCount())
+	}
+	return rotation, nil
+}
+
+// mapChargerPhases orders the wired installation phases by charger terminal,
+// so the first entry is the phase a single-phase car draws from. The consumer
+// assumes that phase until it has detected the car's phases.
+func mapChargerPhases(rotation []int, wired []int) []int {
+	isWired := make(map[int]bool)
+	for _, phase := range wired {
+		isWired[phase] = true
+	}
+	var mapped []int
+	for _, phase := range rotation {
+		if isWired[phase] {
+			mapped = append(mapped, phase)
+		}
+	}
+	return mapped
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuomaz/gohaws"
+)
+
+func TestParsePhaseTopology(t *testing.T) {
+	topology, err := parsePhaseTopology("split")
+	assert.NoError(t, err)
+	assert.Equal(t, TopologySplitPhase, topology)
+	assert.Equal(t, 2, topology.phaseCount())
+	assert.Equal(t, 120.0, topology.nominalVoltage())
+
+	topology, err = parsePhaseTopology("1phase")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1}, topology.phases())
+
+	_, err = parsePhaseTopology("4phase")
+	assert.Error(t, err)
+}
+
+func TestParseChargerPhases(t *testing.T) {
+	phases, err := parseChargerPhases("", TopologyThreePhase)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3}, phases)
+
+	phases, err = parseChargerPhases("L2, 2", TopologyThreePhase)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2}, phases)
+
+	_, err = parseChargerPhases("3", TopologySplitPhase)
+	assert.Error(t, err, "Split-phase only has two legs")
+}
+
+func TestPowerService_SplitPhase(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *event, 10)
+	ps := newPowerService(ctx, events, &haService{}, []phaseSensors{
+		{export: "sensor.export_l1"},
+		{export: "sensor.export_l2"},
+		{export: "sensor.export_l3"},
+	}, TopologySplitPhase, 100, p1Source{}, modbusSource{})
+
+	send := func(entity string, state string) {
+		ps.haChannel <- &gohaws.Message{
+			Event: &gohaws.Event{
+				Data: &gohaws.Data{
+					EntityID: entity,
+					NewState: &gohaws.State{State: state},
+				},
+			},
+		}
+	}
+
+	// The third sensor is outside the topology and must be ignored.
+	send("sensor.export_l3", "1.2")
+	send("sensor.export_l2", "1.2")
+
+	select {
+	case e := <-events:
+		assert.Equal(t, 2, e.powerEvent.phaseIndex)
+		// 1.2kW at the 120V split-phase fallback voltage
+		assert.InDelta(t, 10.0, e.powerEvent.value, 0.001)
+	case <-time.After(time.Second):
+		t.Fatal("expected a power event")
+	}
+	assert.Len(t, events, 0)
+}
+
+func TestDawnConsumer_SplitPhaseChargerCurrentIsPerLeg(t *testing.T) {
+	service := &dawnConsumerService{topology: TopologySplitPhase, phases: TopologySplitPhase.phases()}
+
+	// 16A through a 240V charger across both legs
+	service.dawnCurrentInternal(16)
+	assert.Equal(t, 16.0, service.actualAmps)
+	assert.Equal(t, 32.0, service.evCurrent(), "16A on each of the two legs")
+
+	ledger := newEnergyLedger(hourlyPricer{}, service.evCurrent, TopologySplitPhase)
+	start := time.Date(2024, 5, 1, 4, 0, 0, 0, time.UTC)
+	feedLedger(ledger, &powerEvent{sensorType: SensorTypeImport, phaseIndex: 1, value: 16}, start, start.Add(time.Hour+time.Minute))
+	hours := ledger.hours(start, start.Add(time.Hour))
+	assert.Len(t, hours, 1)
+	assert.InDelta(t, 16*240/1000.0, hours[0].EVKWh, 1e-9)
+
+	// Three-phase: the sensor is the sum over the car's phases
+	service = &dawnConsumerService{}
+	service.dawnCurrentInternal(30)
+	assert.Equal(t, 10.0, service.actualAmps)
+	assert.Equal(t, 30.0, service.evCurrent())
+}
+
+func TestDawnConsumer_SinglePhaseChargerStart(t *testing.T) {
+	service := &dawnConsumerService{
+		pvOnlyMode:         true,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		phases:             []int{1, 2, 3},
+		chargerPhases:      []int{1},
+		exports:            make(map[string]float64),
+		currents:           make(map[string]float64),
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+	}
+
+	// 7A surplus is enough for a single-phase 6A start.
+	service.updateCurrents(&powerEvent{sensorType: SensorTypeExport, phaseIndex: 1, value: 7.0})
+	service.calculateAndSetAmps()
+	assert.False(t, service.pvSurplusStartTime.IsZero(), "Single-phase charger should only need 6A surplus")
+}
+
+func TestParsePhaseRotation(t *testing.T) {
+	rotation, err := parsePhaseRotation("L2L3L1", TopologyThreePhase)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3, 1}, rotation)
+
+	rotation, err = parsePhaseRotation("3,1,2", TopologyThreePhase)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 1, 2}, rotation)
+
+	_, err = parsePhaseRotation("L1L1L2", TopologyThreePhase)
+	assert.Error(t, err)
+
+	_, err = parsePhaseRotation("L1L2", TopologyThreePhase)
+	assert.Error(t, err)
+
+	// A single-phase car on a rotated charger draws from installation phase 2
+	assert.Equal(t, []int{2, 3, 1}, mapChargerPhases([]int{2, 3, 1}, []int{1, 2, 3}))
+	assert.Equal(t, []int{3, 1}, mapChargerPhases([]int{2, 3, 1}, []int{1, 3}))
+}
+
+func TestDawnConsumer_PhaseDetection(t *testing.T) {
+	service := &dawnConsumerService{
+		isCharging:         true,
+		currentAmps:        10.0,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		exports:            make(map[string]float64),
+		currents:           map[string]float64{"phase1": 4.0, "phase2": 5.0, "phase3": 3.0},
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{Setpoint: 20.0},
+	}
+
+	service.beginPhaseDetectionInternal()
+	service.phaseDetectStart = time.Now().Add(-2 * phaseDetectDelay)
+
+	// A single-phase car draws 10A on phase 1 only.
+	service.actualTotalAmps = 10.0
+	service.currents["phase1"] = 14.0
+	service.currents["phase2"] = 5.5
+	service.calculateAndSetAmps()
+
+	assert.Equal(t, []int{1}, service.activePhases)
+	assert.Equal(t, 10.0, service.actualAmps, "All of the draw is on one phase")
+
+	// An overload on a phase the car does not use must not reduce the charger.
+	service.currents["phase2"] = 24.0
+	service.calculateAndSetAmps()
+	assert.Equal(t, 10.0, service.currentAmps)
+
+	// An overload on the car's phase does.
+	service.currents["phase1"] = 23.0
+	service.calculateAndSetAmps()
+	assert.Equal(t, 7.0, service.currentAmps)
+}
+
+func TestDawnConsumer_ExternalStartSkipsPhaseDetection(t *testing.T) {
+	service := &dawnConsumerService{
+		currentAmps:        10.0,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		exports:            make(map[string]float64),
+		currents:           map[string]float64{"phase1": 14.0, "phase2": 5.0, "phase3": 3.0},
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{Setpoint: 20.0},
+	}
+
+	// The car was started outside the service and already draws 10A on phase 1
+	service.connectorStatusInternal("charging")
+	assert.True(t, service.isCharging)
+	assert.Nil(t, service.phaseBaseline, "a snapshot now would include the car")
+
+	service.actualTotalAmps = 10.0
+	service.phaseDetectStart = time.Now().Add(-2 * phaseDetectDelay)
+	service.detectPhasesInternal()
+	assert.Nil(t, service.activePhases)
+	assert.Equal(t, []int{1, 2, 3}, service.controlPhaseList(), "all charger phases")
+}
+
+func TestDawnConsumer_RotationAssumesFirstTerminal(t *testing.T) {
+	rotation, err := parsePhaseRotation("L2L3L1", TopologyThreePhase)
+	assert.NoError(t, err)
+	service := &dawnConsumerService{
+		pvOnlyMode:         true,
+		minimumAmps:        6.0,
+		maximumAmps:        16.0,
+		setpoint:           20.0,
+		phases:             []int{1, 2, 3},
+		chargerPhases:      mapChargerPhases(rotation, []int{1, 2, 3}),
+		assumeFirstPhase:   true,
+		exports:            map[string]float64{"phase1": 0, "phase2": 7.0, "phase3": 0},
+		currents:           map[string]float64{"phase1": 0, "phase2": 0, "phase3": 0},
+		hasDirectionalData: make(map[string]bool),
+		haService:          &haService{},
+		pid:                &PIDController{},
+	}
+
+	// Charger L1 is on phase 2, so 7A there covers a single-phase start
+	assert.Equal(t, []int{2}, service.controlPhaseList())
+	service.calculateAndSetAmps()
+	assert.False(t, service.pvSurplusStartTime.IsZero())
+
+	// Hard safety still watches every charger phase until detection
+	assert.Equal(t, []int{2, 3, 1}, service.safetyPhaseList())
+	service.isCharging = true
+	service.currentAmps, service.actualAmps = 10, 10
+	service.currents["phase1"] = 24.0
+	service.safetyCheck()
+	assert.Equal(t, 6.0, service.currentAmps)
+
+	// Detection wins over the assumption, switching to all phases drops it
+	service.activePhases = []int{3}
+	assert.Equal(t, []int{3}, service.controlPhaseList())
+	service.activePhases = nil
+	service.phaseSwitchTried = true
+	assert.Equal(t, []int{2, 3, 1}, service.controlPhaseList())
+}
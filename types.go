@@ -1,5 +1,10 @@
 package main
 
+import (
+	"fmt"
+	"strings"
+)
+
 type Notification struct {
 	Title   string `json:"title,omitempty"`
 	Message string `json:"message,omitempty"`
@@ -12,6 +17,8 @@ const (
 	SensorTypeImport
 	SensorTypeExport
 	SensorTypeVoltage
+	SensorTypePowerFactor
+	SensorTypeProduction // PV production in W, not per phase
 )
 
 type powerEvent struct {
@@ -19,7 +26,44 @@ type powerEvent struct {
 	phase       string
 	value       float64
 	overCurrent float64
-	phaseIndex  int // 1, 2, or 3
+	phaseIndex  int // 1-based phase (or split-phase leg) index
+}
+
+// phaseFlow is the import and export current of one phase as built up from
+// readings.
+type phaseFlow struct {
+	imported    float64
+	exported    float64
+	directional bool // import or export readings have been seen
+}
+
+// apply applies an import, export or absolute current reading and reports
+// whether the event was one. A non-zero reading clears the other direction; a
+// zero reading is the idle side of a meter or a pair of HA sensors reporting
+// both directions, and leaves the active one alone. An absolute current is
+// taken as import only until directional readings have been seen.
+func (f *phaseFlow) apply(pe *powerEvent) bool {
+	switch pe.sensorType {
+	case SensorTypeImport:
+		f.imported = pe.value
+		if pe.value > 0 {
+			f.exported = 0
+		}
+		f.directional = true
+	case SensorTypeExport:
+		f.exported = pe.value
+		if pe.value > 0 {
+			f.imported = 0
+		}
+		f.directional = true
+	case SensorTypeCurrent:
+		if !f.directional {
+			f.imported = pe.value
+		}
+	default:
+		return false
+	}
+	return true
 }
 
 type priceEvent struct {
@@ -29,3 +73,42 @@ type event struct {
 	powerEvent *powerEvent
 	priceEvent *priceEvent
 }
+
+// ExportAccounting selects how per-phase import and export are combined into
+// the surplus that drives PV-only charging.
+type ExportAccounting int
+
+const (
+	// AccountingSummed nets export against import across all phases. This
+	// matches meters that bill the sum of the phases.
+	AccountingSummed ExportAccounting = iota
+	// AccountingPerPhaseStrict only counts surplus that is available on every
+	// phase, so no single phase is allowed to import.
+	AccountingPerPhaseStrict
+	// AccountingPerPhaseWeighted nets each phase separately and weights
+	// imports more heavily than exports.
+	AccountingPerPhaseWeighted
+)
+
+func (a ExportAccounting) String() string {
+	switch a {
+	case AccountingPerPhaseStrict:
+		return "per_phase"
+	case AccountingPerPhaseWeighted:
+		return "weighted"
+	default:
+		return "summed"
+	}
+}
+
+func parseExportAccounting(s string) (ExportAccounting, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "summed", "sum":
+		return AccountingSummed, nil
+	case "per_phase", "strict":
+		return AccountingPerPhaseStrict, nil
+	case "weighted":
+		return AccountingPerPhaseWeighted, nil
+	}
+	return AccountingSummed, fmt.Errorf("unknown export accounting model %q", s)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tuomaz/gohaws"
+)
+
+// stateUnit returns the unit_of_measurement reported with an HA state.
+func stateUnit(state *gohaws.State) string {
+	if state == nil {
+		return ""
+	}
+	if state.UnitOfMeasurement != "" {
+		return state.UnitOfMeasurement
+	}
+	if unit, ok := state.Attributes["unit_of_measurement"]; ok {
+		return fmt.Sprintf("%v", unit)
+	}
+	return ""
+}
+
+// statePowerFactor returns a power_factor attribute reported with an HA state.
+func statePowerFactor(state *gohaws.State) (float64, bool) {
+	if state == nil {
+		return 0, false
+	}
+	value, ok := state.Attributes["power_factor"]
+	if !ok {
+		return 0, false
+	}
+	return normalizePowerFactor(parseFloat(value), ""), true
+}
+
+// normalizePowerFactor turns a power factor reading into 0..1, accepting
+// percent readings. Invalid readings are treated as unity.
+func normalizePowerFactor(value float64, unit string) float64 {
+	if value < 0 {
+		value = -value
+	}
+	if unit == "%" || value > 1 {
+		value /= 100
+	}
+	if value < 0.1 || value > 1 {
+		return 1
+	}
+	return value
+}
+
+// toAmps converts a current, power or apparent power reading to RMS amps.
+// Active power is divided by the power factor, so the result is the current
+// the fuse sees. An empty unit is read as defaultUnit.
+func toAmps(value float64, unit string, defaultUnit string, voltage float64, powerFactor float64) (float64, error) {
+	if unit == "" {
+		unit = defaultUnit
+	}
+	if powerFactor <= 0 || powerFactor > 1 {
+		powerFactor = 1
+	}
+
+	switch strings.TrimSpace(unit) {
+	case "A":
+		return value, nil
+	case "mA":
+		return value / 1000.0, nil
+	case "W":
+		return value / (voltage * powerFactor), nil
+	case "kW":
+		return value * 1000.0 / (voltage * powerFactor), nil
+	case "VA":
+		return value / voltage, nil
+	case "kVA":
+		return value * 1000.0 / voltage, nil
+	}
+	return 0, fmt.Errorf("unsupported unit %q", unit)
+}
+
+// toVolts converts a voltage reading to volts.
+func toVolts(value float64, unit string) float64 {
+	switch strings.TrimSpace(unit) {
+	case "kV":
+		return value * 1000.0
+	case "mV":
+		return value / 1000.0
+	}
+	return value
+}
+
+// toWatts converts a power reading to W. An empty unit is read as W.
+func toWatts(value float64, unit string) float64 {
+	switch strings.TrimSpace(unit) {
+	case "kW":
+		return value * 1000.0
+	case "MW":
+		return value * 1000000.0
+	}
+	return value
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tuomaz/gohaws"
+)
+
+func TestToAmps(t *testing.T) {
+	amps, err := toAmps(2.3, "kW", "kW", 230, 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10.0, amps, 0.001)
+
+	amps, err = toAmps(2300, "W", "kW", 230, 1)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10.0, amps, 0.001, "W must not be read as kW")
+
+	amps, err = toAmps(1840, "W", "kW", 230, 0.8)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10.0, amps, 0.001, "Active power is divided by the power factor")
+
+	amps, err = toAmps(2300, "VA", "kW", 230, 0.5)
+	assert.NoError(t, err)
+	assert.InDelta(t, 10.0, amps, 0.001, "Apparent power ignores the power factor")
+
+	amps, err = toAmps(10, "", "A", 230, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 10.0, amps)
+
+	_, err = toAmps(10, "kWh", "kW", 230, 1)
+	assert.Error(t, err)
+}
+
+func TestNormalizePowerFactor(t *testing.T) {
+	assert.Equal(t, 0.9, normalizePowerFactor(0.9, ""))
+	assert.Equal(t, 0.9, normalizePowerFactor(90, "%"))
+	assert.Equal(t, 0.9, normalizePowerFactor(-0.9, ""))
+	assert.Equal(t, 1.0, normalizePowerFactor(0, ""))
+}
+
+func TestToWatts(t *testing.T) {
+	assert.Equal(t, 1500.0, toWatts(1.5, "kW"))
+	assert.Equal(t, 1500.0, toWatts(1500, "W"))
+	assert.Equal(t, 1500.0, toWatts(1500, ""))
+}
+
+func TestPowerService_UnitDetection(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan *event, 10)
+	ps := newPowerService(ctx, events, &haService{}, []phaseSensors{
+		{import_: "sensor.power_l1", powerFactor: "sensor.pf_l1"},
+	}, TopologySinglePhase, 100, p1Source{}, modbusSource{})
+
+	send := func(state *gohaws.State) *powerEvent {
+		ps.haChannel <- &gohaws.Message{
+			Event: &gohaws.Event{
+				Data: &gohaws.Data{EntityID: state.EntityID, NewState: state},
+			},
+		}
+		select {
+		case e := <-events:
+			return e.powerEvent
+		case <-time.After(time.Second):
+			t.Fatal("expected a power event")
+		}
+		return nil
+	}
+
+	// Shelly/Tibber style: W in the attributes
+	e := send(&gohaws.State{
+		EntityID:   "sensor.power_l1",
+		State:      "2300",
+		Attributes: map[string]interface{}{"unit_of_measurement": "W"},
+	})
+	assert.InDelta(t, 10.0, e.value, 0.001)
+
+	// No unit keeps the historical kW behaviour
+	e = send(&gohaws.State{EntityID: "sensor.power_l1", State: "2.3"})
+	assert.InDelta(t, 10.0, e.value, 0.001)
+
+	// A power factor sensor is applied to later readings
+	ps.haChannel <- &gohaws.Message{
+		Event: &gohaws.Event{
+			Data: &gohaws.Data{EntityID: "sensor.pf_l1", NewState: &gohaws.State{State: "80", UnitOfMeasurement: "%"}},
+		},
+	}
+	e = send(&gohaws.State{EntityID: "sensor.power_l1", State: "1.84", UnitOfMeasurement: "kW"})
+	assert.InDelta(t, 10.0, e.value, 0.001)
+}